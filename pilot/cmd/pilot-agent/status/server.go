@@ -52,7 +52,7 @@ const (
 )
 
 var (
-	appProberPattern = regexp.MustCompile(`^/app-health/[^/]+/(livez|readyz)$`)
+	appProberPattern = regexp.MustCompile(`^/app-health/[^/]+/(livez|readyz|startupz)$`)
 )
 
 // KubeAppProbers holds the information about a Kubernetes pod prober.
@@ -99,7 +99,7 @@ func NewServer(config Config) (*Server, error) {
 	// Validate the map key matching the regex pattern.
 	for path, prober := range s.appKubeProbers {
 		if !appProberPattern.Match([]byte(path)) {
-			return nil, fmt.Errorf(`invalid key, must be in form of regex pattern ^/app-health/[^\/]+/(livez|readyz)$`)
+			return nil, fmt.Errorf(`invalid key, must be in form of regex pattern ^/app-health/[^\/]+/(livez|readyz|startupz)$`)
 		}
 		if prober.Port.Type != intstr.Int {
 			return nil, fmt.Errorf("invalid prober config for %v, the port must be int type", path)
@@ -115,6 +115,12 @@ func FormatProberURL(container string) (string, string) {
 		fmt.Sprintf("/app-health/%v/livez", container)
 }
 
+// FormatStartupProberURL returns the HTTP URL that pilot agent will serve to take over the
+// Kubernetes startup prober of the app.
+func FormatStartupProberURL(container string) string {
+	return fmt.Sprintf("/app-health/%v/startupz", container)
+}
+
 // Run opens a the status port and begins accepting probes.
 func (s *Server) Run(ctx context.Context) {
 	log.Infof("Opening status port %d\n", s.statusPort)
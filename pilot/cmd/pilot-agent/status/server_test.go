@@ -72,6 +72,10 @@ func TestNewServer(t *testing.T) {
 			httpProbe: `{"/app-health/hello-world/readyz": {"path": "/hello/sunnyvale", "port": 8080},
 "/app-health/business/livez": {"port": 9090}}`,
 		},
+		// A valid input with a startup prober.
+		{
+			httpProbe: `{"/app-health/hello-world/startupz": {"path": "/hello/started", "port": 8080}}`,
+		},
 		// A valid input without any prober info.
 		{
 			httpProbe: `{}`,
@@ -333,6 +333,10 @@ type NodeMetadata struct {
 	// If not set, no timeout is set.
 	IdleTimeout string `json:"IDLE_TIMEOUT,omitempty"`
 
+	// MinTLSVersion is the minimum TLS version the sidecar accepts for inbound mutual TLS traffic,
+	// TLSv1_2 or TLSv1_3. If not set, the Envoy default is used.
+	MinTLSVersion string `json:"MIN_TLS_VERSION,omitempty"`
+
 	// HTTP10 indicates the application behind the sidecar is making outbound http requests with HTTP/1.0
 	// protocol. It will enable the "AcceptHttp_10" option on the http options for outbound HTTP listeners.
 	// Alpha in 1.1, based on feedback may be turned into an API or change. Set to "1" to enable.
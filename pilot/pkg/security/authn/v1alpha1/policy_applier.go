@@ -408,6 +408,9 @@ func (a v1alpha1PolicyApplier) InboundFilterChain(sdsUdsPath string, node *model
 			},
 		}
 	}
+	if tlsParams := minTLSParameters(meta.MinTLSVersion); tlsParams != nil {
+		tls.CommonTlsContext.TlsParams = tlsParams
+	}
 	mtls := GetMutualTLS(a.policy)
 	if mtls == nil {
 		return nil
@@ -446,3 +449,21 @@ func NewPolicyApplier(policy *authn_v1alpha1.Policy) authn.PolicyApplier {
 		policy: policy,
 	}
 }
+
+// minTLSParameters returns the TLS parameters enforcing the minimum TLS version requested by the
+// sidecar through the MIN_TLS_VERSION node metadata, or nil to keep the Envoy default.
+func minTLSParameters(version string) *auth.TlsParameters {
+	switch version {
+	case "TLSv1_2":
+		return &auth.TlsParameters{
+			TlsMinimumProtocolVersion: auth.TlsParameters_TLSv1_2,
+		}
+	case "TLSv1_3":
+		return &auth.TlsParameters{
+			TlsMinimumProtocolVersion: auth.TlsParameters_TLSv1_3,
+			TlsMaximumProtocolVersion: auth.TlsParameters_TLSv1_3,
+		}
+	default:
+		return nil
+	}
+}
@@ -1078,6 +1078,62 @@ func TestOnInboundFilterChains(t *testing.T) {
 	}
 }
 
+func TestOnInboundFilterChainsMinTLSVersion(t *testing.T) {
+	policy := &authn.Policy{
+		Peers: []*authn.PeerAuthenticationMethod{
+			{
+				Params: &authn.PeerAuthenticationMethod_Mtls{
+					Mtls: &authn.MutualTls{
+						Mode: authn.MutualTls_STRICT,
+					},
+				},
+			},
+		},
+	}
+	cases := []struct {
+		name          string
+		minTLSVersion string
+		expected      *auth.TlsParameters
+	}{
+		{
+			name:     "NotSet",
+			expected: nil,
+		},
+		{
+			name:          "TLSv1_2",
+			minTLSVersion: "TLSv1_2",
+			expected: &auth.TlsParameters{
+				TlsMinimumProtocolVersion: auth.TlsParameters_TLSv1_2,
+			},
+		},
+		{
+			name:          "TLSv1_3",
+			minTLSVersion: "TLSv1_3",
+			expected: &auth.TlsParameters{
+				TlsMinimumProtocolVersion: auth.TlsParameters_TLSv1_3,
+				TlsMaximumProtocolVersion: auth.TlsParameters_TLSv1_3,
+			},
+		},
+		{
+			name:          "Unknown",
+			minTLSVersion: "TLSv1_0",
+			expected:      nil,
+		},
+	}
+	for _, c := range cases {
+		node := &model.Proxy{
+			Metadata: &model.NodeMetadata{MinTLSVersion: c.minTLSVersion},
+		}
+		got := NewPolicyApplier(policy).InboundFilterChain("", node)
+		if len(got) != 1 {
+			t.Fatalf("[%v] expected one filter chain, got %d", c.name, len(got))
+		}
+		if params := got[0].TLSContext.CommonTlsContext.TlsParams; !reflect.DeepEqual(params, c.expected) {
+			t.Errorf("[%v] unexpected TLS parameters, got %v, want %v", c.name, params, c.expected)
+		}
+	}
+}
+
 func constructSDSConfig(name, sdsudspath string) *auth.SdsSecretConfig {
 	gRPCConfig := &core.GrpcService_GoogleGrpc{
 		TargetUri:  sdsudspath,
@@ -13,6 +13,8 @@
 // limitations under the License.
 
 // Package inject implements kube-inject or webhoook autoinject feature to inject sidecar.
+// The package is built against k8s.io/api v0.17.1, so newer pod fields, such as spec.os or
+// seccompProfile, are not available here.
 // This file is focused on rewriting Kubernetes app probers to support mutual TLS.
 package inject
 
@@ -157,6 +159,9 @@ func DumpAppProbers(podspec *corev1.PodSpec) string {
 		if h := updateNamedPort(c.LivenessProbe, portMap); h != nil {
 			out[livez] = h
 		}
+		if h := updateNamedPort(c.StartupProbe, portMap); h != nil {
+			out[status.FormatStartupProberURL(c.Name)] = h
+		}
 	}
 	b, err := json.Marshal(out)
 	if err != nil {
@@ -198,6 +203,9 @@ func rewriteAppHTTPProbe(annotations map[string]string, podSpec *corev1.PodSpec,
 		if hg := convertAppProber(c.LivenessProbe, livez, statusPort); hg != nil {
 			*c.LivenessProbe.HTTPGet = *hg
 		}
+		if hg := convertAppProber(c.StartupProbe, status.FormatStartupProberURL(c.Name), statusPort); hg != nil {
+			*c.StartupProbe.HTTPGet = *hg
+		}
 	}
 }
 
@@ -240,6 +248,13 @@ func createProbeRewritePatch(annotations map[string]string, podSpec *corev1.PodS
 				Value: *after,
 			})
 		}
+		if after := convertAppProber(c.StartupProbe, status.FormatStartupProberURL(c.Name), statusPort); after != nil {
+			patch = append(patch, rfc6902PatchOperation{
+				Op:    "replace",
+				Path:  fmt.Sprintf("/spec/containers/%v/startupProbe/httpGet", i),
+				Value: *after,
+			})
+		}
 	}
 	return patch
 }
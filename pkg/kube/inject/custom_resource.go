@@ -0,0 +1,205 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is focused on injecting the pod templates embedded in custom resources, whose types
+// are unknown to the injector.
+package inject
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// CustomPodTemplate locates the pod templates of the custom resources of APIVersion and Kind.
+type CustomPodTemplate struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// Paths of the pod templates in the resource, as dot separated field names, e.g.
+	// "spec.template" and "spec.canary.template".
+	Paths []string `json:"paths"`
+}
+
+// knativeServingGroup is the API group of Knative Services. Their pod template, at
+// spec.template, holds the annotations of each revision, e.g. its autoscaling settings, which are
+// read like the ones of any pod template once the Service is listed in the custom pod templates.
+// Knative only accepts the injected init containers and emptyDir volumes in a revision with its
+// kubernetes.podspec-init-containers and kubernetes.podspec-volumes-emptydir features enabled,
+// so the Services are not injected unless listed.
+const knativeServingGroup = "serving.knative.dev"
+
+// validateCustomPodTemplates validates the custom pod templates of the params.
+func validateCustomPodTemplates(templates []CustomPodTemplate) error {
+	for i, t := range templates {
+		field := fmt.Sprintf("customPodTemplates[%d]", i)
+		if t.APIVersion == "" || t.Kind == "" {
+			return fmt.Errorf("%s invalid: apiVersion and kind are required", field)
+		}
+		if len(t.Paths) == 0 {
+			return fmt.Errorf("%s invalid: at least one path is required", field)
+		}
+		for _, path := range t.Paths {
+			for _, name := range strings.Split(path, ".") {
+				if name == "" {
+					return fmt.Errorf("%s invalid: path %q has an empty field name", field, path)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// customPodTemplatePaths returns the paths of the pod templates of the custom resource raw, or
+// nil when its type is not configured.
+func customPodTemplatePaths(templates []CustomPodTemplate, raw []byte) []string {
+	var typeMeta metav1.TypeMeta
+	if err := yaml.Unmarshal(raw, &typeMeta); err != nil {
+		return nil
+	}
+	var paths []string
+	for _, t := range templates {
+		if t.APIVersion != typeMeta.APIVersion || t.Kind != typeMeta.Kind {
+			continue
+		}
+		for _, path := range t.Paths {
+			if !containsString(paths, path) {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// warnUnlistedKnativeService warns that the resource raw, left unchanged, is a Knative Service
+// whose pod template would be injected once listed in the custom pod templates.
+func warnUnlistedKnativeService(raw []byte, warnings *injectionWarnings) {
+	var header struct {
+		metav1.TypeMeta `json:",inline"`
+		ObjectMeta      metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := yaml.Unmarshal(raw, &header); err != nil || header.Kind != "Service" ||
+		!strings.HasPrefix(header.APIVersion, knativeServingGroup+"/") {
+		return
+	}
+	warnings.warnf("Knative Service %q is not injected, list %s Service with path spec.template in customPodTemplates, "+
+		"with the kubernetes.podspec-init-containers and kubernetes.podspec-volumes-emptydir Knative features enabled",
+		header.ObjectMeta.Name, header.APIVersion)
+}
+
+// customPodTemplateObject is a pod template of a custom resource, shaped like the built-in
+// workloads so that it is injected like them, along with the type and metadata of the resource.
+type customPodTemplateObject struct {
+	metav1.TypeMeta
+	ObjectMeta metav1.ObjectMeta
+	Spec       customPodTemplateSpec
+}
+
+type customPodTemplateSpec struct {
+	Template corev1.PodTemplateSpec
+}
+
+// DeepCopyObject implements runtime.Object.
+func (o *customPodTemplateObject) DeepCopyObject() runtime.Object {
+	out := &customPodTemplateObject{TypeMeta: o.TypeMeta}
+	o.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	o.Spec.Template.DeepCopyInto(&out.Spec.Template)
+	return out
+}
+
+// intoCustomResource injects the istio proxy into each pod template found at paths in the custom
+// resource raw. The rest of the resource, including the fields of the templates unknown to a pod
+// template, is kept as is. Paths that hold no pod template are
+// reported as warnings.
+func intoCustomResource(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig,
+	raw []byte, paths []string, warnings *injectionWarnings) ([]byte, error) {
+	var resource map[string]interface{}
+	if err := yaml.Unmarshal(raw, &resource); err != nil {
+		return nil, err
+	}
+	var header struct {
+		metav1.TypeMeta `json:",inline"`
+		ObjectMeta      metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := yaml.Unmarshal(raw, &header); err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		fields := strings.Split(path, ".")
+		parent := resource
+		for _, name := range fields[:len(fields)-1] {
+			parent, _ = parent[name].(map[string]interface{})
+		}
+		template, ok := parent[fields[len(fields)-1]].(map[string]interface{})
+		if !ok {
+			warnings.warnf("%s %q has no pod template at %s", header.Kind, header.ObjectMeta.Name, path)
+			continue
+		}
+
+		in := &customPodTemplateObject{TypeMeta: header.TypeMeta, ObjectMeta: header.ObjectMeta}
+		if err := convertThroughJSON(template, &in.Spec.Template); err != nil {
+			return nil, fmt.Errorf("invalid pod template at %s: %v", path, err)
+		}
+		out, err := intoObject(sidecarTemplate, valuesConfig, meshconfig, in, warnings)
+		if err != nil {
+			return nil, err
+		}
+		var injected map[string]interface{}
+		if err := convertThroughJSON(out.(*customPodTemplateObject).Spec.Template, &injected); err != nil {
+			return nil, err
+		}
+		keepUnknownTemplateFields(template, injected)
+		parent[fields[len(fields)-1]] = injected
+	}
+	return yaml.Marshal(resource)
+}
+
+// keepUnknownTemplateFields copies to the injected pod template the fields of the original one
+// that a corev1.PodTemplateSpec does not have, and were dropped when converting to it, e.g. the
+// containerConcurrency and timeoutSeconds of the spec of Knative revisions.
+func keepUnknownTemplateFields(original, injected map[string]interface{}) {
+	for name, value := range original {
+		if _, ok := injected[name]; !ok {
+			injected[name] = value
+		}
+	}
+	originalSpec, _ := original["spec"].(map[string]interface{})
+	injectedSpec, _ := injected["spec"].(map[string]interface{})
+	if injectedSpec == nil {
+		return
+	}
+	for name, value := range originalSpec {
+		if _, ok := injectedSpec[name]; !ok {
+			injectedSpec[name] = value
+		}
+	}
+}
+
+// convertThroughJSON converts in to out, e.g. a generic map to a typed struct, by going through
+// their JSON encoding.
+func convertThroughJSON(in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is focused on previewing the injection as a diff, so that only the changes it makes
+// to the resources are reviewed.
+package inject
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ghodss/yaml"
+	"github.com/pmezard/go-difflib/difflib"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	yamlDecoder "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// diffContextLines is the number of unchanged lines shown around each change.
+const diffContextLines = 3
+
+// IntoResourceFileDiff injects the istio proxy into the kubernetes YAML read from in, like
+// IntoResourceFile, but writes to out a unified diff of each resource instead of the injected
+// YAML. The items of Lists are diffed one by one, and resources left unchanged are omitted. The
+// original resources are compared once marshaled like the injected ones, so that the diff does
+// not include formatting changes.
+func IntoResourceFileDiff(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig,
+	in io.Reader, out io.Writer) error {
+	reader := yamlDecoder.NewYAMLReader(bufio.NewReaderSize(in, 4096))
+	for {
+		raw, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if isEmptyDocument(raw) {
+			continue
+		}
+
+		resources := [][]byte{raw}
+		obj, err := FromRawToObject(raw)
+		if err != nil && !runtime.IsNotRegisteredError(err) {
+			return err
+		}
+		if list, ok := obj.(*corev1.List); ok {
+			resources = resources[:0]
+			for _, item := range list.Items {
+				resources = append(resources, item.Raw)
+			}
+		}
+		for _, resource := range resources {
+			if err = writeResourceDiff(sidecarTemplate, valuesConfig, meshconfig, resource, out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeResourceDiff writes to out the unified diff between the resource raw and its injected
+// version, if they differ. The value of the sensitive env vars is redacted on both sides, unless
+// the values disable it.
+func writeResourceDiff(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig,
+	raw []byte, out io.Writer) error {
+	var outValues outputValues
+	_ = yaml.Unmarshal([]byte(valuesConfig), &outValues)
+
+	original := raw
+	obj, err := FromRawToObject(raw)
+	if err == nil {
+		if original, err = yaml.Marshal(obj); err != nil {
+			return err
+		}
+	} else if !runtime.IsNotRegisteredError(err) {
+		return err
+	}
+	if outValues.SidecarInjectorWebhook.PreserveKeyOrder {
+		// The injected keys keep the order of raw, which is only reformatted.
+		if original, err = keepKeyOrder(raw, raw); err != nil {
+			return err
+		}
+	}
+
+	var injected bytes.Buffer
+	if err = intoResourceFile(sidecarTemplate, valuesConfig, meshconfig, bytes.NewReader(raw), &injected, nil, nil, nil); err != nil {
+		return err
+	}
+	// A single resource was written, along with its document separator.
+	updated := bytes.TrimSuffix(bytes.TrimPrefix(injected.Bytes(), []byte("---\n")), []byte("---\n"))
+	if redactSensitiveEnabled(valuesConfig) {
+		if original, err = redactSensitiveYAML(original); err != nil {
+			return err
+		}
+		if updated, err = redactSensitiveYAML(updated); err != nil {
+			return err
+		}
+	}
+
+	name := resourceName(raw)
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(original)),
+		B:        difflib.SplitLines(string(updated)),
+		FromFile: "a/" + name,
+		ToFile:   "b/" + name,
+		Context:  diffContextLines,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(out, diff)
+	return err
+}
+
+// resourceName returns the name of the resource raw, as "Kind/name".
+func resourceName(raw []byte) string {
+	var header struct {
+		metav1.TypeMeta `json:",inline"`
+		ObjectMeta      metav1.ObjectMeta `json:"metadata"`
+	}
+	_ = yaml.Unmarshal(raw, &header)
+	return header.Kind + "/" + header.ObjectMeta.Name
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIntoResourceFileDiff(t *testing.T) {
+	cases := []struct {
+		in        string
+		wantFiles []string
+	}{
+		{
+			in:        "hello.yaml",
+			wantFiles: []string{"Deployment/hello"},
+		},
+		{
+			// The items of the list are diffed one by one.
+			in:        "list.yaml",
+			wantFiles: []string{"Deployment/hello-v1", "Deployment/hello-v2"},
+		},
+		{
+			// Resources without a pod template have no diff.
+			in: "hello-service.yaml",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			params := newTestParams()
+			in, err := os.Open("testdata/inject/" + c.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = in.Close() }()
+			var out bytes.Buffer
+			if err = IntoResourceFileDiff(loadSidecarTemplate(t), getValues(params, t), params.Mesh, in, &out); err != nil {
+				t.Fatalf("IntoResourceFileDiff() returned an error: %v", err)
+			}
+
+			var files []string
+			for _, line := range strings.SplitAfter(out.String(), "\n") {
+				switch {
+				case strings.HasPrefix(line, "+++ b/"):
+					files = append(files, strings.TrimSpace(strings.TrimPrefix(line, "+++ b/")))
+				case strings.HasPrefix(line, "--- a/"), strings.HasPrefix(line, "@@ "):
+				case strings.HasPrefix(line, "-"):
+					// The injection only adds to the resources declared here.
+					t.Errorf("unexpected removed line %q", line)
+				}
+			}
+			if !reflect.DeepEqual(files, c.wantFiles) {
+				t.Fatalf("got diffs of %v, want %v:\n%s", files, c.wantFiles, out.String())
+			}
+			if len(c.wantFiles) > 0 && !strings.Contains(out.String(), "+        name: istio-proxy\n") {
+				t.Fatalf("the diff does not add the proxy:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestIntoResourceFileDiffRedaction(t *testing.T) {
+	cases := []struct {
+		name          string
+		showSensitive bool
+		want          string
+		notWant       string
+	}{
+		{
+			name:    "redacted",
+			want:    "value: " + redactedValue + "\n",
+			notWant: "hunter2",
+		},
+		{
+			name:          "shown",
+			showSensitive: true,
+			want:          "value: hunter2\n",
+			notWant:       redactedValue,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := newTestParams()
+			params.ShowSensitive = c.showSensitive
+			params.Mesh.DefaultConfig.ProxyMetadata = map[string]string{"API_TOKEN": "hunter2"}
+			in, err := os.Open("testdata/inject/hello.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = in.Close() }()
+			var out bytes.Buffer
+			if err = IntoResourceFileDiff(loadSidecarTemplate(t), getValues(params, t), params.Mesh, in, &out); err != nil {
+				t.Fatalf("IntoResourceFileDiff() returned an error: %v", err)
+			}
+			if !strings.Contains(out.String(), "+          "+c.want) || strings.Contains(out.String(), c.notWant) {
+				t.Fatalf("the diff of the proxy env should contain %q and not %q:\n%s", c.want, c.notWant, out.String())
+			}
+		})
+	}
+}
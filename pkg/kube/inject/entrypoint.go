@@ -0,0 +1,228 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is focused on coordinating the lifecycle of the application with the one of the
+// sidecar: holding the application until the sidecar is ready, either by wrapping its entrypoint
+// or by starting the sidecar first, and letting the application of Jobs stop the sidecar.
+package inject
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// appEntrypointWrapperScript waits for the sidecar to be ready on its status port, then execs the
+// original entrypoint of the application, passed as the arguments of the script.
+const appEntrypointWrapperScript = `until wget -qO /dev/null http://127.0.0.1:%d/healthz/ready; do
+  sleep 1
+done
+exec "$0" "$@"
+`
+
+// proxyStartedHookScript waits for the sidecar to be ready on its status port. It is run by the
+// postStart hook of the sidecar when the application is held until the proxy starts.
+const proxyStartedHookScript = `until wget -qO /dev/null http://127.0.0.1:%d/healthz/ready; do
+  sleep 1
+done
+`
+
+// shouldWrapAppEntrypoint returns whether the entrypoint of the application is wrapped to wait
+// for the sidecar, which pods can opt out of with the preserveAppEntrypoint annotation.
+func shouldWrapAppEntrypoint(annotations map[string]string, spec *SidecarInjectionSpec) bool {
+	if !spec.AppEntrypointWrapper {
+		return false
+	}
+	return annotations[preserveAppEntrypointAnnotation] != "true"
+}
+
+// appEntrypointWrapper returns the index of the container whose entrypoint is wrapped, along with
+// its wrapped command and arguments. The index is -1 when there is nothing to wrap.
+func appEntrypointWrapper(annotations map[string]string, podSpec *corev1.PodSpec, spec *SidecarInjectionSpec,
+	warnings *injectionWarnings) (int, []string, []string) {
+	if !shouldWrapAppEntrypoint(annotations, spec) {
+		return -1, nil, nil
+	}
+	sidecar := FindSidecar(spec.Containers)
+	if sidecar == nil {
+		return -1, nil, nil
+	}
+	statusPort := extractStatusPort(sidecar)
+	// Pilot agent statusPort is not defined, there is no readiness to wait for.
+	if statusPort == -1 {
+		return -1, nil, nil
+	}
+	for i, c := range podSpec.Containers {
+		if c.Name == ProxyContainerName {
+			continue
+		}
+		// The entrypoint of the image is not known to the injector, so it cannot be wrapped.
+		if len(c.Command) == 0 {
+			warnings.warnf("container %q sets no command, its entrypoint is not wrapped to wait for the sidecar", c.Name)
+			return -1, nil, nil
+		}
+		command := []string{"/bin/sh", "-c", fmt.Sprintf(appEntrypointWrapperScript, statusPort)}
+		args := append(append([]string{}, c.Command...), c.Args...)
+		return i, command, args
+	}
+	return -1, nil, nil
+}
+
+// wrapAppEntrypoint wraps the entrypoint of the first application container of the pod so that it
+// blocks until the sidecar is ready.
+func wrapAppEntrypoint(annotations map[string]string, podSpec *corev1.PodSpec, spec *SidecarInjectionSpec,
+	warnings *injectionWarnings) {
+	i, command, args := appEntrypointWrapper(annotations, podSpec, spec, warnings)
+	if i == -1 {
+		return
+	}
+	podSpec.Containers[i].Command = command
+	podSpec.Containers[i].Args = args
+}
+
+// createAppEntrypointPatch generates the patch for webhook.
+func createAppEntrypointPatch(annotations map[string]string, podSpec *corev1.PodSpec, spec *SidecarInjectionSpec) []rfc6902PatchOperation {
+	i, command, args := appEntrypointWrapper(annotations, podSpec, spec, nil)
+	if i == -1 {
+		return nil
+	}
+	return []rfc6902PatchOperation{
+		{
+			Op:    "add",
+			Path:  fmt.Sprintf("/spec/containers/%d/command", i),
+			Value: command,
+		},
+		{
+			Op:    "add",
+			Path:  fmt.Sprintf("/spec/containers/%d/args", i),
+			Value: args,
+		},
+	}
+}
+
+// applyHoldApplicationUntilProxyStarts gives the sidecar a postStart hook waiting for its
+// readiness when the application is held until the proxy starts, as configured by the injection
+// or by the holdApplicationUntilProxyStarts annotation of the pod. The kubelet starts the
+// containers in order, each once the postStart hook of the previous one has completed, so the
+// sidecar is moved first in the pod afterwards. HoldApplicationUntilProxyStarts is left set only
+// when the hook is added.
+func applyHoldApplicationUntilProxyStarts(sic *SidecarInjectionSpec, annotations map[string]string,
+	warnings *injectionWarnings) {
+	if value, ok := annotations[holdApplicationUntilProxyStartsAnnotation]; ok {
+		// validated with the other annotations
+		sic.HoldApplicationUntilProxyStarts, _ = strconv.ParseBool(value)
+	}
+	if !sic.HoldApplicationUntilProxyStarts {
+		return
+	}
+	sic.HoldApplicationUntilProxyStarts = false
+	sidecar := FindSidecar(sic.Containers)
+	if sidecar == nil {
+		return
+	}
+	statusPort := extractStatusPort(sidecar)
+	// Pilot agent statusPort is not defined, there is no readiness to wait for.
+	if statusPort == -1 {
+		warnings.warnf("the %s container has no status port, the application is not held until it starts", ProxyContainerName)
+		return
+	}
+	if sidecar.Lifecycle != nil && sidecar.Lifecycle.PostStart != nil {
+		warnings.warnf("the %s container already sets a postStart hook, the application is not held until it starts",
+			ProxyContainerName)
+		return
+	}
+	if sidecar.Lifecycle == nil {
+		sidecar.Lifecycle = &corev1.Lifecycle{}
+	}
+	sidecar.Lifecycle.PostStart = &corev1.Handler{
+		Exec: &corev1.ExecAction{
+			Command: []string{"/bin/sh", "-c", fmt.Sprintf(proxyStartedHookScript, statusPort)},
+		},
+	}
+	sic.HoldApplicationUntilProxyStarts = true
+}
+
+// moveSidecarFirst moves the sidecar before the other containers of the pod.
+func moveSidecarFirst(podSpec *corev1.PodSpec) {
+	for i, c := range podSpec.Containers {
+		if c.Name != ProxyContainerName {
+			continue
+		}
+		copy(podSpec.Containers[1:i+1], podSpec.Containers[:i])
+		podSpec.Containers[0] = c
+		return
+	}
+}
+
+// createSidecarFirstPatch generates the patch for webhook moving the sidecar, once added, before
+// the other containers of the pod.
+func createSidecarFirstPatch(podSpec *corev1.PodSpec, prevStatus *SidecarInjectionStatus,
+	spec *SidecarInjectionSpec) []rfc6902PatchOperation {
+	if !spec.HoldApplicationUntilProxyStarts {
+		return nil
+	}
+	// The previously injected containers are removed, and the injected ones appended.
+	kept := 0
+	for _, c := range podSpec.Containers {
+		if !containsString(prevStatus.Containers, c.Name) {
+			kept++
+		}
+	}
+	for i, c := range spec.Containers {
+		if c.Name != ProxyContainerName {
+			continue
+		}
+		if kept+i == 0 {
+			return nil
+		}
+		return []rfc6902PatchOperation{{
+			Op:   "move",
+			From: fmt.Sprintf("/spec/containers/%d", kept+i),
+			Path: "/spec/containers/0",
+		}}
+	}
+	return nil
+}
+
+// ProxyQuitURLEnv is the variable the application containers of Jobs get the URL that stops the
+// proxy in, when enabled.
+const ProxyQuitURLEnv = "ISTIO_QUIT_URL"
+
+// applyJobProxyQuitEnv gives the application containers of Jobs and CronJobs the URL of the quit
+// endpoint of the pilot agent. The proxy cannot tell when the application is done, so it is up
+// to the application to stop it, for the pod to complete.
+func applyJobProxyQuitEnv(typeMeta *metav1.TypeMeta, podSpec *corev1.PodSpec, spec *SidecarInjectionSpec) {
+	if !spec.JobProxyQuitEnv || (typeMeta.Kind != "Job" && typeMeta.Kind != "CronJob") {
+		return
+	}
+	sidecar := FindSidecar(spec.Containers)
+	if sidecar == nil {
+		return
+	}
+	statusPort := extractStatusPort(sidecar)
+	// Pilot agent statusPort is not defined, there is no quit endpoint.
+	if statusPort == -1 {
+		return
+	}
+	env := corev1.EnvVar{Name: ProxyQuitURLEnv, Value: fmt.Sprintf("http://127.0.0.1:%d/quitquitquit", statusPort)}
+	for i := range podSpec.Containers {
+		c := &podSpec.Containers[i]
+		if c.Name == ProxyContainerName || hasEnv(c.Env, env.Name) {
+			continue
+		}
+		c.Env = append(c.Env, env)
+	}
+}
@@ -26,33 +26,117 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
+	"github.com/docker/distribution/reference"
 	"github.com/ghodss/yaml"
 	"github.com/gogo/protobuf/jsonpb"
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
+	"github.com/google/uuid"
 	"github.com/hashicorp/go-multierror"
 
 	"istio.io/api/annotation"
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/pkg/log"
+	"istio.io/pkg/version"
 
 	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/batch/v2alpha1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
 	yamlDecoder "k8s.io/apimachinery/pkg/util/yaml"
 )
 
 type annotationValidationFunc func(value string) error
 
+// Pod annotations understood by the injector that are not part of istio.io/api/annotation.
+const (
+	// sidecarIdleTimeoutAnnotation sets the idle timeout of the connections handled by the sidecar.
+	sidecarIdleTimeoutAnnotation = "sidecar.istio.io/idleTimeout"
+
+	// sidecarDisableAccessLogAnnotation turns off the access log of the sidecar, regardless of the
+	// mesh wide access log settings.
+	sidecarDisableAccessLogAnnotation = "sidecar.istio.io/disableAccessLog"
+
+	// sidecarPortProtocolsAnnotation gives the sidecar protocol hints for the ports of the pod, as a
+	// comma separated list of port:protocol pairs, e.g. "8080:http,9090:grpc".
+	sidecarPortProtocolsAnnotation = "sidecar.istio.io/portProtocols"
+
+	// sidecarLogLevelAnnotation overrides the log level of the sidecar proxy.
+	sidecarLogLevelAnnotation = "sidecar.istio.io/logLevel"
+
+	// sidecarComponentLogLevelAnnotation overrides the per component log levels of the sidecar
+	// proxy, e.g. "misc:error,upstream:debug".
+	sidecarComponentLogLevelAnnotation = "sidecar.istio.io/componentLogLevel"
+
+	// minTLSVersionAnnotation sets the minimum TLS version the sidecar accepts for inbound traffic.
+	// It reaches pilot as the MIN_TLS_VERSION node metadata, which sets the TLS parameters of the
+	// inbound mutual TLS filter chains.
+	minTLSVersionAnnotation = "security.istio.io/minTLSVersion"
+
+	// injectionIDAnnotation carries the unique ID of the injection of the pod, when recorded.
+	injectionIDAnnotation = "sidecar.istio.io/injectionID"
+
+	// preserveAppEntrypointAnnotation opts a pod out of the wrapping of its entrypoint, when
+	// AppEntrypointWrapper is set.
+	preserveAppEntrypointAnnotation = "sidecar.istio.io/preserveAppEntrypoint"
+
+	// holdApplicationUntilProxyStartsAnnotation overrides HoldApplicationUntilProxyStarts for a pod.
+	holdApplicationUntilProxyStartsAnnotation = "sidecar.istio.io/holdApplicationUntilProxyStarts"
+
+	// ownerAnnotation carries the controller owning the pod, when recorded.
+	ownerAnnotation = "sidecar.istio.io/owner"
+
+	// injectorVersionAnnotation carries the version of the injector that injected the pod, when
+	// recorded. Unlike the version of the sidecar.istio.io/status annotation, it does not depend on
+	// the template.
+	injectorVersionAnnotation = "sidecar.istio.io/injectorVersion"
+
+	// safeToEvictAnnotation tells the cluster autoscaler whether it may evict the pod when draining
+	// a node. Pods with emptyDir volumes, such as the ones of the proxy, are not evicted otherwise.
+	safeToEvictAnnotation = "cluster-autoscaler.kubernetes.io/safe-to-evict"
+
+	// proxyMetadataAnnotation overrides entries of the proxyMetadata of the mesh ProxyConfig for
+	// a pod, as a JSON object of env var names to values.
+	proxyMetadataAnnotation = "sidecar.istio.io/proxyMetadata"
+
+	// trustDomainAnnotation overrides the trust domain of the mesh in the identity of the proxy.
+	trustDomainAnnotation = "security.istio.io/trustDomain"
+
+	// sidecarProxyCPULimitAnnotation sets the CPU limit of the sidecar proxy, like
+	// sidecar.istio.io/proxyCPU does for its request.
+	sidecarProxyCPULimitAnnotation = "sidecar.istio.io/proxyCPULimit"
+
+	// sidecarProxyMemoryLimitAnnotation sets the memory limit of the sidecar proxy, like
+	// sidecar.istio.io/proxyMemory does for its request.
+	sidecarProxyMemoryLimitAnnotation = "sidecar.istio.io/proxyMemoryLimit"
+
+	// imagePullSecretsAnnotation lists, comma separated, the names of secrets added to the image
+	// pull secrets of a pod along with the ones of ImagePullSecrets.
+	imagePullSecretsAnnotation = "sidecar.istio.io/imagePullSecrets"
+
+	// proxyEnvAnnotation sets variables in the env of the proxy of a pod, as a JSON or YAML object
+	// of names to values. They override the variables of the same name the injection sets.
+	proxyEnvAnnotation = "sidecar.istio.io/proxyEnv"
+
+	// proxyArgsAnnotation appends arguments to the ones of the proxy of a pod, as a JSON array of
+	// strings. They replace the ones of ExtraProxyArgs.
+	proxyArgsAnnotation = "sidecar.istio.io/proxyArgs"
+)
+
 // per-sidecar policy and status
 var (
 	alwaysValidFunc = func(value string) error {
@@ -64,17 +148,17 @@ var (
 		annotation.SidecarStatus.Name:                             alwaysValidFunc,
 		annotation.SidecarRewriteAppHTTPProbers.Name:              alwaysValidFunc,
 		annotation.SidecarControlPlaneAuthPolicy.Name:             alwaysValidFunc,
-		annotation.SidecarDiscoveryAddress.Name:                   alwaysValidFunc,
+		annotation.SidecarDiscoveryAddress.Name:                   validateDiscoveryAddress,
 		annotation.SidecarProxyImage.Name:                         alwaysValidFunc,
-		annotation.SidecarProxyCPU.Name:                           alwaysValidFunc,
-		annotation.SidecarProxyMemory.Name:                        alwaysValidFunc,
+		annotation.SidecarProxyCPU.Name:                           validateQuantity,
+		annotation.SidecarProxyMemory.Name:                        validateQuantity,
 		annotation.SidecarInterceptionMode.Name:                   validateInterceptionMode,
 		annotation.SidecarBootstrapOverride.Name:                  alwaysValidFunc,
 		annotation.SidecarStatsInclusionPrefixes.Name:             alwaysValidFunc,
 		annotation.SidecarStatsInclusionSuffixes.Name:             alwaysValidFunc,
 		annotation.SidecarStatsInclusionRegexps.Name:              alwaysValidFunc,
-		annotation.SidecarUserVolume.Name:                         alwaysValidFunc,
-		annotation.SidecarUserVolumeMount.Name:                    alwaysValidFunc,
+		annotation.SidecarUserVolume.Name:                         validateUserVolume,
+		annotation.SidecarUserVolumeMount.Name:                    validateUserVolumeMount,
 		annotation.SidecarEnableCoreDump.Name:                     validateBool,
 		annotation.SidecarStatusPort.Name:                         validateStatusPort,
 		annotation.SidecarStatusReadinessInitialDelaySeconds.Name: validateUInt32,
@@ -85,12 +169,39 @@ var (
 		annotation.SidecarTrafficIncludeInboundPorts.Name:         ValidateIncludeInboundPorts,
 		annotation.SidecarTrafficExcludeInboundPorts.Name:         ValidateExcludeInboundPorts,
 		annotation.SidecarTrafficExcludeOutboundPorts.Name:        ValidateExcludeOutboundPorts,
-		annotation.SidecarTrafficKubevirtInterfaces.Name:          alwaysValidFunc,
+		annotation.SidecarTrafficKubevirtInterfaces.Name:          validateKubevirtInterfaces,
+		sidecarIdleTimeoutAnnotation:                              validateDuration,
+		sidecarDisableAccessLogAnnotation:                         validateBool,
+		sidecarPortProtocolsAnnotation:                            validatePortProtocols,
+		sidecarLogLevelAnnotation:                                 validateLogLevel,
+		sidecarComponentLogLevelAnnotation:                        validateComponentLogLevel,
+		minTLSVersionAnnotation:                                   validateMinTLSVersion,
+		preserveAppEntrypointAnnotation:                           validateBool,
+		holdApplicationUntilProxyStartsAnnotation:                 validateBool,
+		injectionIDAnnotation:                                     alwaysValidFunc,
+		ownerAnnotation:                                           alwaysValidFunc,
+		injectorVersionAnnotation:                                 alwaysValidFunc,
+		proxyMetadataAnnotation:                                   validateProxyMetadata,
+		trustDomainAnnotation:                                     validateTrustDomain,
+		sidecarProxyCPULimitAnnotation:                            validateQuantity,
+		sidecarProxyMemoryLimitAnnotation:                         validateQuantity,
+		imagePullSecretsAnnotation:                                validateImagePullSecrets,
+		proxyEnvAnnotation:                                        validateProxyEnv,
+		proxyArgsAnnotation:                                       validateProxyArgs,
+		proxySecurityContextAnnotation:                            validateProxySecurityContext,
 	}
 )
 
+// validateAnnotations returns an error for every annotation known to annotationRegistry whose
+// value is invalid, in the order of their names, so that all of them can be fixed at once.
 func validateAnnotations(annotations map[string]string) (err error) {
-	for name, value := range annotations {
+	names := make([]string, 0, len(annotations))
+	for name := range annotations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := annotations[name]
 		if v, ok := annotationRegistry[name]; ok {
 			if e := v(value); e != nil {
 				err = multierror.Append(err, fmt.Errorf("invalid value '%s' for annotation '%s': %v", value, name, e))
@@ -102,6 +213,83 @@ func validateAnnotations(annotations map[string]string) (err error) {
 	return
 }
 
+// strictAnnotationPrefixes are the prefixes of the annotation keys that, in strict mode, must be
+// known to annotationRegistry.
+var strictAnnotationPrefixes = []string{"sidecar.istio.io/", "traffic.sidecar.istio.io/"}
+
+// validateAnnotationKeys returns an error for every annotation using one of the prefixes of the
+// injector that is not known to it, e.g. a misspelled one, along with the closest known key.
+func validateAnnotationKeys(annotations map[string]string) (err error) {
+	names := make([]string, 0, len(annotations))
+	for name := range annotations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := annotationRegistry[name]; ok || !hasStrictAnnotationPrefix(name) {
+			continue
+		}
+		err = multierror.Append(err, fmt.Errorf("unknown annotation '%s', did you mean '%s'?", name, closestAnnotation(name)))
+	}
+	return
+}
+
+func hasStrictAnnotationPrefix(name string) bool {
+	for _, prefix := range strictAnnotationPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// closestAnnotation returns the known annotation key with the smallest edit distance to name.
+func closestAnnotation(name string) string {
+	known := make([]string, 0, len(annotationRegistry))
+	for k := range annotationRegistry {
+		known = append(known, k)
+	}
+	sort.Strings(known)
+	closest, best := "", -1
+	for _, k := range known {
+		if d := editDistance(name, k); best == -1 || d < best {
+			closest, best = k, d
+		}
+	}
+	return closest
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
 // InjectionPolicy determines the policy for injecting the
 // sidecar proxy into the watched namespace(s).
 type InjectionPolicy string
@@ -134,6 +322,13 @@ const (
 	DefaultIncludeIPRanges              = "*"
 	DefaultIncludeInboundPorts          = "*"
 	DefaultkubevirtInterfaces           = ""
+	DefaultMaxRedirectPorts             = 1000
+)
+
+// The range of ports reserved for Istio, which applications are not expected to use.
+const (
+	reservedPortRangeStart = 15000
+	reservedPortRangeEnd   = 15090
 )
 
 const (
@@ -141,6 +336,11 @@ const (
 	ProxyContainerName = "istio-proxy"
 )
 
+// maxRedirectArgsLength bounds the combined length of the outbound IP range arguments passed to
+// the init container. The kernel caps a single argument at 128KiB; staying well below it leaves
+// room for the rest of the rendered iptables rules.
+const maxRedirectArgsLength = 32 * 1024
+
 // SidecarInjectionSpec collects all container types and volumes for
 // sidecar mesh injection
 type SidecarInjectionSpec struct {
@@ -153,6 +353,82 @@ type SidecarInjectionSpec struct {
 	Volumes             []corev1.Volume               `yaml:"volumes"`
 	DNSConfig           *corev1.PodDNSConfig          `yaml:"dnsConfig"`
 	ImagePullSecrets    []corev1.LocalObjectReference `yaml:"imagePullSecrets"`
+	// MaxContainersPerPod is the maximum number of containers the pod may have once
+	// the sidecar is injected. A value of zero disables the check.
+	MaxContainersPerPod int `yaml:"maxContainersPerPod"`
+	// ShareProcessNamespaceAware indicates whether the proxy is told when it shares the
+	// process namespace of the pod with the application containers.
+	ShareProcessNamespaceAware bool `yaml:"shareProcessNamespaceAware"`
+	// TuneProxyMemoryFromLimit indicates whether the proxy is given a memory threshold
+	// derived from its memory limit.
+	TuneProxyMemoryFromLimit bool `yaml:"tuneProxyMemoryFromLimit"`
+	// Tolerations are merged into the pod tolerations, skipping those the pod already has.
+	Tolerations []corev1.Toleration `yaml:"tolerations"`
+	// ReadinessGates are merged into the pod readiness gates, skipping those the pod already has.
+	ReadinessGates []corev1.PodReadinessGate `yaml:"readinessGates"`
+	// RecordInjectionID indicates whether the pod is annotated with a unique ID of the injection.
+	RecordInjectionID bool `yaml:"recordInjectionID"`
+	// InferPullPolicyFromTag indicates whether the image pull policy of the injected
+	// containers is derived from their image tag.
+	InferPullPolicyFromTag bool `yaml:"inferPullPolicyFromTag"`
+	// MatchPodImagePullPolicy indicates whether the image pull policy of the injected containers
+	// is the one most used by the containers of the pod.
+	MatchPodImagePullPolicy bool `yaml:"matchPodImagePullPolicy"`
+	// DisableServiceLinks indicates whether spec.enableServiceLinks is set to false on pods
+	// that leave it unset.
+	DisableServiceLinks bool `yaml:"disableServiceLinks"`
+	// AppEntrypointWrapper indicates whether the entrypoint of the first application container
+	// is wrapped to wait for the sidecar to be ready.
+	AppEntrypointWrapper bool `yaml:"appEntrypointWrapper"`
+	// TopologyAware indicates whether the proxy is given the name of its node.
+	TopologyAware bool `yaml:"topologyAware"`
+	// DedupeDownwardAPIEnv indicates whether the variables of the injected containers reading a
+	// downward API field or resource already read by another variable reference that one instead.
+	DedupeDownwardAPIEnv bool `yaml:"dedupeDownwardAPIEnv"`
+	// TelemetryUDSAppEnv indicates whether the first application container is given access to
+	// the telemetry UDS of the proxy.
+	TelemetryUDSAppEnv bool `yaml:"telemetryUDSAppEnv"`
+	// MinReadinessInitialDelaySeconds is the floor of the initial delay of the proxy readiness probe.
+	MinReadinessInitialDelaySeconds uint32 `yaml:"minReadinessInitialDelaySeconds"`
+	// ProxyImageRules select the proxy image from the number of containers of the pod.
+	ProxyImageRules []ProxyImageRule `yaml:"proxyImageRules"`
+	// RecordOwner indicates whether the pod is annotated with the controller owning it.
+	RecordOwner bool `yaml:"recordOwner"`
+	// SpotNodeAware indicates whether the proxy drains faster on spot/preemptible nodes.
+	SpotNodeAware bool `yaml:"spotNodeAware"`
+	// CoupleProxyLimitsToRequests indicates whether the proxy limits are dropped when it has no requests.
+	CoupleProxyLimitsToRequests bool `yaml:"coupleProxyLimitsToRequests"`
+	// RequireCNINodeAffinity indicates whether the pod requires nodes running the istio-cni plugin.
+	RequireCNINodeAffinity bool `yaml:"requireCNINodeAffinity"`
+	// NodeDrainAware indicates whether the pod is marked safe to evict by the cluster autoscaler.
+	NodeDrainAware bool `yaml:"nodeDrainAware"`
+	// InitInheritProxyResources indicates whether the init container is given the resources of the proxy.
+	InitInheritProxyResources bool `yaml:"initInheritProxyResources"`
+	// RecordInjectorVersion indicates whether the pod is annotated with the version of the injector.
+	RecordInjectorVersion bool `yaml:"recordInjectorVersion"`
+	// InjectorVersion is the version recorded, when known from the values config.
+	InjectorVersion string `yaml:"injectorVersion"`
+	// ProxyVolumeSizeLimit is the size limit given to the injected emptyDir volumes, if any.
+	ProxyVolumeSizeLimit string `yaml:"proxyVolumeSizeLimit"`
+	// HoldApplicationUntilProxyStarts indicates whether the sidecar is started first, and the
+	// application containers only once it is ready.
+	HoldApplicationUntilProxyStarts bool `yaml:"holdApplicationUntilProxyStarts"`
+	// JobProxyQuitEnv indicates whether the application containers of Jobs and CronJobs are given
+	// the URL that stops the proxy.
+	JobProxyQuitEnv bool `yaml:"jobProxyQuitEnv"`
+	// InitSeccompProfile is the seccomp profile of the istio-init container, if any.
+	InitSeccompProfile string `yaml:"initSeccompProfile"`
+	// ExtraProxyArgs are appended to the arguments of the proxy, unless the pod sets its own.
+	ExtraProxyArgs []string `yaml:"extraProxyArgs"`
+	// SeccompAnnotations are the annotations selecting the seccomp profiles of the injected
+	// containers, added to the pod along with the injection status.
+	SeccompAnnotations map[string]string `json:"-"`
+	// Annotations are the annotations added to the pod, only resolved by BuildSidecar.
+	Annotations map[string]string `json:"-"`
+	// ProxyMergeTrace records how the settings of the proxy container were resolved
+	// from the template, the values config and the pod annotations, in the order they were
+	// applied. It is returned by BuildSidecar and in the injection reports.
+	ProxyMergeTrace []ProxyMergeStep `json:"-"`
 }
 
 // SidecarTemplateData is the data object to which the templated
@@ -208,6 +484,216 @@ type Params struct {
 	SDSEnabled                   bool                   `json:"sdsEnabled"`
 	PodDNSSearchNamespaces       []string               `json:"podDNSSearchNamespaces"`
 	EnableCni                    bool                   `json:"enablecni"`
+	// If set, every document written by kube-inject is prefixed with a `---` marker, including
+	// the first one. Some strict YAML parsers require an explicit start marker for each document.
+	AlwaysEmitDocumentSeparator bool `json:"alwaysEmitDocumentSeparator"`
+	// Maximum number of containers allowed in a pod after injection, e.g. to match a cluster policy.
+	// Injection fails for pods that would exceed it. Zero means no limit.
+	MaxContainersPerPod int `json:"maxContainersPerPod"`
+	// Let the proxy know when the pod sets spec.shareProcessNamespace, so that the agent does not
+	// treat the application processes as its own when handling signals and termination.
+	ShareProcessNamespaceAware bool `json:"shareProcessNamespaceAware"`
+	// Name of a ConfigMap holding the CA bundle, under the root-cert.pem key, that the proxy
+	// uses to verify the control plane certificates. Empty means the default roots are used.
+	ProxyCABundleConfigMap string `json:"proxyCABundleConfigMap"`
+	// Give the proxy a memory threshold derived from its memory limit, so that it can shed load
+	// before it gets OOMKilled. Proxies without a memory limit are left untouched.
+	TuneProxyMemoryFromLimit bool `json:"tuneProxyMemoryFromLimit"`
+	// Tolerations added to every injected pod, e.g. so that mesh pods can be scheduled onto
+	// tainted mesh dedicated nodes. Tolerations the pod already declares are not repeated.
+	ProxyTolerations []corev1.Toleration `json:"proxyTolerations"`
+	// Annotate every injected pod with a UUID generated at injection time, to correlate the
+	// injector logs with the running pods.
+	RecordInjectionID bool `json:"recordInjectionID"`
+	// Derive the image pull policy of the injected containers from their image tag: Always for
+	// mutable tags such as latest, IfNotPresent for pinned ones. Overrides ImagePullPolicy.
+	InferPullPolicyFromTag bool `json:"inferPullPolicyFromTag"`
+	// Give the injected containers the image pull policy set by most containers of the pod, so
+	// that the proxy follows the conventions of the workload. Overrides ImagePullPolicy and
+	// InferPullPolicyFromTag, unless no policy is set by a majority of the containers.
+	MatchPodImagePullPolicy bool `json:"matchPodImagePullPolicy"`
+	// Re-inject pods whose status annotation was written by an injector too old for its schema to
+	// be understood. Their sidecar, detected by name, is replaced. By default such pods are skipped.
+	ReinjectLegacyStatus bool `json:"reinjectLegacyStatus"`
+	// Allocate a stdin and a TTY for the proxy container, so that operators can attach to debug
+	// proxy images interactively.
+	ProxyInteractive bool `json:"proxyInteractive"`
+	// Condition types of the readiness gates added to every injected pod, e.g. to hold traffic
+	// until a controller has programmed the mesh for it. Gates the pod already declares are kept.
+	ReadinessGates []string `json:"readinessGates"`
+	// Set spec.enableServiceLinks to false on injected pods that do not set it, so that the
+	// containers, the proxy included, do not get an environment variable per service of the
+	// namespace. An explicit setting of the pod is kept.
+	DisableServiceLinks bool `json:"disableServiceLinks"`
+	// Wrap the command of the first application container in a script that waits for the sidecar
+	// to be ready, so that the application never runs without the mesh. The application image must
+	// provide /bin/sh and wget, and its container must set a command. Pods can opt out with the
+	// sidecar.istio.io/preserveAppEntrypoint annotation.
+	AppEntrypointWrapper bool `json:"appEntrypointWrapper"`
+	// Make sure the proxy gets the name of its node through the downward API, in the NODE_NAME
+	// variable, for topology aware routing.
+	TopologyAware bool `json:"topologyAware"`
+	// Declare the variables of the injected containers that read the same downward API field or
+	// resource as an earlier variable, e.g. ISTIO_META_POD_NAME and POD_NAME, as a $(VAR) reference
+	// to that variable, so that each source is read once. Both names stay defined.
+	DedupeDownwardAPIEnv bool `json:"dedupeDownwardAPIEnv"`
+	// Fail the injection of pods carrying sidecar.istio.io/ or traffic.sidecar.istio.io/
+	// annotations unknown to the injector, e.g. misspelled ones that would be silently ignored.
+	StrictAnnotations bool `json:"strictAnnotations"`
+	// Fail the injection of pods setting hostPID or hostIPC instead of only warning about them.
+	StrictHostNamespaces bool `json:"strictHostNamespaces"`
+	// Hub and Tag of the istio images, from which InitImage and ProxyImage are derived, following
+	// InitImageName and ProxyImageName, when they are not set.
+	Hub string `json:"hub"`
+	Tag string `json:"tag"`
+	// Absolute path of the Unix domain socket the proxy serves telemetry on. Its directory is
+	// mounted from an in-memory volume of the pod. Empty means telemetry is not served on a UDS.
+	TelemetryUDSPath string `json:"telemetryUDSPath"`
+	// Mount the telemetry UDS volume into the first application container too, and give it the
+	// path of the socket in the ISTIO_TELEMETRY_UDS_PATH variable. Requires TelemetryUDSPath.
+	TelemetryUDSAppEnv bool `json:"telemetryUDSAppEnv"`
+	// Report every param or proxy setting overridden by a pod annotation as a warning. The
+	// overrides are recorded in the proxy merge trace regardless.
+	ReportAnnotationOverrides bool `json:"reportAnnotationOverrides"`
+	// Floor of the initial delay of the proxy readiness probe. A larger delay, whether set by
+	// ReadinessInitialDelaySeconds or by a pod annotation, is left unchanged.
+	MinReadinessInitialDelaySeconds uint32 `json:"minReadinessInitialDelaySeconds"`
+	// Proxy images selected by the number of containers of the pod. The rule with the largest
+	// MinContainers that the pod reaches wins; pods matching no rule get ProxyImage. The
+	// sidecar.istio.io/proxyImage annotation takes precedence over the rules.
+	ProxyImageRules []ProxyImageRule `json:"proxyImageRules"`
+	// Name of a ProxyImageSelector registered with RegisterProxyImageSelector. The selector chooses
+	// the proxy and init images from the whole pod, and takes precedence over every other image
+	// setting, the sidecar.istio.io/proxyImage annotation included.
+	ProxyImageSelector string `json:"proxyImageSelector"`
+	// Annotate injected pods owned by a controller with it, e.g. "Deployment/hello", to correlate
+	// their telemetry with the workload. Pods with no controller are not annotated.
+	RecordOwner bool `json:"recordOwner"`
+	// Shorten the drain of the proxy of pods that tolerate or select spot/preemptible nodes, which
+	// are reclaimed with a short notice. Longer drains are capped to spotDrainDuration and
+	// spotParentShutdownDuration.
+	SpotNodeAware bool `json:"spotNodeAware"`
+	// Show the value of secret-looking env vars, e.g. *_TOKEN or *_PASSWORD, in the pods and
+	// patches logged by the injector, the injection diffs and the warnings. They are redacted by
+	// default, keeping only their names.
+	ShowSensitive bool `json:"showSensitive"`
+	// Only apply the limits of the proxy resources along with requests. A proxy rendered with
+	// limits but no requests gets neither, and a warning, so that the QoS class of the pod is
+	// predictable.
+	CoupleProxyLimitsToRequests bool `json:"coupleProxyLimitsToRequests"`
+	// In CNI mode, give injected pods a node affinity requiring the cniNodeLabel, for clusters
+	// where only some nodes run the istio-cni plugin. Ignored when EnableCni is false.
+	RequireCNINodeAffinity bool `json:"requireCNINodeAffinity"`
+	// Annotate injected pods as safe to evict for the cluster autoscaler, which otherwise keeps
+	// nodes running pods with the emptyDir volumes of the proxy. Pods setting the annotation
+	// themselves keep their value.
+	NodeDrainAware bool `json:"nodeDrainAware"`
+	// Maximum combined number of ports listed in IncludeInboundPorts, ExcludeInboundPorts and
+	// ExcludeOutboundPorts, each of them rendered as iptables rules by the init container. Defaults
+	// to DefaultMaxRedirectPorts when zero.
+	MaxRedirectPorts int `json:"maxRedirectPorts"`
+	// Fail the validation when the proxy and init images are pulled from different registries,
+	// usually a mistake in air-gapped clusters mirroring a single registry.
+	RequireSameImageRegistry bool `json:"requireSameImageRegistry"`
+	// Give the istio-init or istio-validation init container the resources of the proxy, once
+	// resolved from the values and the pod annotations, so that both are sized consistently.
+	// Ignored when InitResources is set.
+	InitInheritProxyResources bool `json:"initInheritProxyResources"`
+	// Resources of the istio-init or istio-validation init container, taking precedence over
+	// global.proxy.init.resources of the values config.
+	InitResources *corev1.ResourceRequirements `json:"initResources"`
+	// Annotate injected pods with Version, in sidecar.istio.io/injectorVersion, to tell which
+	// build of the injector processed them.
+	RecordInjectorVersion bool `json:"recordInjectorVersion"`
+	// Pod templates embedded in custom resources, which are otherwise written unchanged since
+	// their types are unknown to the injector. A resource may carry several templates, e.g. a
+	// primary and a canary one, each of them injected. Knative Services are injected once listed
+	// with the spec.template path, which their revisions only accept with the
+	// kubernetes.podspec-init-containers and kubernetes.podspec-volumes-emptydir Knative features
+	// enabled.
+	CustomPodTemplates []CustomPodTemplate `json:"customPodTemplates"`
+	// Replace the sidecar of injected pods whose status records another template version, or
+	// another mode than the current values inject, e.g. to upgrade manifests kept injected in
+	// source control. The redirect annotations are recomputed, so values that the pod declared in
+	// them are lost. Pods injected from the same template into the same mode are left unchanged
+	// regardless.
+	ReinjectOnVersionChange bool `json:"reinjectOnVersionChange"`
+	// Leave unchanged the pods whose sidecar.istio.io/inject annotation disables injection, as the
+	// webhook does. kube-inject otherwise injects them, since it is run on the manifests on purpose.
+	HonorInjectAnnotation bool `json:"honorInjectAnnotation"`
+	// Size limit of the emptyDir volumes added by the injection, as a quantity, e.g. "64Mi". The
+	// volumes are otherwise only bounded by the disk or memory of the node. Injected volumes
+	// declaring their own limit, e.g. through sidecar.istio.io/userVolume, keep it.
+	ProxyVolumeSizeLimit string `json:"proxyVolumeSizeLimit"`
+	// Start the sidecar before the application containers, which the kubelet only starts once
+	// the postStart hook of the sidecar reports it ready on its status port, so that early
+	// outbound calls of the application do not fail. The proxy image must provide /bin/sh and
+	// wget. Pods can override it with the sidecar.istio.io/holdApplicationUntilProxyStarts
+	// annotation.
+	HoldApplicationUntilProxyStarts bool `json:"holdApplicationUntilProxyStarts"`
+	// Give the proxy of pods whose application containers have a preStop hook a preStop hook of
+	// its own, waiting until the TCP ports declared by the application containers are no longer
+	// listened on. The kubelet only sends SIGTERM to the proxy once the hook returns, so the proxy
+	// drains after the application stopped serving, within the termination grace period. The
+	// proxy image must provide /bin/sh and grep. A global.proxy.lifecycle takes precedence.
+	DrainAfterApplication bool `json:"drainAfterApplication"`
+	// Give the application containers of Jobs and CronJobs the URL of the quit endpoint of the
+	// pilot agent, in ISTIO_QUIT_URL, so that they can stop the proxy once their work is done.
+	// The proxy otherwise keeps running, and the pods of the Job never complete. The endpoint
+	// only accepts POST requests from localhost.
+	JobProxyQuitEnv bool `json:"jobProxyQuitEnv"`
+	// If set, kube-inject writes the mapping keys of each resource in the order of its input,
+	// rather than sorted, so that the injected manifests diff cleanly against the ones they were
+	// generated from. Comments are still dropped.
+	PreserveKeyOrder bool `json:"preserveKeyOrder"`
+	// Names of the secrets added to the image pull secrets of every injected pod, e.g. to pull the
+	// proxy image from a private registry. Secrets the pod already declares are not repeated.
+	ImagePullSecrets []string `json:"imagePullSecrets"`
+	// Seccomp profile of the istio-init container: RuntimeDefault, Unconfined or the path of a
+	// profile of the nodes prefixed with localhost/. Empty leaves the profile unset. It has no
+	// effect in CNI mode, which has no istio-init container.
+	InitSeccompProfile string `json:"initSeccompProfile"`
+	// Arguments appended to the ones the template gives the proxy, so that they win over them,
+	// e.g. --proxyLogLevel. Pods can replace them with the sidecar.istio.io/proxyArgs annotation.
+	ExtraProxyArgs []string `json:"extraProxyArgs"`
+	// Name of the containerPort of the proxy exposing the status port, e.g. status-port, so that
+	// NetworkPolicies can select it. The readiness probe of the proxy then references the port by
+	// name. Empty leaves the status port undeclared.
+	StatusPortName string `json:"statusPortName"`
+}
+
+// ProxyImageRule selects the proxy image of the pods having at least MinContainers containers.
+type ProxyImageRule struct {
+	MinContainers int    `json:"minContainers"`
+	Image         string `json:"image"`
+}
+
+// InitImageName returns the fully qualified image name for the istio
+// init image given a docker hub and tag.
+func InitImageName(hub string, tag string) string {
+	return hub + "/proxy_init:" + tag
+}
+
+// ProxyImageName returns the fully qualified image name for the istio
+// proxy image given a docker hub and tag.
+func ProxyImageName(hub string, tag string) string {
+	return hub + "/proxyv2:" + tag
+}
+
+// proxyImage returns ProxyImage, or the proxy image of Hub and Tag when it is not set.
+func (p *Params) proxyImage() string {
+	if p.ProxyImage == "" && p.Hub != "" && p.Tag != "" {
+		return ProxyImageName(p.Hub, p.Tag)
+	}
+	return p.ProxyImage
+}
+
+// initImage returns InitImage, or the init image of Hub and Tag when it is not set.
+func (p *Params) initImage() string {
+	if p.InitImage == "" && p.Hub != "" && p.Tag != "" {
+		return InitImageName(p.Hub, p.Tag)
+	}
+	return p.InitImage
 }
 
 // Validate validates the parameters and returns an error if there is configuration issue.
@@ -218,33 +704,195 @@ func (p *Params) Validate() error {
 	if err := ValidateExcludeIPRanges(p.ExcludeIPRanges); err != nil {
 		return err
 	}
+	if err := validateRedirectArgsLength(p.IncludeIPRanges, p.ExcludeIPRanges); err != nil {
+		return err
+	}
+	if err := validateImageReference("proxyImage", p.proxyImage()); err != nil {
+		return err
+	}
+	if err := validateImageReference("initImage", p.initImage()); err != nil {
+		return err
+	}
+	if p.RequireSameImageRegistry {
+		if err := validateSameImageRegistry(p.proxyImage(), p.initImage()); err != nil {
+			return err
+		}
+	}
 	if err := ValidateIncludeInboundPorts(p.IncludeInboundPorts); err != nil {
 		return err
 	}
-	return ValidateExcludeInboundPorts(p.ExcludeInboundPorts)
+	if err := ValidateExcludeInboundPorts(p.ExcludeInboundPorts); err != nil {
+		return err
+	}
+	if err := ValidateExcludeOutboundPorts(p.ExcludeOutboundPorts); err != nil {
+		return err
+	}
+	if err := validateRedirectPortCount(p.MaxRedirectPorts, p.IncludeInboundPorts, p.ExcludeInboundPorts,
+		p.ExcludeOutboundPorts); err != nil {
+		return err
+	}
+	if err := validateProxyCABundleConfigMap(p.ProxyCABundleConfigMap); err != nil {
+		return err
+	}
+	if err := validateImagePullSecrets(strings.Join(p.ImagePullSecrets, ",")); err != nil {
+		return err
+	}
+	if p.StatusPortName != "" {
+		if errs := validation.IsValidPortName(p.StatusPortName); len(errs) > 0 {
+			return fmt.Errorf("statusPortName invalid: %q: %s", p.StatusPortName, strings.Join(errs, "; "))
+		}
+	}
+	if p.InitSeccompProfile != "" {
+		if _, err := seccompAnnotationValue(p.InitSeccompProfile); err != nil {
+			return fmt.Errorf("initSeccompProfile invalid: %v", err)
+		}
+	}
+	if err := validateKubevirtInterfaces(p.KubevirtInterfaces); err != nil {
+		return err
+	}
+	if err := validateTelemetryUDS(p.TelemetryUDSPath, p.TelemetryUDSAppEnv); err != nil {
+		return err
+	}
+	for i, rule := range p.ProxyImageRules {
+		field := fmt.Sprintf("proxyImageRules[%d]", i)
+		if rule.MinContainers < 1 {
+			return fmt.Errorf("%s invalid: minContainers must be at least 1, got %d", field, rule.MinContainers)
+		}
+		if rule.Image == "" {
+			return fmt.Errorf("%s invalid: image is required", field)
+		}
+		if err := validateImageReference(field, rule.Image); err != nil {
+			return err
+		}
+	}
+	if p.ProxyImageSelector != "" && lookupProxyImageSelector(p.ProxyImageSelector) == nil {
+		return fmt.Errorf("proxyImageSelector invalid: %q is not registered", p.ProxyImageSelector)
+	}
+	if err := validateCustomPodTemplates(p.CustomPodTemplates); err != nil {
+		return err
+	}
+	if p.ProxyVolumeSizeLimit != "" {
+		if err := validateQuantity(p.ProxyVolumeSizeLimit); err != nil {
+			return fmt.Errorf("proxyVolumeSizeLimit invalid: %v", err)
+		}
+	}
+	if trustDomain := p.Mesh.GetTrustDomain(); trustDomain != "" {
+		if err := validateTrustDomain(trustDomain); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // intoHelmValues returns a map of the traversed path in helm values YAML to the param value.
 func (p *Params) intoHelmValues() map[string]string {
 	vals := map[string]string{
-		"global.proxy_init.image":                    p.InitImage,
-		"global.proxy.image":                         p.ProxyImage,
-		"global.proxy.enableCoreDump":                strconv.FormatBool(p.EnableCoreDump),
-		"global.proxy.privileged":                    strconv.FormatBool(p.Privileged),
-		"global.imagePullPolicy":                     p.ImagePullPolicy,
-		"global.proxy.statusPort":                    strconv.Itoa(p.StatusPort),
-		"global.proxy.tracer":                        p.Tracer,
-		"global.proxy.readinessInitialDelaySeconds":  strconv.Itoa(int(p.ReadinessInitialDelaySeconds)),
-		"global.proxy.readinessPeriodSeconds":        strconv.Itoa(int(p.ReadinessPeriodSeconds)),
-		"global.proxy.readinessFailureThreshold":     strconv.Itoa(int(p.ReadinessFailureThreshold)),
-		"global.sds.enabled":                         strconv.FormatBool(p.SDSEnabled),
-		"global.proxy.includeIPRanges":               p.IncludeIPRanges,
-		"global.proxy.excludeIPRanges":               p.ExcludeIPRanges,
-		"global.proxy.includeInboundPorts":           p.IncludeInboundPorts,
-		"global.proxy.excludeInboundPorts":           p.ExcludeInboundPorts,
-		"sidecarInjectorWebhook.rewriteAppHTTPProbe": strconv.FormatBool(p.RewriteAppHTTPProbe),
-		"global.podDNSSearchNamespaces":              getHelmValue(p.PodDNSSearchNamespaces),
-		"istio_cni.enabled":                          strconv.FormatBool(p.EnableCni),
+		"global.proxy_init.image":                            p.initImage(),
+		"global.proxy.image":                                 p.proxyImage(),
+		"global.proxy.enableCoreDump":                        strconv.FormatBool(p.EnableCoreDump),
+		"global.proxy.privileged":                            strconv.FormatBool(p.Privileged),
+		"global.imagePullPolicy":                             p.ImagePullPolicy,
+		"global.proxy.statusPort":                            strconv.Itoa(p.StatusPort),
+		"global.proxy.statusPortName":                        p.StatusPortName,
+		"global.proxy.tracer":                                p.Tracer,
+		"global.proxy.readinessInitialDelaySeconds":          strconv.Itoa(int(p.ReadinessInitialDelaySeconds)),
+		"global.proxy.readinessPeriodSeconds":                strconv.Itoa(int(p.ReadinessPeriodSeconds)),
+		"global.proxy.readinessFailureThreshold":             strconv.Itoa(int(p.ReadinessFailureThreshold)),
+		"global.sds.enabled":                                 strconv.FormatBool(p.SDSEnabled),
+		"global.proxy.includeIPRanges":                       p.IncludeIPRanges,
+		"global.proxy.excludeIPRanges":                       p.ExcludeIPRanges,
+		"global.proxy.includeInboundPorts":                   p.IncludeInboundPorts,
+		"global.proxy.excludeInboundPorts":                   p.ExcludeInboundPorts,
+		"global.proxy.excludeOutboundPorts":                  p.ExcludeOutboundPorts,
+		"sidecarInjectorWebhook.rewriteAppHTTPProbe":         strconv.FormatBool(p.RewriteAppHTTPProbe),
+		"global.podDNSSearchNamespaces":                      getHelmValue(p.PodDNSSearchNamespaces),
+		"istio_cni.enabled":                                  strconv.FormatBool(p.EnableCni),
+		"sidecarInjectorWebhook.alwaysEmitDocumentSeparator": strconv.FormatBool(p.AlwaysEmitDocumentSeparator),
+		"sidecarInjectorWebhook.maxContainersPerPod":         strconv.Itoa(p.MaxContainersPerPod),
+		"sidecarInjectorWebhook.shareProcessNamespaceAware":  strconv.FormatBool(p.ShareProcessNamespaceAware),
+		"global.proxy.caBundleConfigMap":                     p.ProxyCABundleConfigMap,
+		"sidecarInjectorWebhook.tuneProxyMemoryFromLimit":    strconv.FormatBool(p.TuneProxyMemoryFromLimit),
+		"sidecarInjectorWebhook.recordInjectionID":           strconv.FormatBool(p.RecordInjectionID),
+		"sidecarInjectorWebhook.inferPullPolicyFromTag":      strconv.FormatBool(p.InferPullPolicyFromTag),
+		"sidecarInjectorWebhook.proxyImageSelector":          p.ProxyImageSelector,
+		"sidecarInjectorWebhook.matchPodImagePullPolicy":     strconv.FormatBool(p.MatchPodImagePullPolicy),
+		"sidecarInjectorWebhook.reinjectLegacyStatus":        strconv.FormatBool(p.ReinjectLegacyStatus),
+		"global.proxy.interactive":                           strconv.FormatBool(p.ProxyInteractive),
+		"sidecarInjectorWebhook.disableServiceLinks":         strconv.FormatBool(p.DisableServiceLinks),
+		"sidecarInjectorWebhook.appEntrypointWrapper":        strconv.FormatBool(p.AppEntrypointWrapper),
+		"sidecarInjectorWebhook.topologyAware":               strconv.FormatBool(p.TopologyAware),
+		"sidecarInjectorWebhook.dedupeDownwardAPIEnv":        strconv.FormatBool(p.DedupeDownwardAPIEnv),
+		"sidecarInjectorWebhook.strictAnnotations":           strconv.FormatBool(p.StrictAnnotations),
+		"sidecarInjectorWebhook.strictHostNamespaces":        strconv.FormatBool(p.StrictHostNamespaces),
+		"global.proxy.telemetryUDSPath":                      p.TelemetryUDSPath,
+		"sidecarInjectorWebhook.telemetryUDSAppEnv":          strconv.FormatBool(p.TelemetryUDSAppEnv),
+		"sidecarInjectorWebhook.reportAnnotationOverrides":   strconv.FormatBool(p.ReportAnnotationOverrides),
+		"global.proxy.minReadinessInitialDelaySeconds":       strconv.Itoa(int(p.MinReadinessInitialDelaySeconds)),
+		"sidecarInjectorWebhook.recordOwner":                 strconv.FormatBool(p.RecordOwner),
+		"sidecarInjectorWebhook.spotNodeAware":               strconv.FormatBool(p.SpotNodeAware),
+		"sidecarInjectorWebhook.redactSensitive":             strconv.FormatBool(!p.ShowSensitive),
+		"sidecarInjectorWebhook.coupleProxyLimitsToRequests": strconv.FormatBool(p.CoupleProxyLimitsToRequests),
+		"sidecarInjectorWebhook.requireCNINodeAffinity":      strconv.FormatBool(p.RequireCNINodeAffinity),
+		"sidecarInjectorWebhook.nodeDrainAware":              strconv.FormatBool(p.NodeDrainAware),
+		"sidecarInjectorWebhook.initInheritProxyResources":   strconv.FormatBool(p.InitInheritProxyResources),
+		"sidecarInjectorWebhook.recordInjectorVersion":       strconv.FormatBool(p.RecordInjectorVersion),
+		"sidecarInjectorWebhook.injectorVersion":             p.Version,
+		"sidecarInjectorWebhook.reinjectOnVersionChange":     strconv.FormatBool(p.ReinjectOnVersionChange),
+		"sidecarInjectorWebhook.honorInjectAnnotation":       strconv.FormatBool(p.HonorInjectAnnotation),
+		"sidecarInjectorWebhook.proxyVolumeSizeLimit":        p.ProxyVolumeSizeLimit,
+		"sidecarInjectorWebhook.jobProxyQuitEnv":             strconv.FormatBool(p.JobProxyQuitEnv),
+		"sidecarInjectorWebhook.preserveKeyOrder":            strconv.FormatBool(p.PreserveKeyOrder),
+		"sidecarInjectorWebhook.initSeccompProfile":          p.InitSeccompProfile,
+	}
+	vals["sidecarInjectorWebhook.holdApplicationUntilProxyStarts"] = strconv.FormatBool(p.HoldApplicationUntilProxyStarts)
+	vals["sidecarInjectorWebhook.drainAfterApplication"] = strconv.FormatBool(p.DrainAfterApplication)
+	for i, conditionType := range p.ReadinessGates {
+		vals[fmt.Sprintf("sidecarInjectorWebhook.readinessGates[%d]", i)] = conditionType
+	}
+	for i, name := range p.ImagePullSecrets {
+		vals[fmt.Sprintf("sidecarInjectorWebhook.imagePullSecrets[%d]", i)] = name
+	}
+	for i, arg := range p.ExtraProxyArgs {
+		vals[fmt.Sprintf("sidecarInjectorWebhook.extraProxyArgs[%d]", i)] = arg
+	}
+	for i, rule := range p.ProxyImageRules {
+		prefix := fmt.Sprintf("sidecarInjectorWebhook.proxyImageRules[%d].", i)
+		vals[prefix+"minContainers"] = strconv.Itoa(rule.MinContainers)
+		vals[prefix+"image"] = rule.Image
+	}
+	for i, t := range p.CustomPodTemplates {
+		prefix := fmt.Sprintf("sidecarInjectorWebhook.customPodTemplates[%d].", i)
+		vals[prefix+"apiVersion"] = t.APIVersion
+		vals[prefix+"kind"] = t.Kind
+		for j, path := range t.Paths {
+			vals[fmt.Sprintf("%spaths[%d]", prefix, j)] = path
+		}
+	}
+	for i, t := range p.ProxyTolerations {
+		prefix := fmt.Sprintf("sidecarInjectorWebhook.proxyTolerations[%d].", i)
+		for field, value := range map[string]string{
+			"key":      t.Key,
+			"operator": string(t.Operator),
+			"value":    t.Value,
+			"effect":   string(t.Effect),
+		} {
+			if value != "" {
+				vals[prefix+field] = value
+			}
+		}
+		if t.TolerationSeconds != nil {
+			vals[prefix+"tolerationSeconds"] = strconv.FormatInt(*t.TolerationSeconds, 10)
+		}
+	}
+	if p.InitResources != nil {
+		for field, list := range map[string]corev1.ResourceList{
+			"requests": p.InitResources.Requests,
+			"limits":   p.InitResources.Limits,
+		} {
+			for name, quantity := range list {
+				vals[fmt.Sprintf("sidecarInjectorWebhook.initResources.%s.%s", field, name)] = quantity.String()
+			}
+		}
 	}
 	return vals
 }
@@ -283,6 +931,8 @@ type Config struct {
 	InjectedAnnotations map[string]string `json:"injectedAnnotations"`
 }
 
+// validateCIDRList validates a comma separated list of CIDRs, IPv4 and IPv6 ones alike, which
+// istio-iptables splits between iptables and ip6tables.
 func validateCIDRList(cidrs string) error {
 	if len(cidrs) > 0 {
 		for _, cidr := range strings.Split(cidrs, ",") {
@@ -358,6 +1008,15 @@ func ValidateExcludeIPRanges(ipRanges string) error {
 	return nil
 }
 
+// validateRedirectArgsLength verifies that the outbound IP ranges fit in the init container args.
+func validateRedirectArgsLength(includeIPRanges, excludeIPRanges string) error {
+	if l := len(includeIPRanges) + len(excludeIPRanges); l > maxRedirectArgsLength {
+		return fmt.Errorf("includeIPRanges and excludeIPRanges are too long: %d bytes exceeds the limit of %d bytes",
+			l, maxRedirectArgsLength)
+	}
+	return nil
+}
+
 // ValidateIncludeInboundPorts validates the includeInboundPorts parameter
 func ValidateIncludeInboundPorts(ports string) error {
 	if ports != "*" {
@@ -376,6 +1035,155 @@ func ValidateExcludeOutboundPorts(ports string) error {
 	return validatePortList("excludeOutboundPorts", ports)
 }
 
+// validateRedirectPortCount verifies that the port lists rendered as iptables rules by the init
+// container stay within max ports overall, long lists making the init slow or failing it.
+func validateRedirectPortCount(max int, includeInboundPorts, excludeInboundPorts, excludeOutboundPorts string) error {
+	if max <= 0 {
+		max = DefaultMaxRedirectPorts
+	}
+	lists := []struct {
+		name  string
+		ports string
+	}{
+		{annotation.SidecarTrafficIncludeInboundPorts.Name, includeInboundPorts},
+		{annotation.SidecarTrafficExcludeInboundPorts.Name, excludeInboundPorts},
+		{annotation.SidecarTrafficExcludeOutboundPorts.Name, excludeOutboundPorts},
+	}
+	total, longest, longestCount := 0, "", 0
+	for _, l := range lists {
+		if l.ports == "*" {
+			continue
+		}
+		ports, err := parsePorts(l.ports)
+		if err != nil {
+			return err
+		}
+		total += len(ports)
+		if len(ports) > longestCount {
+			longest, longestCount = l.name, len(ports)
+		}
+	}
+	if total > max {
+		return fmt.Errorf("includeInboundPorts, excludeInboundPorts and excludeOutboundPorts list %d ports, "+
+			"exceeding the limit of %d: shorten %s (%d ports)", total, max, longest, longestCount)
+	}
+	return nil
+}
+
+// validateImageReference validates that image is a well formed image reference, such as
+// "docker.io/istio/proxyv2:1.4.0". An empty image is left to the template defaults.
+func validateImageReference(field, image string) error {
+	if image == "" {
+		return nil
+	}
+	if _, err := reference.ParseNormalizedNamed(image); err != nil {
+		return fmt.Errorf("%s invalid: %q: %v", field, image, err)
+	}
+	return nil
+}
+
+// validateSameImageRegistry validates that the proxy and init images are pulled from the same
+// registry host. Images without a host are normalized to docker.io. An empty image is left to the
+// template defaults.
+func validateSameImageRegistry(proxyImage, initImage string) error {
+	if proxyImage == "" || initImage == "" {
+		return nil
+	}
+	proxyRef, err := reference.ParseNormalizedNamed(proxyImage)
+	if err != nil {
+		return fmt.Errorf("proxyImage invalid: %q: %v", proxyImage, err)
+	}
+	initRef, err := reference.ParseNormalizedNamed(initImage)
+	if err != nil {
+		return fmt.Errorf("initImage invalid: %q: %v", initImage, err)
+	}
+	if reference.Domain(proxyRef) != reference.Domain(initRef) {
+		return fmt.Errorf("proxyImage and initImage invalid: registry %q of %q differs from registry %q of %q",
+			reference.Domain(proxyRef), proxyImage, reference.Domain(initRef), initImage)
+	}
+	return nil
+}
+
+// linuxInterfaceNameRegexp matches the names the Linux kernel accepts for network interfaces: at
+// most 15 characters, without whitespace, slashes or colons.
+var linuxInterfaceNameRegexp = regexp.MustCompile(`^[^\s/:]{1,15}$`)
+
+// validateKubevirtInterfaces validates the comma separated list of the kubevirt interfaces
+// whose traffic is captured. The list is passed as is to istio-iptables, and a misspelled name
+// would silently capture nothing, so empty entries, duplicates and names the kernel would refuse,
+// including ones with surrounding whitespace, are rejected.
+func validateKubevirtInterfaces(value string) error {
+	if value == "" {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		if name == "" {
+			return fmt.Errorf("kubevirtInterfaces invalid: %q has an empty entry", value)
+		}
+		if name == "." || name == ".." || !linuxInterfaceNameRegexp.MatchString(name) {
+			return fmt.Errorf("kubevirtInterfaces invalid: %q is not a valid network interface name", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("kubevirtInterfaces invalid: %q is listed more than once", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// validateImagePullSecrets validates a comma separated list of image pull secret names.
+func validateImagePullSecrets(value string) error {
+	if value == "" {
+		return nil
+	}
+	for _, name := range strings.Split(value, ",") {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return fmt.Errorf("imagePullSecrets invalid: %q: %s", name, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// validateProxyCABundleConfigMap validates the name of the ConfigMap holding the proxy CA bundle.
+func validateProxyCABundleConfigMap(name string) error {
+	if name == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("proxyCABundleConfigMap invalid: %q: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// telemetryUDSReservedDirs are the directories of the proxy that the telemetry UDS volume must not
+// be mounted over.
+var telemetryUDSReservedDirs = []string{"/etc/istio/proxy", "/etc/certs", "/var/run/sds", "/var/run/secrets"}
+
+// validateTelemetryUDS validates the path of the telemetry UDS of the proxy. The directory of the
+// socket is mounted into the proxy, and possibly the application, so it must be a dedicated one.
+func validateTelemetryUDS(udsPath string, appEnv bool) error {
+	if udsPath == "" {
+		if appEnv {
+			return fmt.Errorf("telemetryUDSAppEnv requires telemetryUDSPath to be set")
+		}
+		return nil
+	}
+	if !path.IsAbs(udsPath) || path.Clean(udsPath) != udsPath {
+		return fmt.Errorf("telemetryUDSPath invalid: %q: must be a clean absolute path", udsPath)
+	}
+	dir := path.Dir(udsPath)
+	if dir == "/" {
+		return fmt.Errorf("telemetryUDSPath invalid: %q: the socket must not be in the root directory", udsPath)
+	}
+	for _, reserved := range telemetryUDSReservedDirs {
+		if dir == reserved || strings.HasPrefix(dir+"/", reserved+"/") || strings.HasPrefix(reserved+"/", dir+"/") {
+			return fmt.Errorf("telemetryUDSPath invalid: %q: its directory overlaps %s", udsPath, reserved)
+		}
+	}
+	return nil
+}
+
 // validateStatusPort validates the statusPort parameter
 func validateStatusPort(port string) error {
 	if _, e := parsePort(port); e != nil {
@@ -384,69 +1192,293 @@ func validateStatusPort(port string) error {
 	return nil
 }
 
+// warnStatusPortRange reports a status port outside of the ports reserved for Istio. Such a port
+// is allowed, but it may collide with a port of the application. A disabled status port, which is
+// not found in the proxy args, is not reported.
+func warnStatusPortRange(port int, warnings *injectionWarnings) {
+	if port <= 0 || (port >= reservedPortRangeStart && port <= reservedPortRangeEnd) {
+		return
+	}
+	warnings.warnf("statusPort %d is outside of the range reserved for Istio (%d-%d) and may collide with a port of the application",
+		port, reservedPortRangeStart, reservedPortRangeEnd)
+}
+
 // validateUInt32 validates that the given annotation value is a positive integer.
 func validateUInt32(value string) error {
 	_, err := strconv.ParseUint(value, 10, 32)
 	return err
 }
 
-// validateBool validates that the given annotation value is a boolean.
-func validateBool(value string) error {
-	_, err := strconv.ParseBool(value)
-	return err
+// validateDuration validates that the given annotation value is a non-negative duration, e.g. "1h30m".
+func validateDuration(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("duration must not be negative: %v", value)
+	}
+	return nil
 }
 
-func injectRequired(ignored []string, config *Config, podSpec *corev1.PodSpec, metadata *metav1.ObjectMeta) bool { // nolint: lll
-	// Skip injection when host networking is enabled. The problem is
-	// that the iptable changes are assumed to be within the pod when,
-	// in fact, they are changing the routing at the host level. This
-	// often results in routing failures within a node which can
-	// affect the network provider within the cluster causing
-	// additional pod failures.
-	if podSpec.HostNetwork {
-		return false
+// validatePortProtocols validates a comma separated list of port:protocol pairs.
+func validatePortProtocols(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return fmt.Errorf("portProtocols invalid, expected port:protocol: %q", pair)
+		}
+		if _, err := parsePort(parts[0]); err != nil {
+			return fmt.Errorf("portProtocols invalid: %v", err)
+		}
+		switch parts[1] {
+		case "tcp", "http", "grpc", "tls":
+		default:
+			return fmt.Errorf("portProtocols invalid, use tcp,http,grpc,tls: %v", parts[1])
+		}
 	}
+	return nil
+}
 
-	// skip special kubernetes system namespaces
-	for _, namespace := range ignored {
-		if metadata.Namespace == namespace {
-			return false
-		}
+// validateLogLevel validates the log level of the proxy.
+func validateLogLevel(level string) error {
+	switch level {
+	case "trace", "debug", "info", "warning", "error", "critical", "off":
+	default:
+		return fmt.Errorf("logLevel invalid, use trace,debug,info,warning,error,critical,off: %v", level)
 	}
+	return nil
+}
 
-	annos := metadata.GetAnnotations()
-	if annos == nil {
-		annos = map[string]string{}
+// validateComponentLogLevel validates a comma separated list of component:level pairs.
+func validateComponentLogLevel(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("componentLogLevel invalid, expected component:level: %q", pair)
+		}
+		if err := validateLogLevel(parts[1]); err != nil {
+			return fmt.Errorf("componentLogLevel invalid: %v", err)
+		}
 	}
+	return nil
+}
 
-	var useDefault bool
-	var inject bool
-	switch strings.ToLower(annos[annotation.SidecarInject.Name]) {
-	// http://yaml.org/type/bool.html
-	case "y", "yes", "true", "on":
-		inject = true
-	case "":
-		useDefault = true
+// validateMinTLSVersion validates the minimum TLS version of the inbound traffic.
+func validateMinTLSVersion(version string) error {
+	switch version {
+	case "TLSv1_2", "TLSv1_3":
+	default:
+		return fmt.Errorf("minTLSVersion invalid, use TLSv1_2,TLSv1_3: %v", version)
 	}
+	return nil
+}
 
-	// If an annotation is not explicitly given, check the LabelSelectors, starting with NeverInject
-	if useDefault {
-		for _, neverSelector := range config.NeverInjectSelector {
-			selector, err := metav1.LabelSelectorAsSelector(&neverSelector)
-			if err != nil {
-				log.Warnf("Invalid selector for NeverInjectSelector: %v (%v)", neverSelector, err)
-			} else if !selector.Empty() && selector.Matches(labels.Set(metadata.Labels)) {
-				log.Debugf("Explicitly disabling injection for pod %s/%s due to pod labels matching NeverInjectSelector config map entry.",
-					metadata.Namespace, potentialPodName(metadata))
-				inject = false
-				useDefault = false
-				break
-			}
-		}
+// validateDiscoveryAddress validates that the discovery address of the proxy is a host:port.
+func validateDiscoveryAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("discoveryAddress invalid, use host:port: %v", err)
+	}
+	if host == "" {
+		return fmt.Errorf("discoveryAddress invalid, missing host: %v", address)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("discoveryAddress invalid, bad port %q: %v", port, address)
 	}
+	return nil
+}
 
-	// If there's no annotation nor a NeverInjectSelector, check the AlwaysInject one
-	if useDefault {
+// validateProxyMetadata validates the proxyMetadata annotation, a JSON object of env var names to
+// string values.
+func validateProxyMetadata(value string) error {
+	_, err := parseProxyMetadata(value)
+	return err
+}
+
+func parseProxyMetadata(value string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+		return nil, fmt.Errorf("proxyMetadata invalid, expected a JSON object of strings: %v", err)
+	}
+	for name := range metadata {
+		if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+			return nil, fmt.Errorf("proxyMetadata invalid: %q: %s", name, strings.Join(errs, ", "))
+		}
+	}
+	return metadata, nil
+}
+
+// validateProxyEnv validates the proxyEnv annotation, a JSON or YAML object of env var names to
+// string values.
+func validateProxyEnv(value string) error {
+	_, err := parseProxyEnv(value)
+	return err
+}
+
+func parseProxyEnv(value string) (map[string]string, error) {
+	env := map[string]string{}
+	if err := yaml.Unmarshal([]byte(value), &env); err != nil {
+		return nil, fmt.Errorf("proxyEnv invalid, expected an object of strings: %v", err)
+	}
+	for name := range env {
+		if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+			return nil, fmt.Errorf("proxyEnv invalid: %q: %s", name, strings.Join(errs, ", "))
+		}
+	}
+	return env, nil
+}
+
+// validateProxyArgs validates the proxyArgs annotation, a JSON array of strings.
+func validateProxyArgs(value string) error {
+	_, err := parseProxyArgs(value)
+	return err
+}
+
+func parseProxyArgs(value string) ([]string, error) {
+	var args []string
+	if err := json.Unmarshal([]byte(value), &args); err != nil {
+		return nil, fmt.Errorf("proxyArgs invalid, expected a JSON array of strings: %v", err)
+	}
+	return args, nil
+}
+
+// trustDomainRegexp matches the characters SPIFFE allows in a trust domain.
+var trustDomainRegexp = regexp.MustCompile(`^[a-z0-9._-]{1,255}$`)
+
+// validateTrustDomain validates the trust domain of the SPIFFE identity of the proxy.
+func validateTrustDomain(value string) error {
+	if !trustDomainRegexp.MatchString(value) {
+		return fmt.Errorf("trustDomain invalid: %q must be 1 to 255 lowercase letters, digits, dots, dashes or underscores",
+			value)
+	}
+	return nil
+}
+
+// validateBool validates that the given annotation value is a boolean.
+func validateBool(value string) error {
+	_, err := strconv.ParseBool(value)
+	return err
+}
+
+// validateQuantity validates that the given annotation value is a resource quantity, e.g. "100m"
+// or "128Mi".
+func validateQuantity(value string) error {
+	_, err := resource.ParseQuantity(value)
+	return err
+}
+
+// Reasons of the injection decisions of the webhook.
+const (
+	injectReasonHostNetwork          = "pod uses host networking"
+	injectReasonWindows              = "pod runs on Windows nodes"
+	injectReasonIgnoredNamespace     = "namespace is ignored"
+	injectReasonAnnotationEnabled    = "pod annotation enables injection"
+	injectReasonAnnotationDisabled   = "pod annotation disables injection"
+	injectReasonNeverInjectSelector  = "pod labels match the neverInjectSelector"
+	injectReasonAlwaysInjectSelector = "pod labels match the alwaysInjectSelector"
+	injectReasonPolicyEnabled        = "injection policy is enabled"
+	injectReasonPolicyDisabled       = "injection policy is disabled"
+	injectReasonPolicyInvalid        = "injection policy is invalid"
+)
+
+// osNodeLabels are the node labels selecting the operating system of the nodes a pod runs on, as
+// spec.os of pods cannot be read.
+var osNodeLabels = []string{"kubernetes.io/os", "beta.kubernetes.io/os"}
+
+// isWindowsPod returns whether the node selector of the pod restricts it to Windows nodes.
+func isWindowsPod(podSpec *corev1.PodSpec) bool {
+	for _, label := range osNodeLabels {
+		if podSpec.NodeSelector[label] == "windows" {
+			return true
+		}
+	}
+	return false
+}
+
+func injectRequired(ignored []string, config *Config, podSpec *corev1.PodSpec, metadata *metav1.ObjectMeta) bool { // nolint: lll
+	required, _ := injectDecision(ignored, config, podSpec, metadata)
+	return required
+}
+
+// injectAnnotationDisables returns whether the sidecar.istio.io/inject annotation of the pod
+// disables its injection, reading the annotation as injectDecision does.
+func injectAnnotationDisables(metadata *metav1.ObjectMeta) bool {
+	switch strings.ToLower(metadata.GetAnnotations()[annotation.SidecarInject.Name]) {
+	// http://yaml.org/type/bool.html
+	case "", "y", "yes", "true", "on":
+		return false
+	}
+	return true
+}
+
+// injectDecision returns whether the pod is injected and why. Namespaces opt in with their
+// istio-injection label through the selector of the webhook configuration, before the webhook is
+// called. Then, in order of precedence:
+//  1. pods using host networking, pods running on Windows nodes and pods of ignored namespaces are
+//     never injected;
+//  2. the sidecar.istio.io/inject annotation of the pod, so that an explicit "false" always wins;
+//  3. the neverInjectSelector, then the alwaysInjectSelector;
+//  4. the injection policy.
+func injectDecision(ignored []string, config *Config, podSpec *corev1.PodSpec, metadata *metav1.ObjectMeta) (bool, string) { // nolint: lll
+	// Skip injection when host networking is enabled. The problem is
+	// that the iptable changes are assumed to be within the pod when,
+	// in fact, they are changing the routing at the host level. This
+	// often results in routing failures within a node which can
+	// affect the network provider within the cluster causing
+	// additional pod failures.
+	if podSpec.HostNetwork {
+		return false, injectReasonHostNetwork
+	}
+
+	// The proxy and its init container are Linux images.
+	if isWindowsPod(podSpec) {
+		return false, injectReasonWindows
+	}
+
+	// skip special kubernetes system namespaces
+	for _, namespace := range ignored {
+		if metadata.Namespace == namespace {
+			return false, injectReasonIgnoredNamespace
+		}
+	}
+
+	annos := metadata.GetAnnotations()
+	if annos == nil {
+		annos = map[string]string{}
+	}
+
+	var useDefault bool
+	var inject bool
+	reason := injectReasonAnnotationDisabled
+	switch strings.ToLower(annos[annotation.SidecarInject.Name]) {
+	// http://yaml.org/type/bool.html
+	case "y", "yes", "true", "on":
+		inject = true
+		reason = injectReasonAnnotationEnabled
+	case "":
+		useDefault = true
+	}
+
+	// If an annotation is not explicitly given, check the LabelSelectors, starting with NeverInject
+	if useDefault {
+		for _, neverSelector := range config.NeverInjectSelector {
+			selector, err := metav1.LabelSelectorAsSelector(&neverSelector)
+			if err != nil {
+				log.Warnf("Invalid selector for NeverInjectSelector: %v (%v)", neverSelector, err)
+			} else if !selector.Empty() && selector.Matches(labels.Set(metadata.Labels)) {
+				log.Debugf("Explicitly disabling injection for pod %s/%s due to pod labels matching NeverInjectSelector config map entry.",
+					metadata.Namespace, potentialPodName(metadata))
+				inject = false
+				useDefault = false
+				reason = injectReasonNeverInjectSelector
+				break
+			}
+		}
+	}
+
+	// If there's no annotation nor a NeverInjectSelector, check the AlwaysInject one
+	if useDefault {
 		for _, alwaysSelector := range config.AlwaysInjectSelector {
 			selector, err := metav1.LabelSelectorAsSelector(&alwaysSelector)
 			if err != nil {
@@ -456,6 +1488,7 @@ func injectRequired(ignored []string, config *Config, podSpec *corev1.PodSpec, m
 					metadata.Namespace, potentialPodName(metadata))
 				inject = true
 				useDefault = false
+				reason = injectReasonAlwaysInjectSelector
 				break
 			}
 		}
@@ -467,15 +1500,18 @@ func injectRequired(ignored []string, config *Config, podSpec *corev1.PodSpec, m
 		log.Errorf("Illegal value for autoInject:%s, must be one of [%s,%s]. Auto injection disabled!",
 			config.Policy, InjectionPolicyDisabled, InjectionPolicyEnabled)
 		required = false
+		reason = injectReasonPolicyInvalid
 	case InjectionPolicyDisabled:
 		if useDefault {
 			required = false
+			reason = injectReasonPolicyDisabled
 		} else {
 			required = inject
 		}
 	case InjectionPolicyEnabled:
 		if useDefault {
 			required = true
+			reason = injectReasonPolicyEnabled
 		} else {
 			required = inject
 		}
@@ -492,17 +1528,18 @@ func injectRequired(ignored []string, config *Config, podSpec *corev1.PodSpec, m
 			annotationStr += fmt.Sprintf("%s:%s ", name, value)
 		}
 
-		log.Debugf("Sidecar injection policy for %v/%v: namespacePolicy:%v useDefault:%v inject:%v required:%v %s",
+		log.Debugf("Sidecar injection policy for %v/%v: namespacePolicy:%v useDefault:%v inject:%v required:%v reason:%q %s",
 			metadata.Namespace,
 			potentialPodName(metadata),
 			config.Policy,
 			useDefault,
 			inject,
 			required,
+			reason,
 			annotationStr)
 	}
 
-	return required
+	return required, reason
 }
 
 func formatDuration(in *types.Duration) string {
@@ -527,15 +1564,33 @@ func flippedContains(needle, haystack string) bool {
 	return strings.Contains(haystack, needle)
 }
 
+// injectionWarnings collects the non-fatal issues found while injecting. A nil collector only
+// logs them.
+type injectionWarnings []string
+
+func (w *injectionWarnings) warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Warn(msg)
+	if w != nil {
+		*w = append(*w, msg)
+	}
+}
+
 // InjectionData renders sidecarTemplate with valuesConfig.
 func InjectionData(sidecarTemplate, valuesConfig, version string, typeMetadata *metav1.TypeMeta, deploymentMetadata *metav1.ObjectMeta, spec *corev1.PodSpec,
 	metadata *metav1.ObjectMeta, proxyConfig *meshconfig.ProxyConfig, meshConfig *meshconfig.MeshConfig) (
 	*SidecarInjectionSpec, string, error) {
+	return injectionData(sidecarTemplate, valuesConfig, version, typeMetadata, deploymentMetadata, spec, metadata, proxyConfig, meshConfig, nil)
+}
+
+func injectionData(sidecarTemplate, valuesConfig, version string, typeMetadata *metav1.TypeMeta, deploymentMetadata *metav1.ObjectMeta, spec *corev1.PodSpec,
+	metadata *metav1.ObjectMeta, proxyConfig *meshconfig.ProxyConfig, meshConfig *meshconfig.MeshConfig, warnings *injectionWarnings) (
+	*SidecarInjectionSpec, string, error) {
 
 	// If DNSPolicy is not ClusterFirst, the Envoy sidecar may not able to connect to Istio Pilot.
 	if spec.DNSPolicy != "" && spec.DNSPolicy != corev1.DNSClusterFirst {
 		podName := potentialPodName(metadata)
-		log.Warnf("%q's DNSPolicy is not %q. The Envoy sidecar may not able to connect to Istio Pilot",
+		warnings.warnf("%q's DNSPolicy is not %q. The Envoy sidecar may not able to connect to Istio Pilot",
 			metadata.Namespace+"/"+podName, corev1.DNSClusterFirst)
 	}
 
@@ -544,12 +1599,35 @@ func InjectionData(sidecarTemplate, valuesConfig, version string, typeMetadata *
 		return nil, "", err
 	}
 
+	warnPortConflicts(metadata, spec.Containers, warnings)
+
 	values := map[string]interface{}{}
 	if err := yaml.Unmarshal([]byte(valuesConfig), &values); err != nil {
 		log.Infof("Failed to parse values config: %v [%v]\n", err, valuesConfig)
 		return nil, "", multierror.Prefix(err, "could not parse configuration values:")
 	}
 
+	if err := validateTemplateCompatibility(sidecarTemplate, values); err != nil {
+		log.Errorf("Injection failed due to incompatible template and values: %v", err)
+		return nil, "", err
+	}
+
+	if err := checkHostNamespaces(spec, metadata,
+		lookupValue(values, "sidecarInjectorWebhook", "strictHostNamespaces") == "true", warnings); err != nil {
+		log.Errorf("Injection failed due to host namespaces: %v", err)
+		return nil, "", err
+	}
+
+	if lookupValue(values, "sidecarInjectorWebhook", "strictAnnotations") == "true" {
+		if err := validateAnnotationKeys(metadata.GetAnnotations()); err != nil {
+			log.Errorf("Injection failed due to unknown annotations: %v", err)
+			return nil, "", err
+		}
+	}
+
+	// the params overridden by pod annotations are resolved before the template renders them
+	templateValues, paramTrace := resolveParamOverrides(values, metadata.GetAnnotations())
+
 	data := SidecarTemplateData{
 		TypeMeta:       typeMetadata,
 		DeploymentMeta: deploymentMetadata,
@@ -557,13 +1635,14 @@ func InjectionData(sidecarTemplate, valuesConfig, version string, typeMetadata *
 		Spec:           spec,
 		ProxyConfig:    proxyConfig,
 		MeshConfig:     meshConfig,
-		Values:         values,
+		Values:         templateValues,
 	}
 
 	funcMap := template.FuncMap{
 		"formatDuration":      formatDuration,
 		"isset":               isset,
 		"excludeInboundPort":  excludeInboundPort,
+		"excludeNonTCPPorts":  excludeNonTCPInboundPorts,
 		"includeInboundPorts": includeInboundPorts,
 		"kubevirtInterfaces":  kubevirtInterfaces,
 		"applicationPorts":    applicationPorts,
@@ -572,6 +1651,8 @@ func InjectionData(sidecarTemplate, valuesConfig, version string, typeMetadata *
 		"toJSON":              toJSON,
 		"toJson":              toJSON, // Used by, e.g. Istio 1.0.5 template sidecar-injector-configmap.yaml
 		"fromJSON":            fromJSON,
+		"userVolumes":         renderUserVolumes,
+		"userVolumeMounts":    renderUserVolumeMounts,
 		"structToJSON":        structToJSON,
 		"protoToJSON":         protoToJSON,
 		"toYaml":              toYaml,
@@ -579,6 +1660,7 @@ func InjectionData(sidecarTemplate, valuesConfig, version string, typeMetadata *
 		"directory":           directory,
 		"contains":            flippedContains,
 		"toLower":             strings.ToLower,
+		"appPreStopPorts":     applicationPreStopPorts,
 	}
 
 	// Allows the template to use env variables from istiod.
@@ -614,11 +1696,81 @@ func InjectionData(sidecarTemplate, valuesConfig, version string, typeMetadata *
 		log.Warnf("Failed to unmarshal template %v %s", err, bbuf.String())
 		return nil, "", multierror.Prefix(err, "failed parsing generated injected YAML (check Istio sidecar injector configuration):")
 	}
+	templateEnvLen := make([]int, len(sic.Containers))
+	for i, c := range sic.Containers {
+		templateEnvLen[i] = len(c.Env)
+	}
+
+	if lookupValue(values, "istio_cni", "enabled") == "true" {
+		warnCniTrafficAnnotations(metadata, warnings)
+	}
+
+	// resolve the proxy settings: template, then values, then pod annotations
+	sic.ProxyMergeTrace = append(paramTrace, mergeProxyContainer(sic.Containers, values, metadata.GetAnnotations())...)
 
 	// set sidecar --concurrency
 	applyConcurrency(sic.Containers)
 
-	status := &SidecarInjectionStatus{Version: version}
+	applyShareProcessNamespace(&sic, spec, metadata, warnings)
+	// before the memory threshold, which is derived from the limits
+	applyProxyResourceAnnotations(&sic, metadata.GetAnnotations())
+	coupleProxyLimitsToRequests(&sic, warnings)
+	inheritProxyResources(&sic)
+	if err := applyProxyVolumeSizeLimit(&sic); err != nil {
+		return nil, "", err
+	}
+	applyProxyMemoryThreshold(&sic)
+	applyNodeNameEnv(&sic)
+	applyReadinessInitialDelayFloor(&sic)
+	applyProxyImageRules(&sic, spec, metadata.GetAnnotations())
+	// last of the image settings, and before the pull policies derived from the images
+	if err := applyProxyImageSelector(&sic, values, metadata, spec); err != nil {
+		return nil, "", err
+	}
+	applySpotNodeDrain(&sic, spec)
+	applyHoldApplicationUntilProxyStarts(&sic, metadata.GetAnnotations(), warnings)
+	warnAppPreStop(metadata, spec.Containers, FindSidecar(sic.Containers), warnings)
+	if sic.InferPullPolicyFromTag {
+		inferPullPolicies(sic.InitContainers)
+		inferPullPolicies(sic.Containers)
+	}
+	if policy := podPullPolicy(spec); sic.MatchPodImagePullPolicy && policy != "" {
+		setPullPolicies(sic.InitContainers, policy)
+		setPullPolicies(sic.Containers, policy)
+	}
+
+	applyProxyMetadata(&sic, proxyConfig.GetProxyMetadata(), metadata.GetAnnotations())
+	applyTrustDomain(&sic, meshConfig.GetTrustDomain(), metadata.GetAnnotations())
+	applyImagePullSecrets(&sic, spec, metadata.GetAnnotations())
+	applyProxyEnv(&sic, metadata.GetAnnotations())
+	applyExtraProxyArgs(&sic, metadata.GetAnnotations())
+	applyProxySecurityContext(&sic, metadata.GetAnnotations())
+	if lookupValue(values, "sidecarInjectorWebhook", "redactSensitive") != "false" {
+		redactTrace(sic.ProxyMergeTrace)
+	}
+	if lookupValue(values, "sidecarInjectorWebhook", "reportAnnotationOverrides") == "true" {
+		warnAnnotationOverrides(sic.ProxyMergeTrace, warnings)
+	}
+	if sidecar := FindSidecar(sic.Containers); sidecar != nil {
+		warnStatusPortRange(extractStatusPort(sidecar), warnings)
+	}
+	if err := applyInitSeccompProfile(&sic); err != nil {
+		return nil, "", err
+	}
+
+	for i := range sic.Containers {
+		sortAppendedEnv(sic.Containers[i].Env[templateEnvLen[i]:])
+		sic.Containers[i].Env = dedupeEnv(sic.Containers[i].Env)
+		if sic.DedupeDownwardAPIEnv {
+			referenceDownwardAPIEnv(sic.Containers[i].Name, sic.Containers[i].Env)
+		}
+	}
+
+	if err := renameCollidingVolumes(&sic, spec.Volumes, parseInjectionStatus(metadata.Annotations)); err != nil {
+		return nil, "", err
+	}
+
+	status := &SidecarInjectionStatus{Version: version, Mode: injectionModeFor(&sic)}
 	for _, c := range sic.InitContainers {
 		status.InitContainers = append(status.InitContainers, c.Name)
 	}
@@ -631,6 +1783,7 @@ func InjectionData(sidecarTemplate, valuesConfig, version string, typeMetadata *
 	for _, c := range sic.ImagePullSecrets {
 		status.ImagePullSecrets = append(status.ImagePullSecrets, c.Name)
 	}
+	recordPodChanges(status, &sic, metadata, spec)
 	statusAnnotationValue, err := json.Marshal(status)
 	if err != nil {
 		return nil, "", fmt.Errorf("error encoded injection status: %v", err)
@@ -638,6 +1791,27 @@ func InjectionData(sidecarTemplate, valuesConfig, version string, typeMetadata *
 	return &sic, string(statusAnnotationValue), nil
 }
 
+// recordPodChanges records in status what injecting sic changes in the pod of metadata and spec,
+// besides the containers, volumes and image pull secrets, so that uninjectPod can revert it.
+func recordPodChanges(status *SidecarInjectionStatus, sic *SidecarInjectionSpec, metadata *metav1.ObjectMeta, spec *corev1.PodSpec) {
+	for _, name := range redirectAnnotations {
+		if value, ok := metadata.Annotations[name]; ok {
+			if status.RedirectAnnotations == nil {
+				status.RedirectAnnotations = map[string]string{}
+			}
+			status.RedirectAnnotations[name] = value
+		}
+	}
+	status.Tolerations = missingTolerations(spec.Tolerations, sic.Tolerations)
+	for _, g := range missingReadinessGates(spec.ReadinessGates, sic.ReadinessGates) {
+		status.ReadinessGates = append(status.ReadinessGates, string(g.ConditionType))
+	}
+	status.ServiceLinksDisabled = sic.DisableServiceLinks && spec.EnableServiceLinks == nil
+	status.CNINodeAffinity = sic.RequireCNINodeAffinity && !reflect.DeepEqual(cniNodeAffinity(spec.Affinity), spec.Affinity)
+	_, declared := metadata.Annotations[safeToEvictAnnotation]
+	status.SafeToEvict = sic.NodeDrainAware && !declared
+}
+
 func parseTemplate(tmplStr string, funcMap map[string]interface{}, data SidecarTemplateData) (bytes.Buffer, error) {
 	var tmpl bytes.Buffer
 	temp := template.New("inject")
@@ -654,9 +1828,53 @@ func parseTemplate(tmplStr string, funcMap map[string]interface{}, data SidecarT
 	return tmpl, nil
 }
 
+// outputValues holds the subset of the values config that controls how
+// kube-inject selects and writes its output, as opposed to what gets injected.
+type outputValues struct {
+	SidecarInjectorWebhook struct {
+		AlwaysEmitDocumentSeparator bool                `json:"alwaysEmitDocumentSeparator"`
+		ReinjectLegacyStatus        bool                `json:"reinjectLegacyStatus"`
+		ReinjectOnVersionChange     bool                `json:"reinjectOnVersionChange"`
+		HonorInjectAnnotation       bool                `json:"honorInjectAnnotation"`
+		PreserveKeyOrder            bool                `json:"preserveKeyOrder"`
+		CustomPodTemplates          []CustomPodTemplate `json:"customPodTemplates"`
+	} `json:"sidecarInjectorWebhook"`
+}
+
 // IntoResourceFile injects the istio proxy into the specified
 // kubernetes YAML file.
 func IntoResourceFile(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig, in io.Reader, out io.Writer) error {
+	return intoResourceFile(sidecarTemplate, valuesConfig, meshconfig, in, out, nil, nil, nil)
+}
+
+// OutputTransform post-processes the YAML of each object of a file, e.g. to add a header, before
+// it is written. It runs once the object is injected and marshaled: its output is not injected
+// again.
+type OutputTransform func([]byte) ([]byte, error)
+
+// IntoResourceFileWithTransform is like IntoResourceFile, with the output of each object passed
+// through transform when it is not nil.
+func IntoResourceFileWithTransform(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig,
+	in io.Reader, out io.Writer, transform OutputTransform) error {
+	return intoResourceFile(sidecarTemplate, valuesConfig, meshconfig, in, out, nil, nil, transform)
+}
+
+// IntoResourceFileWithWarnings is like IntoResourceFile, but also returns the non-fatal issues
+// found while injecting, e.g. annotations that may have no effect.
+func IntoResourceFileWithWarnings(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig,
+	in io.Reader, out io.Writer) ([]string, error) {
+	var warnings injectionWarnings
+	err := intoResourceFile(sidecarTemplate, valuesConfig, meshconfig, in, out, &warnings, nil, nil)
+	return warnings, err
+}
+
+func intoResourceFile(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig, in io.Reader, out io.Writer,
+	warnings *injectionWarnings, report *InjectionFileReport, transform OutputTransform) error {
+	// Invalid values are reported by InjectionData once a resource is injected.
+	var outValues outputValues
+	_ = yaml.Unmarshal([]byte(valuesConfig), &outValues)
+	prefixSeparator := outValues.SidecarInjectorWebhook.AlwaysEmitDocumentSeparator
+
 	reader := yamlDecoder.NewYAMLReader(bufio.NewReaderSize(in, 4096))
 	for {
 		raw, err := reader.Read()
@@ -666,6 +1884,17 @@ func IntoResourceFile(sidecarTemplate string, valuesConfig string, meshconfig *m
 		if err != nil {
 			return err
 		}
+		if isEmptyDocument(raw) {
+			// Helm renders documents holding no object, e.g. for its disabled templates. Their
+			// comments are kept, while blank documents are dropped.
+			if len(bytes.TrimSpace(raw)) == 0 {
+				continue
+			}
+			if err = writeDocument(out, raw, prefixSeparator); err != nil {
+				return err
+			}
+			continue
+		}
 
 		obj, err := FromRawToObject(raw)
 		if err != nil && !runtime.IsNotRegisteredError(err) {
@@ -674,27 +1903,79 @@ func IntoResourceFile(sidecarTemplate string, valuesConfig string, meshconfig *m
 
 		var updated []byte
 		if err == nil {
-			outObject, err := IntoObject(sidecarTemplate, valuesConfig, meshconfig, obj) // nolint: vetshadow
+			outObject, err := intoObject(sidecarTemplate, valuesConfig, meshconfig, obj, warnings) // nolint: vetshadow
 			if err != nil {
 				return err
 			}
 			if updated, err = yaml.Marshal(outObject); err != nil {
 				return err
 			}
+			report.addResult(obj, outObject, func(metadata *metav1.ObjectMeta, spec *corev1.PodSpec) (*SidecarInjectionSpec, error) {
+				return BuildSidecar(sidecarTemplate, valuesConfig, meshconfig, metadata, spec)
+			})
+			if outValues.SidecarInjectorWebhook.PreserveKeyOrder {
+				if updated, err = keepKeyOrder(raw, updated); err != nil {
+					return err
+				}
+			}
+		} else if paths := customPodTemplatePaths(outValues.SidecarInjectorWebhook.CustomPodTemplates, raw); len(paths) > 0 {
+			if updated, err = intoCustomResource(sidecarTemplate, valuesConfig, meshconfig, raw, paths, warnings); err != nil {
+				return err
+			}
+			if outValues.SidecarInjectorWebhook.PreserveKeyOrder {
+				if updated, err = keepKeyOrder(raw, updated); err != nil {
+					return err
+				}
+			}
+			report.addObject(raw, true, "")
 		} else {
 			updated = raw // unchanged
+			warnUnlistedKnativeService(raw, warnings)
+			report.addObject(raw, false, SkipReasonUnsupportedKind)
+		}
+		if transform != nil {
+			if updated, err = transform(updated); err != nil {
+				return fmt.Errorf("output transform failed: %v", err)
+			}
+		}
+
+		if err = writeDocument(out, updated, prefixSeparator); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if _, err = out.Write(updated); err != nil {
+// writeDocument writes the YAML document doc to out, preceded by its separator when
+// prefixSeparator is set and followed by it otherwise.
+func writeDocument(out io.Writer, doc []byte, prefixSeparator bool) error {
+	if prefixSeparator {
+		if _, err := fmt.Fprint(out, "---\n"); err != nil {
 			return err
 		}
-		if _, err = fmt.Fprint(out, "---\n"); err != nil {
+	}
+	if _, err := out.Write(doc); err != nil {
+		return err
+	}
+	if !prefixSeparator {
+		if _, err := fmt.Fprint(out, "---\n"); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// isEmptyDocument reports whether the YAML document raw holds no object, only blank lines and
+// comments.
+func isEmptyDocument(raw []byte) bool {
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 && line[0] != '#' {
+			return false
+		}
+	}
+	return true
+}
+
 // FromRawToObject is used to convert from raw to the runtime object
 func FromRawToObject(raw []byte) (runtime.Object, error) {
 	var typeMeta metav1.TypeMeta
@@ -716,12 +1997,84 @@ func FromRawToObject(raw []byte) (runtime.Object, error) {
 
 // IntoObject convert the incoming resources into Injected resources
 func IntoObject(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig, in runtime.Object) (interface{}, error) {
-	out := in.DeepCopyObject()
+	return intoObject(sidecarTemplate, valuesConfig, meshconfig, in, nil)
+}
+
+// BuildSidecar returns what injecting the istio proxy adds to the pod of metadata and spec,
+// which are left unchanged: the containers, init containers, volumes, image pull secrets and
+// annotations of the returned spec are the ones IntoObject merges into the pod, except for the
+// injection ID, which is unique to each injection. The checks that
+// would skip the injection are not applied, and the changes made to the application containers,
+// such as the rewrite of their HTTP probes, are not part of it. The ProxyMergeTrace of the
+// returned spec tells which of the template, the values and the pod annotations set each
+// setting of the proxy.
+func BuildSidecar(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig,
+	metadata *metav1.ObjectMeta, spec *corev1.PodSpec) (*SidecarInjectionSpec, error) {
+	metadata = metadata.DeepCopy()
+	spec = spec.DeepCopy()
+
+	typeMeta := &metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}
+	sic, status, err := injectionData(
+		sidecarTemplate,
+		valuesConfig,
+		sidecarTemplateVersionHash(sidecarTemplate),
+		typeMeta,
+		metadata,
+		spec,
+		metadata,
+		meshconfig.DefaultConfig,
+		meshconfig,
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	// Every injection records a new ID, which is left out.
+	sic.Annotations = injectedAnnotations(sic, metadata, status, "")
+	rewriteCniPodSPec(sic.Annotations, sic)
+	return sic, nil
+}
+
+// InjectPod is like IntoObject for a pod already decoded by the caller. The given pod is left
+// unchanged; the injected copy is returned.
+func InjectPod(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig, pod *corev1.Pod) (*corev1.Pod, error) {
+	out, err := intoObject(sidecarTemplate, valuesConfig, meshconfig, pod, nil)
+	if err != nil {
+		return nil, err
+	}
+	return out.(*corev1.Pod), nil
+}
+
+// ProxyImageSelector returns the images of the proxy and of the init containers to inject into
+// the given pod. An empty image keeps the one selected otherwise.
+type ProxyImageSelector func(pod *corev1.Pod) (proxyImage, initImage string, err error)
+
+var (
+	proxyImageSelectorsMu sync.RWMutex
+	proxyImageSelectors   = map[string]ProxyImageSelector{}
+)
+
+// RegisterProxyImageSelector registers selector under name, for the
+// sidecarInjectorWebhook.proxyImageSelector value to refer to. This lets both kube-inject and the
+// webhook, whose params only travel as values, call the selector. A nil selector unregisters name.
+func RegisterProxyImageSelector(name string, selector ProxyImageSelector) {
+	proxyImageSelectorsMu.Lock()
+	defer proxyImageSelectorsMu.Unlock()
+	if selector == nil {
+		delete(proxyImageSelectors, name)
+		return
+	}
+	proxyImageSelectors[name] = selector
+}
+
+func lookupProxyImageSelector(name string) ProxyImageSelector {
+	proxyImageSelectorsMu.RLock()
+	defer proxyImageSelectorsMu.RUnlock()
+	return proxyImageSelectors[name]
+}
 
-	var deploymentMetadata *metav1.ObjectMeta
-	var metadata *metav1.ObjectMeta
-	var podSpec *corev1.PodSpec
-	var typeMeta *metav1.TypeMeta
+func intoObject(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig, in runtime.Object,
+	warnings *injectionWarnings) (interface{}, error) {
+	out := in.DeepCopyObject()
 
 	// Handle Lists
 	if list, ok := out.(*corev1.List); ok {
@@ -736,7 +2089,7 @@ func IntoObject(sidecarTemplate string, valuesConfig string, meshconfig *meshcon
 				return nil, err
 			}
 
-			r, err := IntoObject(sidecarTemplate, valuesConfig, meshconfig, obj) // nolint: vetshadow
+			r, err := intoObject(sidecarTemplate, valuesConfig, meshconfig, obj, warnings) // nolint: vetshadow
 			if err != nil {
 				return nil, err
 			}
@@ -748,47 +2101,10 @@ func IntoObject(sidecarTemplate string, valuesConfig string, meshconfig *meshcon
 		return result, nil
 	}
 
-	// CronJobs have JobTemplates in them, instead of Templates, so we
-	// special case them.
-	switch v := out.(type) {
-	case *v2alpha1.CronJob:
-		job := v
-		typeMeta = &job.TypeMeta
-		metadata = &job.Spec.JobTemplate.ObjectMeta
-		deploymentMetadata = &job.ObjectMeta
-		podSpec = &job.Spec.JobTemplate.Spec.Template.Spec
-	case *corev1.Pod:
-		pod := v
-		typeMeta = &pod.TypeMeta
-		metadata = &pod.ObjectMeta
-		deploymentMetadata = &pod.ObjectMeta
-		podSpec = &pod.Spec
-	case *appsv1.Deployment: // Added to be explicit about the most expected case
-		deploy := v
-		typeMeta = &deploy.TypeMeta
-		deploymentMetadata = &deploy.ObjectMeta
-		metadata = &deploy.Spec.Template.ObjectMeta
-		podSpec = &deploy.Spec.Template.Spec
-	default:
-		// `in` is a pointer to an Object. Dereference it.
-		outValue := reflect.ValueOf(out).Elem()
-
-		typeMeta = outValue.FieldByName("TypeMeta").Addr().Interface().(*metav1.TypeMeta)
-
-		deploymentMetadata = outValue.FieldByName("ObjectMeta").Addr().Interface().(*metav1.ObjectMeta)
-
-		templateValue := outValue.FieldByName("Spec").FieldByName("Template")
-		// `Template` is defined as a pointer in some older API
-		// definitions, e.g. ReplicationController
-		if templateValue.Kind() == reflect.Ptr {
-			if templateValue.IsNil() {
-				return out, fmt.Errorf("spec.template is required value")
-			}
-			templateValue = templateValue.Elem()
-		}
-		metadata = templateValue.FieldByName("ObjectMeta").Addr().Interface().(*metav1.ObjectMeta)
-		podSpec = templateValue.FieldByName("Spec").Addr().Interface().(*corev1.PodSpec)
-	}
+	typeMeta, deploymentMetadata, metadata, podSpec, err := podTemplateOf(out)
+	if err != nil {
+		return out, err
+	}
 
 	name := metadata.Name
 	if name == "" {
@@ -805,8 +2121,53 @@ func IntoObject(sidecarTemplate string, valuesConfig string, meshconfig *meshcon
 			name)
 		return out, nil
 	}
+	if isWindowsPod(podSpec) {
+		_, _ = fmt.Fprintf(os.Stderr, "Skipping injection because %q runs on Windows nodes\n", name)
+		return out, nil
+	}
+	if injectAnnotationDisables(metadata) {
+		var outValues outputValues
+		_ = yaml.Unmarshal([]byte(valuesConfig), &outValues)
+		if outValues.SidecarInjectorWebhook.HonorInjectAnnotation {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping injection because %q disables it with the %s annotation\n",
+				name, annotation.SidecarInject.Name)
+			return out, nil
+		}
+	}
 
-	//skip injection for injected pods
+	// skip injection for injected pods, including partially injected ones which
+	// carry no proxy container but record what was injected in their status.
+	if prev := parseInjectionStatus(metadata.Annotations); prev != nil {
+		var outValues outputValues
+		_ = yaml.Unmarshal([]byte(valuesConfig), &outValues)
+		reinject := false
+		if outValues.SidecarInjectorWebhook.ReinjectOnVersionChange {
+			if prev.Version != sidecarTemplateVersionHash(sidecarTemplate) {
+				reinject = true
+			} else if reinject, err = injectionModeChanged(sidecarTemplate, valuesConfig, typeMeta, deploymentMetadata,
+				metadata, podSpec, meshconfig, prev); err != nil {
+				return nil, err
+			}
+		}
+		if !reinject {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping injection because %q has been injected already\n", name)
+			return out, nil
+		}
+		// injected from another template, or into another mode: the recorded sidecar is replaced.
+		uninjectPod(metadata, podSpec, prev)
+	}
+	// pods injected by much older versions carry a status this version cannot parse; their
+	// sidecar is found by name instead.
+	if hasLegacyInjectionStatus(metadata.Annotations) && hasLegacyInjectedResources(podSpec) {
+		var outValues outputValues
+		_ = yaml.Unmarshal([]byte(valuesConfig), &outValues)
+		if !outValues.SidecarInjectorWebhook.ReinjectLegacyStatus {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping injection because %q has been injected by an older version, "+
+				"set reinjectLegacyStatus to replace its sidecar\n", name)
+			return out, nil
+		}
+		removeLegacyInjectedResources(podSpec)
+	}
 	if len(podSpec.Containers) > 1 {
 		for _, c := range podSpec.Containers {
 			if c.Name == ProxyContainerName {
@@ -817,7 +2178,7 @@ func IntoObject(sidecarTemplate string, valuesConfig string, meshconfig *meshcon
 		}
 	}
 
-	spec, status, err := InjectionData(
+	spec, status, err := injectionData(
 		sidecarTemplate,
 		valuesConfig,
 		sidecarTemplateVersionHash(sidecarTemplate),
@@ -826,21 +2187,47 @@ func IntoObject(sidecarTemplate string, valuesConfig string, meshconfig *meshcon
 		podSpec,
 		metadata,
 		meshconfig.DefaultConfig,
-		meshconfig)
+		meshconfig,
+		warnings)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := checkContainerLimit(name, podSpec, spec); err != nil {
+		return nil, err
+	}
+
+	// Only containers, volumes, image pull secrets, tolerations, readiness gates and DNS config are
+	// merged into the pod spec. Other scheduling related fields such as spec.overhead, which is set from the pod's
+	// RuntimeClass, are left as declared.
 	podSpec.InitContainers = append(podSpec.InitContainers, spec.InitContainers...)
 
 	podSpec.Containers = append(podSpec.Containers, spec.Containers...)
 	podSpec.Volumes = append(podSpec.Volumes, spec.Volumes...)
+	podSpec.ImagePullSecrets = append(podSpec.ImagePullSecrets, spec.ImagePullSecrets...)
+	podSpec.Tolerations = append(podSpec.Tolerations, missingTolerations(podSpec.Tolerations, spec.Tolerations)...)
+	podSpec.ReadinessGates = append(podSpec.ReadinessGates, missingReadinessGates(podSpec.ReadinessGates, spec.ReadinessGates)...)
 
 	podSpec.DNSConfig = spec.DNSConfig
 
+	if spec.DisableServiceLinks && podSpec.EnableServiceLinks == nil {
+		enableServiceLinks := false
+		podSpec.EnableServiceLinks = &enableServiceLinks
+	}
+
+	if spec.RequireCNINodeAffinity {
+		podSpec.Affinity = cniNodeAffinity(podSpec.Affinity)
+	}
+
 	// Modify application containers' HTTP probe after appending injected containers.
 	// Because we need to extract istio-proxy's statusPort.
 	rewriteAppHTTPProbe(metadata.Annotations, podSpec, spec)
+	wrapAppEntrypoint(metadata.Annotations, podSpec, spec, warnings)
+	applyTelemetryUDSAppEnv(podSpec, spec)
+	applyJobProxyQuitEnv(typeMeta, podSpec, spec)
+	if spec.HoldApplicationUntilProxyStarts {
+		moveSidecarFirst(podSpec)
+	}
 
 	// due to bug https://github.com/kubernetes/kubernetes/issues/57923,
 	// k8s sa jwt token volume mount file is only accessible to root user, not istio-proxy(the user that istio proxy runs as).
@@ -852,47 +2239,1037 @@ func IntoObject(sidecarTemplate string, valuesConfig string, meshconfig *meshcon
 		}
 	}
 
+	// Bare pod templates may have no metadata section at all.
+	initObjectMetaMaps(metadata)
+
+	annotations := injectedAnnotations(spec, metadata, status, newInjectionID())
+	rewriteCniPodSPec(annotations, spec)
+	for name, value := range annotations {
+		metadata.Annotations[name] = value
+	}
+	// Labels are only ever added, never removed or changed: the workload selector or an HPA may
+	// target any of the existing ones, and altering them would orphan the pods of the controller.
+	if status != "" && metadata.Labels[model.TLSModeLabelName] == "" {
+		metadata.Labels[model.TLSModeLabelName] = model.IstioMutualTLSModeLabel
+	}
+
+	return out, nil
+}
+
+// injectedAnnotations returns the annotations the injection of spec adds to the pod template of
+// metadata, its injection status included. The injection ID is only recorded when not empty.
+// kube-inject adds the redirect annotations on top of these, the webhook does not.
+func injectedAnnotations(spec *SidecarInjectionSpec, metadata *metav1.ObjectMeta, status, injectionID string) map[string]string {
+	annotations := map[string]string{annotation.SidecarStatus.Name: status}
+	if spec.RecordInjectionID && injectionID != "" {
+		annotations[injectionIDAnnotation] = injectionID
+	}
+	if owner := podOwner(metadata); spec.RecordOwner && owner != "" {
+		annotations[ownerAnnotation] = owner
+	}
+	if spec.RecordInjectorVersion {
+		// The values config of the webhook does not usually set a version, the build is recorded.
+		injectorVersion := spec.InjectorVersion
+		if injectorVersion == "" {
+			injectorVersion = version.Info.Version
+		}
+		annotations[injectorVersionAnnotation] = injectorVersion
+	}
+	if _, ok := metadata.Annotations[safeToEvictAnnotation]; spec.NodeDrainAware && !ok {
+		annotations[safeToEvictAnnotation] = "true"
+	}
+	for name, value := range spec.SeccompAnnotations {
+		annotations[name] = value
+	}
+	return annotations
+}
+
+// podTemplateOf returns the type of the given workload, along with its metadata and the metadata
+// and spec of its pod template. Pods are their own template.
+func podTemplateOf(out runtime.Object) (typeMeta *metav1.TypeMeta, deploymentMetadata *metav1.ObjectMeta,
+	metadata *metav1.ObjectMeta, podSpec *corev1.PodSpec, err error) {
+	// CronJobs have JobTemplates in them, instead of Templates, so we
+	// special case them.
+	switch v := out.(type) {
+	case *v2alpha1.CronJob:
+		job := v
+		typeMeta = &job.TypeMeta
+		metadata = &job.Spec.JobTemplate.ObjectMeta
+		deploymentMetadata = &job.ObjectMeta
+		podSpec = &job.Spec.JobTemplate.Spec.Template.Spec
+	case *corev1.Pod:
+		pod := v
+		typeMeta = &pod.TypeMeta
+		metadata = &pod.ObjectMeta
+		deploymentMetadata = &pod.ObjectMeta
+		podSpec = &pod.Spec
+	case *appsv1.Deployment: // Added to be explicit about the most expected case
+		deploy := v
+		typeMeta = &deploy.TypeMeta
+		deploymentMetadata = &deploy.ObjectMeta
+		metadata = &deploy.Spec.Template.ObjectMeta
+		podSpec = &deploy.Spec.Template.Spec
+	default:
+		// `in` is a pointer to an Object. Dereference it.
+		outValue := reflect.ValueOf(out).Elem()
+
+		typeMeta = outValue.FieldByName("TypeMeta").Addr().Interface().(*metav1.TypeMeta)
+
+		deploymentMetadata = outValue.FieldByName("ObjectMeta").Addr().Interface().(*metav1.ObjectMeta)
+
+		templateValue := outValue.FieldByName("Spec").FieldByName("Template")
+		// `Template` is defined as a pointer in some older API
+		// definitions, e.g. ReplicationController
+		if templateValue.Kind() == reflect.Ptr {
+			if templateValue.IsNil() {
+				return nil, nil, nil, nil, fmt.Errorf("spec.template is required value")
+			}
+			templateValue = templateValue.Elem()
+		}
+		metadata = templateValue.FieldByName("ObjectMeta").Addr().Interface().(*metav1.ObjectMeta)
+		podSpec = templateValue.FieldByName("Spec").Addr().Interface().(*corev1.PodSpec)
+	}
+	return typeMeta, deploymentMetadata, metadata, podSpec, nil
+}
+
+// initObjectMetaMaps allocates the annotations and labels of metadata when they are absent, so
+// that injection can write to them.
+func initObjectMetaMaps(metadata *metav1.ObjectMeta) {
 	if metadata.Annotations == nil {
 		metadata.Annotations = make(map[string]string)
 	}
+	if metadata.Labels == nil {
+		metadata.Labels = make(map[string]string)
+	}
+}
 
-	if len(spec.PodRedirectAnnot) != 0 {
-		rewriteCniPodSPec(metadata.Annotations, spec)
+// podOwner returns the controller owning the pod, as "Kind/name", or "" if it has none. Pods of
+// a ReplicaSet created for a Deployment are reported as owned by the Deployment.
+func podOwner(metadata *metav1.ObjectMeta) string {
+	for _, ref := range metadata.GetOwnerReferences() {
+		if ref.Controller == nil || !*ref.Controller {
+			continue
+		}
+		hash := metadata.Labels["pod-template-hash"]
+		if ref.Kind == "ReplicaSet" && hash != "" && strings.HasSuffix(ref.Name, "-"+hash) {
+			return "Deployment/" + strings.TrimSuffix(ref.Name, "-"+hash)
+		}
+		return ref.Kind + "/" + ref.Name
 	}
+	return ""
+}
 
-	metadata.Annotations[annotation.SidecarStatus.Name] = status
-	if status != "" && metadata.Labels[model.TLSModeLabelName] == "" {
-		if metadata.Labels == nil {
-			metadata.Labels = make(map[string]string)
+// cniNodeLabel labels the nodes running the istio-cni plugin.
+const cniNodeLabel = "istio.io/cni"
+
+// cniNodeAffinity returns a copy of affinity that also requires nodes labeled with cniNodeLabel.
+// The requirement is added to every required node selector term, since the terms are ORed.
+func cniNodeAffinity(affinity *corev1.Affinity) *corev1.Affinity {
+	requirement := corev1.NodeSelectorRequirement{Key: cniNodeLabel, Operator: corev1.NodeSelectorOpExists}
+	out := &corev1.Affinity{}
+	if affinity != nil {
+		out = affinity.DeepCopy()
+	}
+	if out.NodeAffinity == nil {
+		out.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	required := out.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		out.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{requirement}}},
+		}
+		return out
+	}
+	for i := range required.NodeSelectorTerms {
+		term := &required.NodeSelectorTerms[i]
+		found := false
+		for _, e := range term.MatchExpressions {
+			if e.Key == requirement.Key && e.Operator == requirement.Operator {
+				found = true
+				break
+			}
+		}
+		if !found {
+			term.MatchExpressions = append(term.MatchExpressions, requirement)
 		}
-		metadata.Labels[model.TLSModeLabelName] = model.IstioMutualTLSModeLabel
 	}
+	return out
+}
 
-	return out, nil
+// maxVolumeRenameAttempts bounds the number of suffixes tried to give an injected volume a name
+// that is not used by the pod.
+const maxVolumeRenameAttempts = 100
+
+// renameCollidingVolumes renames the injected volumes whose name is already used by a volume of
+// the pod, e.g. an application volume named istio-envoy, and updates the mounts of the injected
+// containers accordingly. Volumes recorded in the previous injection status of the pod are
+// replaced by the injection and so do not collide.
+func renameCollidingVolumes(sic *SidecarInjectionSpec, podVolumes []corev1.Volume, prev *SidecarInjectionStatus) error {
+	taken := make(map[string]bool, len(podVolumes)+len(sic.Volumes))
+	for _, v := range podVolumes {
+		if prev == nil || !containsString(prev.Volumes, v.Name) {
+			taken[v.Name] = true
+		}
+	}
+	var colliding []int
+	for i, v := range sic.Volumes {
+		if taken[v.Name] {
+			colliding = append(colliding, i)
+		}
+	}
+	for _, v := range sic.Volumes {
+		taken[v.Name] = true
+	}
+
+	for _, i := range colliding {
+		old := sic.Volumes[i].Name
+		name := ""
+		for n := 1; n <= maxVolumeRenameAttempts; n++ {
+			if candidate := fmt.Sprintf("%s-%d", old, n); !taken[candidate] {
+				name = candidate
+				break
+			}
+		}
+		if name == "" {
+			return fmt.Errorf("injected volume %q collides with a volume of the pod and no free name was found", old)
+		}
+		taken[name] = true
+		renameVolumeMounts(sic.InitContainers, old, name)
+		renameVolumeMounts(sic.Containers, old, name)
+		sic.Volumes[i].Name = name
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func renameVolumeMounts(containers []corev1.Container, from, to string) {
+	for i := range containers {
+		for j := range containers[i].VolumeMounts {
+			if containers[i].VolumeMounts[j].Name == from {
+				containers[i].VolumeMounts[j].Name = to
+			}
+		}
+	}
+}
+
+// newInjectionID returns a unique ID for an injection. The ID is informational only, the
+// injection status annotation alone decides whether a pod has already been injected.
+func newInjectionID() string {
+	return uuid.New().String()
+}
+
+// missingTolerations returns the tolerations in added that are not already in target.
+func missingTolerations(target, added []corev1.Toleration) []corev1.Toleration {
+	var missing []corev1.Toleration
+	for i := range added {
+		if !hasToleration(target, &added[i]) && !hasToleration(missing, &added[i]) {
+			missing = append(missing, added[i])
+		}
+	}
+	return missing
+}
+
+func hasToleration(tolerations []corev1.Toleration, t *corev1.Toleration) bool {
+	for i := range tolerations {
+		if tolerations[i].MatchToleration(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingReadinessGates returns the readiness gates in added whose condition type is not already
+// gated on by target.
+func missingReadinessGates(target, added []corev1.PodReadinessGate) []corev1.PodReadinessGate {
+	var missing []corev1.PodReadinessGate
+	for _, g := range added {
+		if !hasReadinessGate(target, g.ConditionType) && !hasReadinessGate(missing, g.ConditionType) {
+			missing = append(missing, g)
+		}
+	}
+	return missing
+}
+
+func hasReadinessGate(gates []corev1.PodReadinessGate, conditionType corev1.PodConditionType) bool {
+	for _, g := range gates {
+		if g.ConditionType == conditionType {
+			return true
+		}
+	}
+	return false
+}
+
+// applyImagePullSecrets adds to the image pull secrets of sic the ones listed by the
+// sidecar.istio.io/imagePullSecrets annotation, and drops the ones the pod already declares, so
+// that the injection status only records the secrets actually added. The secrets of a previous
+// injection, which are removed on re-injection, are not counted as declared.
+func applyImagePullSecrets(sic *SidecarInjectionSpec, spec *corev1.PodSpec, annotations map[string]string) {
+	secrets := sic.ImagePullSecrets
+	if value := annotations[imagePullSecretsAnnotation]; value != "" {
+		for _, name := range strings.Split(value, ",") {
+			secrets = append(secrets, corev1.LocalObjectReference{Name: name})
+		}
+	}
+	var previous []string
+	if prev := parseInjectionStatus(annotations); prev != nil {
+		previous = prev.ImagePullSecrets
+	}
+	declared := map[string]bool{}
+	for _, s := range spec.ImagePullSecrets {
+		if !containsString(previous, s.Name) {
+			declared[s.Name] = true
+		}
+	}
+	var added []corev1.LocalObjectReference
+	for _, s := range secrets {
+		if !declared[s.Name] {
+			declared[s.Name] = true
+			added = append(added, s)
+		}
+	}
+	sic.ImagePullSecrets = added
+}
+
+// checkContainerLimit returns an error if injecting the sidecar containers into the pod
+// would exceed the maximum number of containers per pod configured for the injection.
+func checkContainerLimit(podName string, podSpec *corev1.PodSpec, spec *SidecarInjectionSpec) error {
+	if spec.MaxContainersPerPod <= 0 {
+		return nil
+	}
+	if total := len(podSpec.Containers) + len(spec.Containers); total > spec.MaxContainersPerPod {
+		return fmt.Errorf("injecting sidecar into %q would result in %d containers, exceeding the maximum of %d containers per pod",
+			podName, total, spec.MaxContainersPerPod)
+	}
+	return nil
+}
+
+// checkHostNamespaces guards the injection of pods sharing the PID or IPC namespace of their
+// node. The proxy then sees, and may signal, the processes of the node, so such pods are warned
+// about, or refused in strict mode. The hostPID and hostIPC fields themselves are left as declared.
+func checkHostNamespaces(spec *corev1.PodSpec, metadata *metav1.ObjectMeta, strict bool, warnings *injectionWarnings) error {
+	var shared []string
+	if spec.HostPID {
+		shared = append(shared, "hostPID")
+	}
+	if spec.HostIPC {
+		shared = append(shared, "hostIPC")
+	}
+	if len(shared) == 0 {
+		return nil
+	}
+	podName := metadata.Namespace + "/" + potentialPodName(metadata)
+	if strict {
+		return fmt.Errorf("%q sets %s, refusing to inject the sidecar into host namespaces", podName, strings.Join(shared, " and "))
+	}
+	warnings.warnf("%q sets %s, the sidecar shares the host namespaces with the node processes", podName, strings.Join(shared, " and "))
+	return nil
+}
+
+// applyShareProcessNamespace handles pods sharing a single process namespace between their
+// containers. The proxy is then no longer PID 1 of its own namespace and sees the application
+// processes, so, when the injection is aware of it, the agent is told through its metadata.
+// Otherwise a warning is logged. The pod's shareProcessNamespace field itself is left as declared.
+func applyShareProcessNamespace(sic *SidecarInjectionSpec, spec *corev1.PodSpec, metadata *metav1.ObjectMeta,
+	warnings *injectionWarnings) {
+	if spec.ShareProcessNamespace == nil || !*spec.ShareProcessNamespace {
+		return
+	}
+	if !sic.ShareProcessNamespaceAware {
+		warnings.warnf("%q shares its process namespace, the sidecar signal handling may affect the application containers",
+			metadata.Namespace+"/"+potentialPodName(metadata))
+		return
+	}
+	for i, c := range sic.Containers {
+		if c.Name == ProxyContainerName {
+			sic.Containers[i].Env = append(sic.Containers[i].Env, corev1.EnvVar{
+				Name:  "ISTIO_META_SHARE_PROCESS_NAMESPACE",
+				Value: "true",
+			})
+			return
+		}
+	}
+}
+
+// cniTrafficAnnotations are the traffic annotations that the istio-cni plugin, rather than an
+// injected init container, applies when istio-cni is enabled.
+var cniTrafficAnnotations = []string{
+	annotation.SidecarTrafficIncludeOutboundIPRanges.Name,
+	annotation.SidecarTrafficExcludeOutboundIPRanges.Name,
+	annotation.SidecarTrafficIncludeInboundPorts.Name,
+	annotation.SidecarTrafficExcludeInboundPorts.Name,
+	annotation.SidecarTrafficExcludeOutboundPorts.Name,
+	annotation.SidecarTrafficKubevirtInterfaces.Name,
+}
+
+// warnCniTrafficAnnotations warns about the traffic annotations of a pod injected with istio-cni
+// enabled. No init container is injected to apply them, so they have no effect on nodes that do
+// not run the istio-cni plugin.
+func warnCniTrafficAnnotations(metadata *metav1.ObjectMeta, warnings *injectionWarnings) {
+	for _, name := range cniTrafficAnnotations {
+		if _, ok := metadata.Annotations[name]; ok {
+			warnings.warnf("%q sets %s, which is only applied on nodes running the istio-cni plugin",
+				metadata.Namespace+"/"+potentialPodName(metadata), name)
+		}
+	}
+}
+
+// inferPullPolicies sets the image pull policy of the containers from their image tag.
+func inferPullPolicies(containers []corev1.Container) {
+	for i := range containers {
+		if isMutableImageTag(containers[i].Image) {
+			containers[i].ImagePullPolicy = corev1.PullAlways
+		} else {
+			containers[i].ImagePullPolicy = corev1.PullIfNotPresent
+		}
+	}
+}
+
+// podPullPolicy returns the image pull policy set by a majority of the containers of the pod, or
+// an empty policy when there is none.
+func podPullPolicy(spec *corev1.PodSpec) corev1.PullPolicy {
+	counts := map[corev1.PullPolicy]int{}
+	for _, c := range spec.Containers {
+		if c.ImagePullPolicy != "" {
+			counts[c.ImagePullPolicy]++
+		}
+	}
+	for policy, count := range counts {
+		if count*2 > len(spec.Containers) {
+			return policy
+		}
+	}
+	return ""
+}
+
+// setPullPolicies sets the image pull policy of the containers.
+func setPullPolicies(containers []corev1.Container, policy corev1.PullPolicy) {
+	for i := range containers {
+		containers[i].ImagePullPolicy = policy
+	}
+}
+
+// isMutableImageTag reports whether the image reference points to a tag that may be moved to
+// another image: no tag at all, latest, or a tag ending in -latest. Digests are never mutable.
+func isMutableImageTag(image string) bool {
+	if strings.Contains(image, "@") {
+		return false
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	i := strings.LastIndex(name, ":")
+	if i < 0 {
+		return true
+	}
+	tag := name[i+1:]
+	return tag == "latest" || strings.HasSuffix(tag, "-latest")
+}
+
+// proxyMemoryThresholdPercent is the share of the proxy memory limit given to the proxy as its
+// memory threshold. The remainder is headroom for allocations made past the threshold.
+const proxyMemoryThresholdPercent = 90
+
+// applyProxyMemoryThreshold sets the memory threshold of the proxy, in bytes, from the memory
+// limit of its container when the injection tunes it. Proxies without a memory limit are skipped.
+func applyProxyMemoryThreshold(sic *SidecarInjectionSpec) {
+	if !sic.TuneProxyMemoryFromLimit {
+		return
+	}
+	for i, c := range sic.Containers {
+		if c.Name != ProxyContainerName {
+			continue
+		}
+		limit, ok := c.Resources.Limits[corev1.ResourceMemory]
+		if !ok || limit.Value() <= 0 {
+			return
+		}
+		threshold := limit.Value() * proxyMemoryThresholdPercent / 100
+		sic.Containers[i].Env = append(sic.Containers[i].Env, corev1.EnvVar{
+			Name:  "ISTIO_META_PROXY_MEMORY_THRESHOLD",
+			Value: strconv.FormatInt(threshold, 10),
+		})
+		return
+	}
+}
+
+// applyNodeNameEnv gives the proxy the name of its node through the downward API when the
+// injection is topology aware. A NODE_NAME variable already declared by the template is kept.
+func applyNodeNameEnv(sic *SidecarInjectionSpec) {
+	if !sic.TopologyAware {
+		return
+	}
+	for i, c := range sic.Containers {
+		if c.Name != ProxyContainerName {
+			continue
+		}
+		for _, e := range c.Env {
+			if e.Name == "NODE_NAME" {
+				return
+			}
+		}
+		sic.Containers[i].Env = append(sic.Containers[i].Env, corev1.EnvVar{
+			Name: "NODE_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"},
+			},
+		})
+		return
+	}
+}
+
+// applyReadinessInitialDelayFloor raises the initial delay of the proxy readiness probe to the
+// configured floor. It never lowers a larger delay.
+func applyReadinessInitialDelayFloor(sic *SidecarInjectionSpec) {
+	if sic.MinReadinessInitialDelaySeconds == 0 {
+		return
+	}
+	for i := range sic.Containers {
+		probe := sic.Containers[i].ReadinessProbe
+		if sic.Containers[i].Name != ProxyContainerName || probe == nil {
+			continue
+		}
+		if probe.InitialDelaySeconds < int32(sic.MinReadinessInitialDelaySeconds) {
+			probe.InitialDelaySeconds = int32(sic.MinReadinessInitialDelaySeconds)
+		}
+	}
+}
+
+// applyProxyImageRules sets the image of the proxy from the rule with the largest MinContainers
+// that the pod reaches. The image set with the proxyImage annotation is kept.
+func applyProxyImageRules(sic *SidecarInjectionSpec, spec *corev1.PodSpec, annotations map[string]string) {
+	if _, ok := annotations[annotation.SidecarProxyImage.Name]; ok {
+		return
+	}
+	var selected *ProxyImageRule
+	for i, rule := range sic.ProxyImageRules {
+		if len(spec.Containers) >= rule.MinContainers && (selected == nil || rule.MinContainers > selected.MinContainers) {
+			selected = &sic.ProxyImageRules[i]
+		}
+	}
+	if selected == nil {
+		return
+	}
+	for i := range sic.Containers {
+		if sic.Containers[i].Name == ProxyContainerName {
+			sic.Containers[i].Image = selected.Image
+		}
+	}
+}
+
+// applyProxyImageSelector sets the images chosen by the proxy image selector named in the values.
+// The init image only replaces that of the init containers running the proxy_init image.
+func applyProxyImageSelector(sic *SidecarInjectionSpec, values map[string]interface{}, metadata *metav1.ObjectMeta,
+	spec *corev1.PodSpec) error {
+	name := lookupValue(values, "sidecarInjectorWebhook", "proxyImageSelector")
+	if name == "" {
+		return nil
+	}
+	selector := lookupProxyImageSelector(name)
+	if selector == nil {
+		return fmt.Errorf("proxy image selector %q is not registered", name)
+	}
+	pod := &corev1.Pod{ObjectMeta: *metadata.DeepCopy(), Spec: *spec.DeepCopy()}
+	proxyImage, initImage, err := selector(pod)
+	if err != nil {
+		return fmt.Errorf("proxy image selector %q failed for pod %q: %v", name, potentialPodName(metadata), err)
+	}
+	if err := validateImageReference("selected proxy image", proxyImage); err != nil {
+		return err
+	}
+	if err := validateImageReference("selected init image", initImage); err != nil {
+		return err
+	}
+	if proxyImage != "" {
+		for i := range sic.Containers {
+			if sic.Containers[i].Name == ProxyContainerName {
+				sic.Containers[i].Image = proxyImage
+			}
+		}
+	}
+	if initImage != "" {
+		proxyInitImage := renderedProxyInitImage(values)
+		for i := range sic.InitContainers {
+			if sic.InitContainers[i].Image == proxyInitImage {
+				sic.InitContainers[i].Image = initImage
+			}
+		}
+	}
+	return nil
+}
+
+// renderedProxyInitImage returns the proxy_init image as the template renders it.
+func renderedProxyInitImage(values map[string]interface{}) string {
+	image := lookupValue(values, "global", "proxy_init", "image")
+	if strings.Contains(image, "/") {
+		return image
+	}
+	return lookupValue(values, "global", "hub") + "/" + image + ":" + lookupValue(values, "global", "tag")
+}
+
+const (
+	// spotDrainDuration caps the drain duration of proxies on spot/preemptible nodes.
+	spotDrainDuration = 5 * time.Second
+	// spotParentShutdownDuration caps the parent shutdown duration of proxies on spot/preemptible
+	// nodes. It must stay longer than spotDrainDuration.
+	spotParentShutdownDuration = 10 * time.Second
+)
+
+// spotNodeLabels are the node labels, and taints, that cloud providers use to mark
+// spot/preemptible nodes, with the value they carry. An empty value matches any value.
+var spotNodeLabels = map[string]string{
+	"cloud.google.com/gke-preemptible":      "",
+	"cloud.google.com/gke-spot":             "",
+	"kubernetes.azure.com/scalesetpriority": "spot",
+	"eks.amazonaws.com/capacityType":        "SPOT",
+	"node.kubernetes.io/lifecycle":          "spot",
+}
+
+// isSpotNodeLabel returns whether the node label or taint key=value marks a spot node.
+func isSpotNodeLabel(key, value string) bool {
+	want, ok := spotNodeLabels[key]
+	return ok && (want == "" || want == value)
+}
+
+// schedulesOnSpotNodes returns whether the pod tolerates the taint of, or selects, spot nodes.
+func schedulesOnSpotNodes(spec *corev1.PodSpec) bool {
+	for _, t := range spec.Tolerations {
+		// An Exists toleration tolerates the taint whatever its value.
+		if _, ok := spotNodeLabels[t.Key]; ok && t.Operator == corev1.TolerationOpExists {
+			return true
+		}
+		if isSpotNodeLabel(t.Key, t.Value) {
+			return true
+		}
+	}
+	for key, value := range spec.NodeSelector {
+		if isSpotNodeLabel(key, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// applySpotNodeDrain caps the drain of the proxy of pods scheduled on spot nodes. Durations
+// already shorter are kept.
+func applySpotNodeDrain(sic *SidecarInjectionSpec, spec *corev1.PodSpec) {
+	if !sic.SpotNodeAware || !schedulesOnSpotNodes(spec) {
+		return
+	}
+	for i := range sic.Containers {
+		c := &sic.Containers[i]
+		if c.Name != ProxyContainerName {
+			continue
+		}
+		for flag, limit := range map[string]time.Duration{
+			"--drainDuration":          spotDrainDuration,
+			"--parentShutdownDuration": spotParentShutdownDuration,
+		} {
+			value, ok := proxyArg(c, flag)
+			if d, err := time.ParseDuration(value); ok && err == nil && d <= limit {
+				continue
+			}
+			setProxyArg(c, flag, limit.String())
+		}
+	}
+}
+
+// applyProxyMetadata adds the proxyMetadata of the mesh ProxyConfig to the env of the proxy, in
+// the order of their names. The proxyMetadata annotation of the pod wins over the mesh for the
+// names both set, and the proxyMetadata wins over the variables of the template.
+func applyProxyMetadata(sic *SidecarInjectionSpec, meshMetadata map[string]string, annotations map[string]string) {
+	merged := map[string]string{}
+	for name, value := range meshMetadata {
+		merged[name] = value
+	}
+	if value, ok := annotations[proxyMetadataAnnotation]; ok {
+		// The annotation has been validated already.
+		podMetadata, _ := parseProxyMetadata(value)
+		names := make([]string, 0, len(podMetadata))
+		for name, value := range podMetadata {
+			merged[name] = value
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sic.traceMerge(ProxyMergeLayerAnnotations, "env."+name, podMetadata[name])
+		}
+	}
+	if len(merged) == 0 {
+		return
+	}
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i := range sic.Containers {
+		if sic.Containers[i].Name != ProxyContainerName {
+			continue
+		}
+		// dedupeEnv keeps the last declaration of a variable, i.e. these ones.
+		for _, name := range names {
+			sic.Containers[i].Env = append(sic.Containers[i].Env, corev1.EnvVar{Name: name, Value: merged[name]})
+		}
+	}
+}
+
+// applyProxyEnv appends to the env of the proxy the variables of the proxyEnv annotation. It runs
+// after the other settings of the env, so that the annotation wins over all of them.
+func applyProxyEnv(sic *SidecarInjectionSpec, annotations map[string]string) {
+	value, ok := annotations[proxyEnvAnnotation]
+	if !ok {
+		return
+	}
+	// The annotation has been validated already.
+	env, _ := parseProxyEnv(value)
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i := range sic.Containers {
+		if sic.Containers[i].Name != ProxyContainerName {
+			continue
+		}
+		// dedupeEnv keeps the last declaration of a variable, i.e. these ones.
+		for _, name := range names {
+			sic.Containers[i].Env = append(sic.Containers[i].Env, corev1.EnvVar{Name: name, Value: env[name]})
+			sic.traceMerge(ProxyMergeLayerAnnotations, "env."+name, env[name])
+		}
+	}
+}
+
+// applyExtraProxyArgs appends to the arguments of the proxy the ones of the proxyArgs annotation,
+// or else the ExtraProxyArgs of the values. The flags of the pilot agent keep their last value, so
+// these win over the ones of the template.
+func applyExtraProxyArgs(sic *SidecarInjectionSpec, annotations map[string]string) {
+	args, layer := sic.ExtraProxyArgs, ProxyMergeLayerValues
+	if value, ok := annotations[proxyArgsAnnotation]; ok {
+		// The annotation has been validated already.
+		args, _ = parseProxyArgs(value)
+		layer = ProxyMergeLayerAnnotations
+	}
+	if len(args) == 0 {
+		return
+	}
+	for i := range sic.Containers {
+		if sic.Containers[i].Name == ProxyContainerName {
+			sic.Containers[i].Args = append(sic.Containers[i].Args, args...)
+			sic.traceMerge(layer, "extraArgs", strings.Join(args, " "))
+		}
+	}
+}
+
+// trustDomainEnv is read by the SDS agent of the proxy for the trust domain of its identity.
+const trustDomainEnv = "TRUST_DOMAIN"
+
+// applyTrustDomain sets the trust domain of the mesh, or the one of the trustDomain annotation,
+// in both the arguments and the env of the proxy so that its SPIFFE identity is consistent. The
+// template is left as is when neither is set.
+func applyTrustDomain(sic *SidecarInjectionSpec, meshTrustDomain string, annotations map[string]string) {
+	trustDomain := meshTrustDomain
+	if value, ok := annotations[trustDomainAnnotation]; ok {
+		trustDomain = value
+		sic.traceMerge(ProxyMergeLayerAnnotations, "trustDomain", value)
+	}
+	if trustDomain == "" {
+		return
+	}
+	arg := "--trust-domain=" + trustDomain
+	for i := range sic.Containers {
+		c := &sic.Containers[i]
+		if c.Name != ProxyContainerName {
+			continue
+		}
+		replaced := false
+		for j := range c.Args {
+			if strings.HasPrefix(c.Args[j], "--trust-domain=") {
+				c.Args[j] = arg
+				replaced = true
+			}
+		}
+		if !replaced {
+			c.Args = append(c.Args, arg)
+		}
+		// dedupeEnv keeps the last declaration of a variable, i.e. this one.
+		c.Env = append(c.Env, corev1.EnvVar{Name: trustDomainEnv, Value: trustDomain})
+	}
+}
+
+// applyProxyResourceAnnotations sets the resource requests and limits of the proxy from the
+// proxyCPU, proxyMemory, proxyCPULimit and proxyMemoryLimit annotations of the pod. The values
+// were validated with the other annotations.
+func applyProxyResourceAnnotations(sic *SidecarInjectionSpec, annotations map[string]string) {
+	overrides := []struct {
+		annotation string
+		limit      bool
+		name       corev1.ResourceName
+	}{
+		{annotation.SidecarProxyCPU.Name, false, corev1.ResourceCPU},
+		{annotation.SidecarProxyMemory.Name, false, corev1.ResourceMemory},
+		{sidecarProxyCPULimitAnnotation, true, corev1.ResourceCPU},
+		{sidecarProxyMemoryLimitAnnotation, true, corev1.ResourceMemory},
+	}
+	for i := range sic.Containers {
+		if sic.Containers[i].Name != ProxyContainerName {
+			continue
+		}
+		resources := &sic.Containers[i].Resources
+		for _, o := range overrides {
+			value, ok := annotations[o.annotation]
+			if !ok {
+				continue
+			}
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil {
+				continue
+			}
+			list, setting := &resources.Requests, "resources.requests."+string(o.name)
+			if o.limit {
+				list, setting = &resources.Limits, "resources.limits."+string(o.name)
+			}
+			if *list == nil {
+				*list = corev1.ResourceList{}
+			}
+			if template, ok := (*list)[o.name]; ok {
+				sic.traceMerge(ProxyMergeLayerTemplate, setting, template.String())
+			}
+			(*list)[o.name] = quantity
+			sic.traceMerge(ProxyMergeLayerAnnotations, setting, value)
+		}
+	}
+}
+
+// coupleProxyLimitsToRequests drops the limits of a proxy that has no requests. Kubernetes would
+// otherwise default the requests to the limits, which changes the QoS class of the pod.
+func coupleProxyLimitsToRequests(sic *SidecarInjectionSpec, warnings *injectionWarnings) {
+	if !sic.CoupleProxyLimitsToRequests {
+		return
+	}
+	for i := range sic.Containers {
+		resources := &sic.Containers[i].Resources
+		if sic.Containers[i].Name != ProxyContainerName || len(resources.Limits) == 0 || len(resources.Requests) > 0 {
+			continue
+		}
+		warnings.warnf("the %s container sets resource limits without requests, its limits are not applied", ProxyContainerName)
+		resources.Limits = nil
+	}
+}
+
+// inheritProxyResources gives the traffic redirection init container the resources of the proxy.
+func inheritProxyResources(sic *SidecarInjectionSpec) {
+	if !sic.InitInheritProxyResources {
+		return
+	}
+	proxy := FindSidecar(sic.Containers)
+	if proxy == nil {
+		return
+	}
+	for i := range sic.InitContainers {
+		if name := sic.InitContainers[i].Name; name == "istio-init" || name == "istio-validation" {
+			sic.InitContainers[i].Resources = *proxy.Resources.DeepCopy()
+		}
+	}
+}
+
+// applyProxyVolumeSizeLimit gives the injected emptyDir volumes the size limit of the injection,
+// unless they declare one.
+func applyProxyVolumeSizeLimit(sic *SidecarInjectionSpec) error {
+	if sic.ProxyVolumeSizeLimit == "" {
+		return nil
+	}
+	limit, err := resource.ParseQuantity(sic.ProxyVolumeSizeLimit)
+	if err != nil {
+		return fmt.Errorf("invalid proxyVolumeSizeLimit %q: %v", sic.ProxyVolumeSizeLimit, err)
+	}
+	for i := range sic.Volumes {
+		if emptyDir := sic.Volumes[i].EmptyDir; emptyDir != nil && emptyDir.SizeLimit == nil {
+			l := limit.DeepCopy()
+			emptyDir.SizeLimit = &l
+		}
+	}
+	return nil
+}
+
+// sortAppendedEnv sorts by name the variables appended by the injection to the env rendered
+// from the template, so that the output does not depend on the order the settings are applied
+// in. The sort is stable: of two declarations of a variable, the later one still wins.
+func sortAppendedEnv(env []corev1.EnvVar) {
+	sort.SliceStable(env, func(i, j int) bool {
+		return env[i].Name < env[j].Name
+	})
+}
+
+// dedupeEnv removes repeated declarations of the same variable from the env of an injected
+// container. The kubelet resolves duplicates to the last declaration, so that one is kept, at
+// the position of the first. Variables of other names reading the same downward API source are
+// handled by referenceDownwardAPIEnv.
+func dedupeEnv(env []corev1.EnvVar) []corev1.EnvVar {
+	last := make(map[string]corev1.EnvVar, len(env))
+	for _, e := range env {
+		last[e.Name] = e
+	}
+	if len(last) == len(env) {
+		return env
+	}
+	out := make([]corev1.EnvVar, 0, len(last))
+	for _, e := range env {
+		if v, ok := last[e.Name]; ok {
+			out = append(out, v)
+			delete(last, e.Name)
+		}
+	}
+	return out
+}
+
+// referenceDownwardAPIEnv replaces the variables of the env of the container that read the same
+// downward API field or resource as an earlier variable with a $(VAR) reference to it. The
+// variables are kept, as the proxy reads them by name.
+func referenceDownwardAPIEnv(container string, env []corev1.EnvVar) {
+	for i := range env {
+		if env[i].ValueFrom == nil {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if env[j].ValueFrom != nil && sameDownwardAPISource(container, env[j].ValueFrom, env[i].ValueFrom) {
+				env[i] = corev1.EnvVar{Name: env[i].Name, Value: "$(" + env[j].Name + ")"}
+				break
+			}
+		}
+	}
+}
+
+// sameDownwardAPISource returns whether a and b, declared in the env of container, read the same
+// field of the pod or the same resource of a container.
+func sameDownwardAPISource(container string, a, b *corev1.EnvVarSource) bool {
+	switch {
+	case a.FieldRef != nil && b.FieldRef != nil:
+		return fieldRefAPIVersion(a.FieldRef) == fieldRefAPIVersion(b.FieldRef) && a.FieldRef.FieldPath == b.FieldRef.FieldPath
+	case a.ResourceFieldRef != nil && b.ResourceFieldRef != nil:
+		ra, rb := a.ResourceFieldRef, b.ResourceFieldRef
+		return resourceFieldRefContainer(container, ra) == resourceFieldRefContainer(container, rb) &&
+			ra.Resource == rb.Resource && resourceFieldRefDivisor(ra).Cmp(resourceFieldRefDivisor(rb)) == 0
+	}
+	return false
+}
+
+// fieldRefAPIVersion returns the API version of ref, which defaults to v1.
+func fieldRefAPIVersion(ref *corev1.ObjectFieldSelector) string {
+	if ref.APIVersion == "" {
+		return "v1"
+	}
+	return ref.APIVersion
+}
+
+// resourceFieldRefContainer returns the container whose resource ref reads, which defaults to
+// the container declaring it.
+func resourceFieldRefContainer(container string, ref *corev1.ResourceFieldSelector) string {
+	if ref.ContainerName == "" {
+		return container
+	}
+	return ref.ContainerName
+}
+
+// resourceFieldRefDivisor returns the divisor of ref, which defaults to 1.
+func resourceFieldRefDivisor(ref *corev1.ResourceFieldSelector) resource.Quantity {
+	if ref.Divisor.IsZero() {
+		return resource.MustParse("1")
+	}
+	return ref.Divisor
 }
 
+// getPortsForContainer returns the ports of the container whose inbound traffic is redirected to
+// the proxy. Envoy cannot transparently proxy UDP nor SCTP, so only TCP ports are returned; a port
+// with no protocol is TCP.
 func getPortsForContainer(container corev1.Container) []string {
 	parts := make([]string, 0)
 	for _, p := range container.Ports {
-		if p.Protocol == corev1.ProtocolUDP || p.Protocol == corev1.ProtocolSCTP {
-			continue
+		switch p.Protocol {
+		case corev1.ProtocolTCP, "":
+			parts = append(parts, strconv.Itoa(int(p.ContainerPort)))
+		case corev1.ProtocolUDP, corev1.ProtocolSCTP:
+			log.Debugf("Skipping inbound redirection of port %d/%s of container %q", p.ContainerPort, p.Protocol, container.Name)
+		default:
+			log.Warnf("Skipping inbound redirection of port %d of container %q, unknown protocol %q",
+				p.ContainerPort, container.Name, p.Protocol)
 		}
-		parts = append(parts, strconv.Itoa(int(p.ContainerPort)))
 	}
 	return parts
 }
 
+// getContainerPorts returns the ports of the given containers, each port listed once even when
+// it is declared by several containers.
 func getContainerPorts(containers []corev1.Container, shouldIncludePorts func(corev1.Container) bool) string {
 	parts := make([]string, 0)
+	seen := make(map[string]bool)
 	for _, c := range containers {
 		if shouldIncludePorts(c) {
-			parts = append(parts, getPortsForContainer(c)...)
+			for _, port := range getPortsForContainer(c) {
+				if !seen[port] {
+					seen[port] = true
+					parts = append(parts, port)
+				}
+			}
 		}
 	}
 
 	return strings.Join(parts, ",")
 }
 
+// warnPortConflicts warns about ports declared by more than one container of the pod. The
+// containers share the network namespace of the pod, so only one of them can bind the port.
+func warnPortConflicts(metadata *metav1.ObjectMeta, containers []corev1.Container, warnings *injectionWarnings) {
+	owners := make(map[corev1.ContainerPort]string)
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			key := corev1.ContainerPort{ContainerPort: p.ContainerPort, Protocol: p.Protocol}
+			if key.Protocol == "" {
+				key.Protocol = corev1.ProtocolTCP
+			}
+			if owner, ok := owners[key]; ok && owner != c.Name {
+				warnings.warnf("%q: containers %q and %q both declare port %d/%s",
+					metadata.Namespace+"/"+potentialPodName(metadata), owner, c.Name, key.ContainerPort, key.Protocol)
+				continue
+			}
+			owners[key] = c.Name
+		}
+	}
+}
+
+// warnAppPreStop warns about application containers having a preStop hook when the proxy has
+// none. The kubelet terminates all containers of the pod at once: the proxy starts draining on
+// SIGTERM while the hooks still run, and may stop forwarding their traffic before they complete.
+func warnAppPreStop(metadata *metav1.ObjectMeta, containers []corev1.Container, sidecar *corev1.Container,
+	warnings *injectionWarnings) {
+	if sidecar != nil && sidecar.Lifecycle != nil && sidecar.Lifecycle.PreStop != nil {
+		return
+	}
+	for _, c := range containers {
+		if c.Name == ProxyContainerName || c.Lifecycle == nil || c.Lifecycle.PreStop == nil {
+			continue
+		}
+		warnings.warnf("%q: container %q has a preStop hook, which runs concurrently with the drain of the proxy",
+			metadata.Namespace+"/"+potentialPodName(metadata), c.Name)
+	}
+}
+
+// applicationPreStopPorts returns the TCP ports of the application containers, separated by
+// spaces, when one of them has a preStop hook. The preStop hook of the proxy waits for them.
+func applicationPreStopPorts(containers []corev1.Container) string {
+	for _, c := range containers {
+		if c.Name != ProxyContainerName && c.Lifecycle != nil && c.Lifecycle.PreStop != nil {
+			return strings.Replace(applicationPorts(containers), ",", " ", -1)
+		}
+	}
+	return ""
+}
+
 // this function is no longer used by the template but kept around for backwards compatibility
 func applicationPorts(containers []corev1.Container) string {
 	return getContainerPorts(containers, func(c corev1.Container) bool {
@@ -984,6 +3361,10 @@ func toYaml(value interface{}) string {
 	return string(y)
 }
 
+// getAnnotation returns the value of the annotation name, or defaultValue when the pod does not
+// set it. An annotation explicitly set to "" is returned as is: for the traffic annotations an
+// empty value clears the list, e.g. excludeInboundPorts: "" excludes no port besides the status
+// port, whatever the params say.
 func getAnnotation(meta metav1.ObjectMeta, name string, defaultValue interface{}) string {
 	value, ok := meta.Annotations[name]
 	if !ok {
@@ -1018,6 +3399,30 @@ func excludeInboundPort(port interface{}, excludedInboundPorts string) string {
 	return strings.Join(outPorts, ",")
 }
 
+// excludeNonTCPInboundPorts adds the UDP and SCTP ports of the containers to excludedInboundPorts
+// when all the inbound ports are redirected, so that they are left alone whatever the CNI plugin
+// does with the redirection of other protocols. Ports also declared for TCP stay redirected.
+func excludeNonTCPInboundPorts(includedInboundPorts string, containers []corev1.Container, excludedInboundPorts string) string {
+	if strings.TrimSpace(includedInboundPorts) != "*" {
+		return excludedInboundPorts
+	}
+	tcp := map[string]bool{}
+	for _, port := range splitPorts(includeInboundPorts(containers)) {
+		tcp[port] = true
+	}
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			if p.Protocol != corev1.ProtocolUDP && p.Protocol != corev1.ProtocolSCTP {
+				continue
+			}
+			if port := strconv.Itoa(int(p.ContainerPort)); !tcp[port] {
+				excludedInboundPorts = excludeInboundPort(port, excludedInboundPorts)
+			}
+		}
+	}
+	return excludedInboundPorts
+}
+
 func valueOrDefault(value interface{}, defaultValue interface{}) interface{} {
 	if value == "" || value == nil {
 		return defaultValue
@@ -1029,11 +3434,240 @@ func valueOrDefault(value interface{}, defaultValue interface{}) interface{} {
 // injected sidecar. This includes the names of added containers and
 // volumes.
 type SidecarInjectionStatus struct {
-	Version          string   `json:"version"`
-	InitContainers   []string `json:"initContainers"`
-	Containers       []string `json:"containers"`
-	Volumes          []string `json:"volumes"`
-	ImagePullSecrets []string `json:"imagePullSecrets"`
+	Version          string        `json:"version"`
+	InitContainers   []string      `json:"initContainers"`
+	Containers       []string      `json:"containers"`
+	Volumes          []string      `json:"volumes"`
+	ImagePullSecrets []string      `json:"imagePullSecrets"`
+	Mode             InjectionMode `json:"mode,omitempty"`
+	// RedirectAnnotations are the redirect annotations the pod declared, with their declared
+	// value. kube-inject overwrites them with their effective value.
+	RedirectAnnotations map[string]string `json:"redirectAnnotations,omitempty"`
+	// Tolerations and ReadinessGates are the ones added to the pod, by condition type for
+	// the readiness gates.
+	Tolerations    []corev1.Toleration `json:"tolerations,omitempty"`
+	ReadinessGates []string            `json:"readinessGates,omitempty"`
+	// ServiceLinksDisabled, CNINodeAffinity and SafeToEvict record whether the injection disabled
+	// the service links of the pod, required nodes running istio-cni and added the safe-to-evict
+	// annotation.
+	ServiceLinksDisabled bool `json:"serviceLinksDisabled,omitempty"`
+	CNINodeAffinity      bool `json:"cniNodeAffinity,omitempty"`
+	SafeToEvict          bool `json:"safeToEvict,omitempty"`
+}
+
+// InjectionMode records which parts of the sidecar were injected into a pod.
+type InjectionMode string
+
+const (
+	// InjectionModeFull means that both the proxy and its init containers were injected.
+	// It is recorded as an empty mode to keep the status annotation backwards compatible.
+	InjectionModeFull InjectionMode = ""
+
+	// InjectionModeInitOnly means that only init containers were injected, without a proxy.
+	InjectionModeInitOnly InjectionMode = "InitOnly"
+
+	// InjectionModeProxyOnly means that the proxy was injected without init containers,
+	// e.g. when traffic interception is disabled for the pod.
+	InjectionModeProxyOnly InjectionMode = "ProxyOnly"
+)
+
+// injectionModeFor returns the injection mode matching what the given spec injects.
+func injectionModeFor(sic *SidecarInjectionSpec) InjectionMode {
+	hasProxy := FindSidecar(sic.Containers) != nil
+	switch {
+	case hasProxy && len(sic.InitContainers) == 0:
+		return InjectionModeProxyOnly
+	case !hasProxy && len(sic.InitContainers) != 0:
+		return InjectionModeInitOnly
+	default:
+		return InjectionModeFull
+	}
+}
+
+// injectionModeChanged reports whether injecting the pod of metadata and podSpec again, once the
+// sidecar recorded in prev is removed, would record another mode than prev, e.g. because the
+// values no longer disable the init containers.
+func injectionModeChanged(sidecarTemplate, valuesConfig string, typeMeta *metav1.TypeMeta, deploymentMetadata,
+	metadata *metav1.ObjectMeta, podSpec *corev1.PodSpec, meshConfig *meshconfig.MeshConfig, prev *SidecarInjectionStatus) (bool, error) {
+	metadata, podSpec = metadata.DeepCopy(), podSpec.DeepCopy()
+	uninjectPod(metadata, podSpec, prev)
+	spec, _, err := injectionData(sidecarTemplate, valuesConfig, prev.Version, typeMeta, deploymentMetadata, podSpec,
+		metadata, meshConfig.DefaultConfig, meshConfig, nil)
+	if err != nil {
+		return false, err
+	}
+	return injectionModeFor(spec) != prev.Mode, nil
+}
+
+// parseInjectionStatus returns the injection status recorded in the given pod annotations,
+// or nil if the pod carries no valid status annotation.
+func parseInjectionStatus(annotations map[string]string) *SidecarInjectionStatus {
+	value, ok := annotations[annotation.SidecarStatus.Name]
+	if !ok {
+		return nil
+	}
+	var iStatus SidecarInjectionStatus
+	if err := json.Unmarshal([]byte(value), &iStatus); err != nil {
+		return nil
+	}
+	// heuristic assumes status is valid if any of the resource
+	// lists is non-empty.
+	if len(iStatus.InitContainers) == 0 &&
+		len(iStatus.Containers) == 0 &&
+		len(iStatus.Volumes) == 0 &&
+		len(iStatus.ImagePullSecrets) == 0 {
+		return nil
+	}
+	return &iStatus
+}
+
+// hasLegacyInjectionStatus reports whether the pod annotations carry a status annotation
+// that parseInjectionStatus does not understand, e.g. one written by a much older version.
+func hasLegacyInjectionStatus(annotations map[string]string) bool {
+	_, ok := annotations[annotation.SidecarStatus.Name]
+	return ok && parseInjectionStatus(annotations) == nil
+}
+
+// ContainerRole describes how the injection treated a container of a pod.
+type ContainerRole string
+
+const (
+	// ContainerRoleApp is the role of the main application container, the first container that was
+	// not injected. It is the one whose entrypoint is wrapped to wait for the sidecar.
+	ContainerRoleApp ContainerRole = "App"
+
+	// ContainerRoleProxy is the role of the injected proxy container.
+	ContainerRoleProxy ContainerRole = "Proxy"
+
+	// ContainerRoleInjected is the role of the other injected containers, e.g. istio-init.
+	ContainerRoleInjected ContainerRole = "Injected"
+
+	// ContainerRoleUntouched is the role of the containers of the pod that were left as is.
+	ContainerRoleUntouched ContainerRole = "Untouched"
+)
+
+// ContainerInjection is the injection decision taken for a single container of a pod.
+type ContainerInjection struct {
+	Name string        `json:"name"`
+	Init bool          `json:"init,omitempty"`
+	Role ContainerRole `json:"role"`
+}
+
+// ContainerInjections classifies the containers of an injected pod from its status annotation, init
+// containers first. It returns nil if the pod has not been injected.
+func ContainerInjections(metadata *metav1.ObjectMeta, podSpec *corev1.PodSpec) []ContainerInjection {
+	status := parseInjectionStatus(metadata.GetAnnotations())
+	if status == nil {
+		return nil
+	}
+	injected := make(map[string]bool)
+	for _, name := range status.InitContainers {
+		injected[name] = true
+	}
+	for _, name := range status.Containers {
+		injected[name] = true
+	}
+
+	out := make([]ContainerInjection, 0, len(podSpec.InitContainers)+len(podSpec.Containers))
+	for _, c := range podSpec.InitContainers {
+		role := ContainerRoleUntouched
+		if injected[c.Name] {
+			role = ContainerRoleInjected
+		}
+		out = append(out, ContainerInjection{Name: c.Name, Init: true, Role: role})
+	}
+	hasApp := false
+	for _, c := range podSpec.Containers {
+		var role ContainerRole
+		switch {
+		case injected[c.Name] && c.Name == ProxyContainerName:
+			role = ContainerRoleProxy
+		case injected[c.Name]:
+			role = ContainerRoleInjected
+		case !hasApp:
+			role = ContainerRoleApp
+			hasApp = true
+		default:
+			role = ContainerRoleUntouched
+		}
+		out = append(out, ContainerInjection{Name: c.Name, Role: role})
+	}
+	return out
+}
+
+// hasLegacyInjectedResources reports whether the pod spec holds any of the containers or
+// volumes that were injected, under hardcoded names, before SidecarInjectionStatus existed.
+func hasLegacyInjectedResources(podSpec *corev1.PodSpec) bool {
+	for _, c := range podSpec.InitContainers {
+		if containsString(legacyInitContainerNames, c.Name) {
+			return true
+		}
+	}
+	for _, c := range podSpec.Containers {
+		if containsString(legacyContainerNames, c.Name) {
+			return true
+		}
+	}
+	for _, v := range podSpec.Volumes {
+		if containsString(legacyVolumeNames, v.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeLegacyInjectedResources removes the resources found by hasLegacyInjectedResources.
+func removeLegacyInjectedResources(podSpec *corev1.PodSpec) {
+	initContainers := podSpec.InitContainers[:0]
+	for _, c := range podSpec.InitContainers {
+		if !containsString(legacyInitContainerNames, c.Name) {
+			initContainers = append(initContainers, c)
+		}
+	}
+	podSpec.InitContainers = initContainers
+
+	containers := podSpec.Containers[:0]
+	for _, c := range podSpec.Containers {
+		if !containsString(legacyContainerNames, c.Name) {
+			containers = append(containers, c)
+		}
+	}
+	podSpec.Containers = containers
+
+	volumes := podSpec.Volumes[:0]
+	for _, v := range podSpec.Volumes {
+		if !containsString(legacyVolumeNames, v.Name) {
+			volumes = append(volumes, v)
+		}
+	}
+	podSpec.Volumes = volumes
+}
+
+// templateCompatibilityVersionRegexp matches the marker {{- /* compatibilityVersion: "1" */ -}}.
+var templateCompatibilityVersionRegexp = regexp.MustCompile(`\{\{-?\s*/\*\s*compatibilityVersion:\s*"?([^"\s*]+)"?\s*\*/\s*-?\}\}`)
+
+// ValidateTemplate checks that sidecarTemplate and valuesConfig are compatible: when both carry a
+// compatibility version marker, the versions must be the same. A template or values config
+// without marker, e.g. a custom one, is not checked.
+func ValidateTemplate(sidecarTemplate, valuesConfig string) error {
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(valuesConfig), &values); err != nil {
+		return multierror.Prefix(err, "could not parse configuration values:")
+	}
+	return validateTemplateCompatibility(sidecarTemplate, values)
+}
+
+func validateTemplateCompatibility(sidecarTemplate string, values map[string]interface{}) error {
+	match := templateCompatibilityVersionRegexp.FindStringSubmatch(sidecarTemplate)
+	valuesVersion := lookupValue(values, "global", "sidecarTemplateCompatibilityVersion")
+	if match == nil || valuesVersion == "" {
+		return nil
+	}
+	if match[1] != valuesVersion {
+		return fmt.Errorf("sidecar template compatibility version %q does not match the version %q of the values config, "+
+			"the template and the values likely come from different Istio releases", match[1], valuesVersion)
+	}
+	return nil
 }
 
 // helper function to generate a template version identifier from a
@@ -16,21 +16,34 @@ package inject
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/ghodss/yaml"
 	"github.com/gogo/protobuf/types"
+	"github.com/google/uuid"
 
+	"istio.io/api/annotation"
 	meshapi "istio.io/api/mesh/v1alpha1"
 
 	"istio.io/istio/pilot/test/util"
 	"istio.io/istio/pkg/config/mesh"
 
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/strvals"
 )
 
 const (
@@ -50,21 +63,6 @@ var (
 	statusPattern = regexp.MustCompile("sidecar.istio.io/status: '{\"version\":\"([0-9a-f]+)\",")
 )
 
-// InitImageName returns the fully qualified image name for the istio
-// init image given a docker hub and tag and debug flag
-// This is used for testing only
-func InitImageName(hub string, tag string) string {
-	return hub + "/proxy_init:" + tag
-}
-
-// ProxyImageName returns the fully qualified image name for the istio
-// proxy image given a docker hub and tag and whether to use debug or not.
-// This is used for testing
-func ProxyImageName(hub string, tag string) string {
-	// Allow overriding the proxy image.
-	return hub + "/proxyv2:" + tag
-}
-
 func TestImageName(t *testing.T) {
 	want := "docker.io/istio/proxy_init:latest"
 	if got := InitImageName("docker.io/istio", "latest"); got != want {
@@ -76,28 +74,97 @@ func TestImageName(t *testing.T) {
 	}
 }
 
-func TestIntoResourceFile(t *testing.T) {
+func TestParamsHubTag(t *testing.T) {
 	cases := []struct {
-		in                           string
-		want                         string
-		imagePullPolicy              string
-		duration                     time.Duration
-		includeIPRanges              string
-		excludeIPRanges              string
-		includeInboundPorts          string
-		excludeInboundPorts          string
-		kubevirtInterfaces           string
-		statusPort                   int
-		readinessInitialDelaySeconds uint32
-		readinessPeriodSeconds       uint32
-		readinessFailureThreshold    uint32
-		enableAuth                   bool
-		enableCoreDump               bool
-		privileged                   bool
-		tproxy                       bool
-		podDNSSearchNamespaces       []string
-		enableCni                    bool
+		name      string
+		params    Params
+		wantProxy string
+		wantInit  string
 	}{
+		{
+			name:      "derived from hub and tag",
+			params:    Params{Hub: "gcr.io/istio-testing", Tag: "1.5.0"},
+			wantProxy: "gcr.io/istio-testing/proxyv2:1.5.0",
+			wantInit:  "gcr.io/istio-testing/proxy_init:1.5.0",
+		},
+		{
+			name: "full images win",
+			params: Params{
+				Hub:        "gcr.io/istio-testing",
+				Tag:        "1.5.0",
+				ProxyImage: "docker.io/custom/proxy:debug",
+				InitImage:  "docker.io/custom/init:debug",
+			},
+			wantProxy: "docker.io/custom/proxy:debug",
+			wantInit:  "docker.io/custom/init:debug",
+		},
+		{
+			name:   "hub without tag",
+			params: Params{Hub: "gcr.io/istio-testing"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vals := c.params.intoHelmValues()
+			if got := vals["global.proxy.image"]; got != c.wantProxy {
+				t.Errorf("got proxy image %q, want %q", got, c.wantProxy)
+			}
+			if got := vals["global.proxy_init.image"]; got != c.wantInit {
+				t.Errorf("got init image %q, want %q", got, c.wantInit)
+			}
+		})
+	}
+}
+
+// intoResourceFileCase is a case of TestIntoResourceFile.
+type intoResourceFileCase struct {
+	in                           string
+	want                         string
+	imagePullPolicy              string
+	duration                     time.Duration
+	includeIPRanges              string
+	excludeIPRanges              string
+	includeInboundPorts          string
+	excludeInboundPorts          string
+	kubevirtInterfaces           string
+	statusPort                   int
+	readinessInitialDelaySeconds uint32
+	readinessPeriodSeconds       uint32
+	readinessFailureThreshold    uint32
+	enableAuth                   bool
+	enableCoreDump               bool
+	privileged                   bool
+	tproxy                       bool
+	podDNSSearchNamespaces       []string
+	enableCni                    bool
+	proxyResources               string
+	setParams                    func(p *Params)
+}
+
+// defaultCase returns a case injecting in with the default params, which setParams adjusts
+// when it is not nil, and comparing the output with the want golden file.
+func defaultCase(in, want string, setParams func(p *Params)) intoResourceFileCase {
+	return intoResourceFileCase{
+		in:                           in,
+		want:                         want,
+		includeIPRanges:              DefaultIncludeIPRanges,
+		includeInboundPorts:          DefaultIncludeInboundPorts,
+		statusPort:                   DefaultStatusPort,
+		readinessInitialDelaySeconds: DefaultReadinessInitialDelaySeconds,
+		readinessPeriodSeconds:       DefaultReadinessPeriodSeconds,
+		readinessFailureThreshold:    DefaultReadinessFailureThreshold,
+		setParams:                    setParams,
+	}
+}
+
+// withProxyResources returns c with the proxy resources of the values set to the YAML resources.
+func (c intoResourceFileCase) withProxyResources(resources string) intoResourceFileCase {
+	c.proxyResources = resources
+	return c
+}
+
+func TestIntoResourceFile(t *testing.T) {
+	cases := []intoResourceFileCase{
 		//"testdata/hello.yaml" is tested in http_test.go (with debug)
 		{
 			in:                           "hello.yaml",
@@ -121,6 +188,11 @@ func TestIntoResourceFile(t *testing.T) {
 			readinessFailureThreshold:    DefaultReadinessFailureThreshold,
 			enableCni:                    true,
 		},
+		// Verifies that CNI mode pods require the nodes running the CNI plugin.
+		defaultCase("hello.yaml", "hello-cni-node-affinity.yaml.injected", func(p *Params) {
+			p.EnableCni = true
+			p.RequireCNINodeAffinity = true
+		}),
 		//verifies that the sidecar will not be injected again for an injected yaml
 		{
 			in:                           "hello.yaml.injected",
@@ -384,6 +456,8 @@ func TestIntoResourceFile(t *testing.T) {
 			readinessPeriodSeconds:       DefaultReadinessPeriodSeconds,
 			readinessFailureThreshold:    DefaultReadinessFailureThreshold,
 		},
+		// Verifies that pods selecting Windows nodes are left unchanged.
+		defaultCase("hello-windows.yaml", "hello-windows.yaml.injected", nil),
 		{
 			in:                           "list.yaml",
 			want:                         "list.yaml.injected",
@@ -469,6 +543,14 @@ func TestIntoResourceFile(t *testing.T) {
 			readinessPeriodSeconds:       DefaultReadinessPeriodSeconds,
 			readinessFailureThreshold:    DefaultReadinessFailureThreshold,
 		},
+		// Verifies that the excludeOutboundPorts annotation overrides the param.
+		defaultCase("traffic-annotations.yaml", "traffic-annotations.yaml.injected", func(p *Params) {
+			p.ExcludeOutboundPorts = "5432"
+		}),
+		// Verifies that the excludeOutboundPorts param is passed to the init container.
+		defaultCase("hello.yaml", "hello-exclude-outbound-ports.yaml.injected", func(p *Params) {
+			p.ExcludeOutboundPorts = "5432"
+		}),
 		{
 			// Verifies that the wildcard character "*" behaves properly when used in annotations.
 			in:                           "traffic-annotations-wildcards.yaml",
@@ -491,6 +573,17 @@ func TestIntoResourceFile(t *testing.T) {
 			readinessPeriodSeconds:       DefaultReadinessPeriodSeconds,
 			readinessFailureThreshold:    DefaultReadinessFailureThreshold,
 		},
+		// Verifies that the excluded ranges of the params are carved out of the included ranges
+		// of an annotation, as each of them falls back to the params on its own.
+		defaultCase("hello-include-exclude-ranges.yaml", "hello-include-exclude-ranges.yaml.injected", func(p *Params) {
+			p.ExcludeIPRanges = "10.96.0.0/12"
+		}),
+		// Verifies that explicitly empty exclude annotations clear the excludes set by the params,
+		// rather than falling back to them as absent annotations do.
+		defaultCase("traffic-annotations-empty-excludes.yaml", "traffic-annotations-empty-excludes.yaml.injected", func(p *Params) {
+			p.ExcludeIPRanges = "10.96.0.2/24"
+			p.ExcludeInboundPorts = "4,5,6"
+		}),
 		{
 			// Verifies that pods can have multiple containers
 			in:                           "multi-container.yaml",
@@ -502,6 +595,8 @@ func TestIntoResourceFile(t *testing.T) {
 			readinessPeriodSeconds:       DefaultReadinessPeriodSeconds,
 			readinessFailureThreshold:    DefaultReadinessFailureThreshold,
 		},
+		// Verifies that a port declared by several containers is redirected once.
+		defaultCase("multi-container-shared-port.yaml", "multi-container-shared-port.yaml.injected", nil),
 		{
 			// Verifies that the status params behave properly.
 			in:                           "status_params.yaml",
@@ -549,6 +644,215 @@ func TestIntoResourceFile(t *testing.T) {
 			readinessPeriodSeconds:       DefaultReadinessPeriodSeconds,
 			readinessFailureThreshold:    DefaultReadinessFailureThreshold,
 		},
+		// Verifies that the idle timeout annotation is rendered into the proxy metadata.
+		defaultCase("hello-idle-timeout.yaml", "hello-idle-timeout.yaml.injected", nil),
+		// Verifies that the pod overhead declared by a RuntimeClass survives injection untouched.
+		defaultCase("hello-overhead.yaml", "hello-overhead.yaml.injected", nil),
+		// Verifies that sidecar.istio.io/disableAccessLog turns off the access log of the sidecar.
+		defaultCase("hello-disable-access-log.yaml", "hello-disable-access-log.yaml.injected", nil),
+		// Verifies that sidecar.istio.io/portProtocols is passed to the proxy as protocol hints.
+		defaultCase("hello-port-protocols.yaml", "hello-port-protocols.yaml.injected", nil),
+		// Verifies that a shared process namespace is preserved and reported to the proxy.
+		defaultCase("hello-share-process-namespace.yaml", "hello-share-process-namespace.yaml.injected", func(p *Params) {
+			p.ShareProcessNamespaceAware = true
+		}),
+		// Verifies that the CA bundle ConfigMap is mounted into the proxy.
+		defaultCase("hello.yaml", "hello-ca-bundle.yaml.injected", func(p *Params) {
+			p.ProxyCABundleConfigMap = "control-plane-ca"
+		}),
+		// Verifies that the sidecar variables reading the same downward API field as an
+		// earlier one reference it.
+		defaultCase("hello-downward-api-env.yaml", "hello-downward-api-env.yaml.injected", func(p *Params) {
+			p.DedupeDownwardAPIEnv = true
+		}),
+		// Verifies that the labels matched by the workload selector are left untouched.
+		defaultCase("hello-selector-labels.yaml", "hello-selector-labels.yaml.injected", nil),
+		// Verifies that the proxy tolerations are merged with the pod tolerations without duplicates.
+		defaultCase("hello-tolerations.yaml", "hello-tolerations.yaml.injected", func(p *Params) {
+			p.ProxyTolerations = []corev1.Toleration{
+				{Key: "istio.io/mesh", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+				{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "app", Effect: corev1.TaintEffectNoSchedule},
+			}
+		}),
+		// Verifies that security.istio.io/minTLSVersion is passed to the proxy.
+		defaultCase("hello-min-tls-version.yaml", "hello-min-tls-version.yaml.injected", nil),
+		// Verifies that images with the latest tag are always pulled when the pull policy is inferred.
+		defaultCase("hello.yaml", "hello-pull-policy-latest.yaml.injected", func(p *Params) {
+			p.InitImage = InitImageName(unitTestHub, "latest")
+			p.ProxyImage = ProxyImageName(unitTestHub, "latest")
+			p.InferPullPolicyFromTag = true
+		}),
+		// Verifies that images with a pinned tag are pulled if not present when the pull policy is inferred,
+		// overriding the explicit policy.
+		defaultCase("hello.yaml", "hello-pull-policy-pinned.yaml.injected", func(p *Params) {
+			p.ImagePullPolicy = "Always"
+			p.InitImage = InitImageName(unitTestHub, "1.5.0")
+			p.ProxyImage = ProxyImageName(unitTestHub, "1.5.0")
+			p.InferPullPolicyFromTag = true
+		}),
+		// Verifies that the injected containers get the pull policy of the pod containers when it is matched,
+		// overriding the explicit policy.
+		defaultCase("hello-pull-policy-pod.yaml", "hello-pull-policy-pod.yaml.injected", func(p *Params) {
+			p.MatchPodImagePullPolicy = true
+		}),
+		// Verifies that an injected volume is renamed when the pod already has a volume with its name.
+		defaultCase("hello-volume-collision.yaml", "hello-volume-collision.yaml.injected", nil),
+		// Verifies that sidecar.istio.io/discoveryAddress overrides the discovery address of the proxy.
+		defaultCase("hello-discovery-address.yaml", "hello-discovery-address.yaml.injected", nil),
+		// Verifies that the proxy gets a stdin and a TTY when it is interactive.
+		defaultCase("hello.yaml", "hello-proxy-interactive.yaml.injected", func(p *Params) {
+			p.ProxyInteractive = true
+		}),
+		// Verifies that the injected readiness gates are merged with the pod readiness gates without duplicates.
+		defaultCase("hello-readiness-gates.yaml", "hello-readiness-gates.yaml.injected", func(p *Params) {
+			p.ReadinessGates = []string{"www.example.com/feature-1", "istio.io/mesh-ready"}
+		}),
+		// Verifies that service links are disabled on pods that do not set enableServiceLinks.
+		defaultCase("hello.yaml", "hello-disable-service-links.yaml.injected", func(p *Params) {
+			p.DisableServiceLinks = true
+		}),
+		// Verifies that an explicit enableServiceLinks of the pod is kept.
+		defaultCase("hello-enable-service-links.yaml", "hello-enable-service-links.yaml.injected", func(p *Params) {
+			p.DisableServiceLinks = true
+		}),
+		// Verifies that the entrypoint of the application waits for the sidecar to be ready.
+		defaultCase("hello-entrypoint-wrapper.yaml", "hello-entrypoint-wrapper.yaml.injected", func(p *Params) {
+			p.AppEntrypointWrapper = true
+		}),
+		// Verifies that sidecar.istio.io/preserveAppEntrypoint keeps the entrypoint of the application.
+		defaultCase("hello-entrypoint-preserved.yaml", "hello-entrypoint-preserved.yaml.injected", func(p *Params) {
+			p.AppEntrypointWrapper = true
+		}),
+		// Verifies that the proxy gets the name of its node when the injection is topology aware.
+		defaultCase("hello.yaml", "hello-topology-aware.yaml.injected", func(p *Params) {
+			p.TopologyAware = true
+		}),
+		// Verifies that the first application container shares the telemetry UDS of the proxy.
+		defaultCase("hello.yaml", "hello-telemetry-uds.yaml.injected", func(p *Params) {
+			p.TelemetryUDSPath = "/var/run/istio-telemetry/telemetry.sock"
+			p.TelemetryUDSAppEnv = true
+		}),
+		// Verifies that the initial delay of the proxy readiness probe is raised to the floor.
+		defaultCase("hello.yaml", "hello-min-readiness-delay.yaml.injected", func(p *Params) {
+			p.MinReadinessInitialDelaySeconds = 10
+		}),
+		// Verifies that the proxy of a pod tolerating a spot node taint drains faster.
+		defaultCase("hello-spot-node.yaml", "hello-spot-node.yaml.injected", func(p *Params) {
+			p.SpotNodeAware = true
+		}),
+		// Verifies that the downward-API podIP env of the application is left as is and that
+		// the proxy declares its own INSTANCE_IP once, env vars being scoped to a container.
+		defaultCase("hello-pod-ip-env.yaml", "hello-pod-ip-env.yaml.injected", nil),
+		// Verifies that the preStop hook of the application is left as is.
+		defaultCase("hello-app-prestop.yaml", "hello-app-prestop.yaml.injected", nil),
+		// Verifies that the proxy gets a preStop hook waiting for the application ports
+		// to close, next to the preStop hook of the application.
+		defaultCase("hello-app-prestop.yaml", "hello-app-prestop-drain.yaml.injected", func(p *Params) {
+			p.DrainAfterApplication = true
+		}),
+		// Verifies that the trust domain of the mesh is set in the identity of the proxy.
+		defaultCase("hello.yaml", "hello-mesh-trust-domain.yaml.injected", func(p *Params) {
+			p.Mesh.TrustDomain = "example.org"
+		}),
+		// Verifies that the trustDomain annotation overrides the trust domain of the mesh.
+		defaultCase("hello-trust-domain.yaml", "hello-trust-domain.yaml.injected", func(p *Params) {
+			p.Mesh.TrustDomain = "example.org"
+		}),
+		// Verifies that the proxy resource annotations set both the requests and the limits.
+		defaultCase("hello-proxy-resources.yaml", "hello-proxy-resources.yaml.injected", nil),
+		// Verifies that node drain aware pods are marked safe to evict for the cluster autoscaler.
+		defaultCase("hello.yaml", "hello-node-drain-aware.yaml.injected", func(p *Params) {
+			p.NodeDrainAware = true
+		}),
+		// Verifies that the init container inherits the resources of the proxy.
+		defaultCase("hello.yaml", "hello-init-inherit-proxy-resources.yaml.injected", func(p *Params) {
+			p.InitInheritProxyResources = true
+		}),
+		// Verifies that explicit init resources take precedence over those of the proxy.
+		defaultCase("hello.yaml", "hello-init-resources.yaml.injected", func(p *Params) {
+			p.InitInheritProxyResources = true
+			p.InitResources = &corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("50m"),
+					corev1.ResourceMemory: resource.MustParse("64Mi"),
+				},
+			}
+		}),
+		// Verifies that IPv4 and IPv6 ranges are redirected together on dual-stack clusters.
+		defaultCase("hello.yaml", "hello-dual-stack.yaml.injected", func(p *Params) {
+			p.IncludeIPRanges = "10.0.0.0/8,fd00::/8"
+		}),
+		// Verifies that the injected emptyDir volumes get the proxy volume size limit.
+		defaultCase("hello.yaml", "hello-proxy-volume-size-limit.yaml.injected", func(p *Params) {
+			p.ProxyVolumeSizeLimit = "64Mi"
+		}),
+		// Verifies that the sidecar is started first, with a postStart hook waiting for its
+		// readiness, when the application is held until the proxy starts.
+		defaultCase("hello.yaml", "hello-hold-application.yaml.injected", func(p *Params) {
+			p.HoldApplicationUntilProxyStarts = true
+		}),
+		// Verifies that the image pull secrets are added to the ones of the pod, without
+		// repeating the ones it already declares.
+		defaultCase("hello-image-pull-secrets.yaml", "hello-image-pull-secrets.yaml.injected", func(p *Params) {
+			p.ImagePullSecrets = []string{"regcred", "istio-registry"}
+		}),
+		// Verifies that the pod template of listed Knative Services is injected, keeping the
+		// fields of the revision spec.
+		defaultCase("knative-service.yaml", "knative-service.yaml.injected", func(p *Params) {
+			p.CustomPodTemplates = knativeServiceTemplates
+		}),
+		// Verifies that documents without object are skipped, keeping their comments.
+		defaultCase("hello-empty-documents.yaml", "hello-empty-documents.yaml.injected", nil),
+		// Verifies that the status port is declared by name and probed through that name.
+		defaultCase("hello.yaml", "hello-status-port-name.yaml.injected", func(p *Params) {
+			p.StatusPortName = "status-port"
+		}),
+		// Verifies that the extra proxy args are appended to the ones of the template.
+		defaultCase("hello.yaml", "hello-proxy-args.yaml.injected", func(p *Params) {
+			p.ExtraProxyArgs = []string{"--concurrency", "2"}
+		}),
+		// Verifies that the proxyArgs annotation replaces the extra proxy args.
+		defaultCase("hello-proxy-args-annotation.yaml", "hello-proxy-args-annotation.yaml.injected", func(p *Params) {
+			p.ExtraProxyArgs = []string{"--concurrency", "2"}
+		}),
+		// Verifies that the seccomp profile of the init container is set through its annotation.
+		defaultCase("hello.yaml", "hello-init-seccomp.yaml.injected", func(p *Params) {
+			p.InitSeccompProfile = "RuntimeDefault"
+		}),
+		// Verifies that the seccomp profile of the init container has no effect in CNI mode,
+		// which does not inject it.
+		defaultCase("hello.yaml", "hello-init-seccomp.yaml.cni.injected", func(p *Params) {
+			p.EnableCni = true
+			p.InitSeccompProfile = "RuntimeDefault"
+		}),
+		// Verifies that the variables of the proxyEnv annotation are appended to the env of the
+		// proxy, sorted by name.
+		defaultCase("hello-proxy-env.yaml", "hello-proxy-env.yaml.injected", nil),
+		// Verifies that the proxySecurityContext annotation is merged onto the security context of
+		// the proxy, and that its seccompProfile selects the seccomp profile of the proxy.
+		defaultCase("hello-proxy-security-context.yaml", "hello-proxy-security-context.yaml.injected", nil),
+		// Verifies that the interception mode annotation overrides the TPROXY mesh default.
+		defaultCase("hello-interception-redirect.yaml", "hello-interception-redirect.yaml.injected", func(p *Params) {
+			p.Mesh.DefaultConfig.InterceptionMode = meshapi.ProxyConfig_TPROXY
+		}),
+		// Verifies that the interception mode annotation gives the proxy the capabilities
+		// TPROXY needs, without changing the mesh default.
+		defaultCase("hello-interception-tproxy.yaml", "hello-interception-tproxy.yaml.injected", nil),
+		// Verifies that the proxy is injected without its init container when the annotation
+		// disables the interception.
+		defaultCase("hello-interception-none.yaml", "hello-interception-none.yaml.injected", nil),
+		// Verifies that proxy requests without limits are kept when limits are coupled to requests.
+		defaultCase("hello.yaml", "hello-proxy-requests-only.yaml.injected", func(p *Params) {
+			p.CoupleProxyLimitsToRequests = true
+		}).withProxyResources("requests:\n  cpu: 100m\n  memory: 128Mi\n"),
+		// Verifies that proxy limits without requests are dropped when limits are coupled to requests.
+		defaultCase("hello.yaml", "hello-proxy-limits-only.yaml.injected", func(p *Params) {
+			p.CoupleProxyLimitsToRequests = true
+		}).withProxyResources("limits:\n  cpu: 2000m\n  memory: 1024Mi\n"),
+		// Verifies that proxy requests and limits are both kept when limits are coupled to requests.
+		defaultCase("hello.yaml", "hello.yaml.injected", func(p *Params) {
+			p.CoupleProxyLimitsToRequests = true
+		}),
 		{
 			// Verifies that global.podDNSSearchNamespaces are applied properly
 			in:                           "hello.yaml",
@@ -565,6 +869,10 @@ func TestIntoResourceFile(t *testing.T) {
 				"{{ valueOrDefault .DeploymentMeta.Namespace \"default\" }}.global",
 			},
 		},
+		// Verifies that the user volumes are added to the pod and mounted into the proxy
+		defaultCase("hello-user-volume.yaml", "hello-user-volume.yaml.injected", nil),
+		// Verifies that the user volume annotations are rendered with the pod metadata
+		defaultCase("hello-user-volume-template.yaml", "hello-user-volume-template.yaml.injected", nil),
 	}
 
 	for i, c := range cases {
@@ -609,8 +917,14 @@ func TestIntoResourceFile(t *testing.T) {
 			if c.imagePullPolicy != "" {
 				params.ImagePullPolicy = c.imagePullPolicy
 			}
+			if c.setParams != nil {
+				c.setParams(params)
+			}
 			sidecarTemplate := loadSidecarTemplate(t)
 			valuesConfig := getValues(params, t)
+			if c.proxyResources != "" {
+				valuesConfig = setProxyResources(valuesConfig, c.proxyResources, t)
+			}
 			inputFilePath := "testdata/inject/" + c.in
 			wantFilePath := "testdata/inject/" + c.want
 			in, err := os.Open(inputFilePath)
@@ -696,6 +1010,11 @@ func TestRewriteAppProbe(t *testing.T) {
 			rewriteAppHTTPProbe: true,
 			want:                "ready_live.yaml.injected",
 		},
+		{
+			in:                  "startup-probes.yaml",
+			rewriteAppHTTPProbe: true,
+			want:                "startup-probes.yaml.injected",
+		},
 		// TODO(incfly): add more test case covering different -statusPort=123, --statusPort=123
 		// No statusport, --statusPort 123.
 	}
@@ -742,183 +1061,2610 @@ func TestRewriteAppProbe(t *testing.T) {
 	}
 }
 
-func stripVersion(yaml []byte) []byte {
-	return statusPattern.ReplaceAllLiteral(yaml, []byte(statusReplacement))
-}
-
-func TestInvalidParams(t *testing.T) {
+func TestAlwaysEmitDocumentSeparator(t *testing.T) {
 	cases := []struct {
-		annotation    string
-		paramModifier func(p *Params)
+		in   string
+		docs int
 	}{
 		{
-			annotation: "includeipranges",
-			paramModifier: func(p *Params) {
-				p.IncludeIPRanges = "bad"
-			},
-		},
-		{
-			annotation: "excludeipranges",
-			paramModifier: func(p *Params) {
-				p.ExcludeIPRanges = "*"
-			},
-		},
-		{
-			annotation: "includeinboundports",
-			paramModifier: func(p *Params) {
-				p.IncludeInboundPorts = "bad"
-			},
+			in:   "hello.yaml",
+			docs: 1,
 		},
 		{
-			annotation: "excludeinboundports",
-			paramModifier: func(p *Params) {
-				p.ExcludeInboundPorts = "*"
-			},
+			in:   "hello-multi.yaml",
+			docs: 2,
 		},
 	}
 
 	for _, c := range cases {
-		t.Run(c.annotation, func(t *testing.T) {
+		t.Run(c.in, func(t *testing.T) {
 			params := newTestParams()
-			c.paramModifier(params)
+			params.AlwaysEmitDocumentSeparator = true
+			got, _, err := injectTestFile(c.in, params, t)
+			if err != nil {
+				t.Fatalf("IntoResourceFile(%v) returned an error: %v", c.in, err)
+			}
 
-			if err := params.Validate(); err == nil {
-				t.Fatalf("expected error")
-			} else if !strings.Contains(strings.ToLower(err.Error()), c.annotation) {
-				t.Fatalf("unexpected error: %v", err)
+			out := string(got)
+			if !strings.HasPrefix(out, "---\n") {
+				t.Fatalf("expected output to start with a document separator, got:\n%s", out)
+			}
+			if strings.HasSuffix(out, "---\n") {
+				t.Fatalf("expected no trailing document separator, got:\n%s", out)
+			}
+			docs := strings.Split(strings.TrimPrefix(out, "---\n"), "\n---\n")
+			if len(docs) != c.docs {
+				t.Fatalf("expected %d documents, got %d:\n%s", c.docs, len(docs), out)
+			}
+			for i, doc := range docs {
+				if !strings.Contains(doc, "kind: Deployment") {
+					t.Fatalf("document %d is not a deployment:\n%s", i, doc)
+				}
 			}
 		})
 	}
 }
 
-func TestInvalidAnnotations(t *testing.T) {
+func TestPreserveKeyOrder(t *testing.T) {
+	for _, hold := range []bool{false, true} {
+		t.Run(fmt.Sprintf("holdApplicationUntilProxyStarts=%v", hold), func(t *testing.T) {
+			params := newTestParams()
+			params.PreserveKeyOrder = true
+			// moves the proxy before the hello container
+			params.HoldApplicationUntilProxyStarts = hold
+			got, _, err := injectTestFile("hello.yaml", params, t)
+			if err != nil {
+				t.Fatalf("IntoResourceFile() returned an error: %v", err)
+			}
+
+			out := string(got)
+			// hello.yaml declares the name of its container before its image, which sorting reverses.
+			name := strings.Index(out, "- name: hello\n")
+			image := strings.Index(out, "image: fake.docker.io/google-samples/hello-go-gke:1.0\n")
+			if name < 0 || image < 0 || image < name {
+				t.Fatalf("the keys of the hello container are not in their input order:\n%s", out)
+			}
+			if !strings.Contains(out, "name: istio-proxy\n") {
+				t.Fatalf("the proxy is not injected:\n%s", out)
+			}
+			for _, noise := range []string{"creationTimestamp: null", "status: {}", "resources: {}"} {
+				if strings.Contains(out, noise) {
+					t.Errorf("the output has %q, which is not in the input:\n%s", noise, out)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepKeyOrder(t *testing.T) {
+	original := `spec:
+  volumes:
+  - name: data
+    hostPath:
+      path: /data
+  containers:
+  - name: app
+    image: app:1.0
+`
+	injected := `spec:
+  containers:
+  - image: proxyv2:1.0
+    name: istio-proxy
+    resources: {}
+  - image: app:1.0
+    name: app
+    resources: {}
+  volumes:
+  - emptyDir: {}
+    name: istio-envoy
+  - hostPath:
+      path: /data
+    name: data
+status: {}
+`
+	want := `spec:
+  volumes:
+  - emptyDir: {}
+    name: istio-envoy
+  - name: data
+    hostPath:
+      path: /data
+  containers:
+  - image: proxyv2:1.0
+    name: istio-proxy
+    resources: {}
+  - name: app
+    image: app:1.0
+`
+	got, err := keepKeyOrder([]byte(original), []byte(injected))
+	if err != nil {
+		t.Fatalf("keepKeyOrder() returned an error: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMaxContainersPerPod(t *testing.T) {
 	cases := []struct {
-		annotation string
-		in         string
+		name    string
+		max     int
+		wantErr bool
 	}{
 		{
-			annotation: "includeipranges",
-			in:         "traffic-annotations-bad-includeipranges.yaml",
+			name: "unlimited",
+			max:  0,
 		},
 		{
-			annotation: "excludeipranges",
-			in:         "traffic-annotations-bad-excludeipranges.yaml",
+			name: "within limit",
+			max:  2,
 		},
 		{
-			annotation: "includeinboundports",
-			in:         "traffic-annotations-bad-includeinboundports.yaml",
+			name:    "already at limit",
+			max:     1,
+			wantErr: true,
 		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := newTestParams()
+			params.MaxContainersPerPod = c.max
+			got, _, err := injectTestFile("hello.yaml", params, t)
+			if !c.wantErr {
+				if err != nil {
+					t.Fatalf("IntoResourceFile() returned an error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			if !strings.Contains(err.Error(), `"hello"`) || !strings.Contains(err.Error(), "maximum of 1") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != 0 {
+				t.Fatalf("expected no output, got:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestTuneProxyMemoryFromLimit(t *testing.T) {
+	cases := []struct {
+		name        string
+		memoryLimit string
+		want        string
+	}{
 		{
-			annotation: "excludeinboundports",
-			in:         "traffic-annotations-bad-excludeinboundports.yaml",
+			name:        "256Mi limit",
+			memoryLimit: "256Mi",
+			want:        "hello-memory-threshold.yaml.injected",
 		},
 		{
-			annotation: "excludeoutboundports",
-			in:         "traffic-annotations-bad-excludeoutboundports.yaml",
+			name:        "no memory limit",
+			memoryLimit: "null",
 		},
 	}
 
 	for _, c := range cases {
-		t.Run(c.annotation, func(t *testing.T) {
+		t.Run(c.name, func(t *testing.T) {
 			params := newTestParams()
-			sidecarTemplate := loadSidecarTemplate(t)
-			valuesConfig := getValues(params, t)
-			inputFilePath := "testdata/inject/" + c.in
-			in, err := os.Open(inputFilePath)
+			params.StatusPort = DefaultStatusPort
+			params.ReadinessInitialDelaySeconds = DefaultReadinessInitialDelaySeconds
+			params.ReadinessPeriodSeconds = DefaultReadinessPeriodSeconds
+			params.ReadinessFailureThreshold = DefaultReadinessFailureThreshold
+			params.TuneProxyMemoryFromLimit = true
+			values := chartutil.FromYaml(getValues(params, t))
+			if err := strvals.ParseInto("global.proxy.resources.limits.memory="+c.memoryLimit, values); err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := injectTestFileWithValues("hello.yaml", chartutil.ToYaml(values), params.Mesh, t)
 			if err != nil {
-				t.Fatalf("Failed to open %q: %v", inputFilePath, err)
+				t.Fatalf("IntoResourceFile() returned an error: %v", err)
 			}
-			defer func() { _ = in.Close() }()
-			var got bytes.Buffer
-			if err = IntoResourceFile(sidecarTemplate, valuesConfig, params.Mesh, in, &got); err == nil {
-				t.Fatalf("expected error")
-			} else if !strings.Contains(strings.ToLower(err.Error()), c.annotation) {
-				t.Fatalf("unexpected error: %v", err)
+
+			if c.want == "" {
+				if bytes.Contains(got, []byte("ISTIO_META_PROXY_MEMORY_THRESHOLD")) {
+					t.Fatalf("unexpected memory threshold for a proxy without memory limit:\n%s", got)
+				}
+				return
+			}
+			wantFilePath := "testdata/inject/" + c.want
+			gotBytes := stripVersion(got)
+			wantBytes := stripVersion(util.ReadGoldenFile(gotBytes, wantFilePath, t))
+			util.CompareBytes(gotBytes, wantBytes, wantFilePath, t)
+			if util.Refresh() {
+				util.RefreshGoldenFile(gotBytes, wantFilePath, t)
 			}
 		})
 	}
 }
 
-func TestSkipUDPPorts(t *testing.T) {
+func TestIntoResourceFileWithWarnings(t *testing.T) {
 	cases := []struct {
-		c     corev1.Container
-		ports []string
+		name                   string
+		in                     string
+		enableCni              bool
+		coupleLimitsToRequests bool
+		drainAfterApplication  bool
+		proxyResources         string
+		want                   []string
 	}{
 		{
-			c: corev1.Container{
-				Ports: []corev1.ContainerPort{},
-			},
+			name: "no warnings",
+			in:   "traffic-annotations.yaml",
 		},
 		{
-			c: corev1.Container{
-				Ports: []corev1.ContainerPort{
-					{
-						ContainerPort: 80,
-						Protocol:      corev1.ProtocolTCP,
-					},
-					{
-						ContainerPort: 8080,
-						Protocol:      corev1.ProtocolTCP,
-					},
-				},
+			name:      "traffic annotations with cni",
+			in:        "traffic-annotations.yaml",
+			enableCni: true,
+			want: []string{
+				"traffic.sidecar.istio.io/includeOutboundIPRanges",
+				"traffic.sidecar.istio.io/excludeOutboundIPRanges",
+				"traffic.sidecar.istio.io/includeInboundPorts",
+				"traffic.sidecar.istio.io/excludeInboundPorts",
+				"traffic.sidecar.istio.io/excludeOutboundPorts",
 			},
-			ports: []string{"80", "8080"},
 		},
 		{
-			c: corev1.Container{
-				Ports: []corev1.ContainerPort{
-					{
-						ContainerPort: 53,
-						Protocol:      corev1.ProtocolTCP,
-					},
-					{
-						ContainerPort: 53,
-						Protocol:      corev1.ProtocolUDP,
-					},
-				},
-			},
-			ports: []string{"53"},
+			name:                   "proxy limits without requests",
+			in:                     "hello.yaml",
+			coupleLimitsToRequests: true,
+			proxyResources:         "limits:\n  cpu: 2000m\n",
+			want:                   []string{"limits without requests"},
 		},
 		{
-			c: corev1.Container{
-				Ports: []corev1.ContainerPort{
-					{
-						ContainerPort: 80,
-						Protocol:      corev1.ProtocolTCP,
-					},
-					{
-						ContainerPort: 53,
-						Protocol:      corev1.ProtocolUDP,
-					},
-				},
-			},
-			ports: []string{"80"},
+			name: "app preStop hook",
+			in:   "hello-app-prestop.yaml",
+			want: []string{`container "hello" has a preStop hook`},
 		},
 		{
-			c: corev1.Container{
-				Ports: []corev1.ContainerPort{
-					{
-						ContainerPort: 53,
-						Protocol:      corev1.ProtocolUDP,
-					},
-				},
-			},
+			name: "unlisted Knative Service",
+			in:   "knative-service.yaml",
+			want: []string{`Knative Service "hello" is not injected`},
+		},
+		{
+			name:                  "app preStop hook with the proxy draining after it",
+			in:                    "hello-app-prestop.yaml",
+			drainAfterApplication: true,
 		},
 	}
-	for i := range cases {
-		expectPorts := cases[i].ports
-		ports := getPortsForContainer(cases[i].c)
-		if len(ports) != len(expectPorts) {
-			t.Fatalf("unexpect ports result for case %d", i)
-		}
-		for j := 0; j < len(ports); j++ {
-			if ports[j] != expectPorts[j] {
-				t.Fatalf("unexpect ports result for case %d: expect %v, got %v", i, expectPorts, ports)
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := newTestParams()
+			params.EnableCni = c.enableCni
+			params.CoupleProxyLimitsToRequests = c.coupleLimitsToRequests
+			params.DrainAfterApplication = c.drainAfterApplication
+			valuesConfig := getValues(params, t)
+			if c.proxyResources != "" {
+				valuesConfig = setProxyResources(valuesConfig, c.proxyResources, t)
 			}
-		}
+			got, warnings, err := injectTestFileWithValues(c.in, valuesConfig, params.Mesh, t)
+			if err != nil {
+				t.Fatalf("IntoResourceFileWithWarnings(%v) returned an error: %v", c.in, err)
+			}
+			if len(got) == 0 {
+				t.Fatalf("expected injected output")
+			}
+			if len(warnings) != len(c.want) {
+				t.Fatalf("got %d warnings, want %d: %v", len(warnings), len(c.want), warnings)
+			}
+			for i, want := range c.want {
+				if !strings.Contains(warnings[i], want) {
+					t.Errorf("warning %d: got %q, want it to mention %s", i, warnings[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestIntoResourceFileWithTransform(t *testing.T) {
+	params := newTestParams()
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+	inputFilePath := "testdata/inject/hello.yaml"
+	input, err := ioutil.ReadFile(inputFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want bytes.Buffer
+	if err = IntoResourceFile(sidecarTemplate, valuesConfig, params.Mesh, bytes.NewReader(input), &want); err != nil {
+		t.Fatalf("IntoResourceFile(%v) returned an error: %v", inputFilePath, err)
+	}
+	header := func(b []byte) ([]byte, error) {
+		return append([]byte(strings.ToUpper("# licensed under the apache license")+"\n"), b...), nil
+	}
+	var got bytes.Buffer
+	err = IntoResourceFileWithTransform(sidecarTemplate, valuesConfig, params.Mesh, bytes.NewReader(input), &got, header)
+	if err != nil {
+		t.Fatalf("IntoResourceFileWithTransform(%v) returned an error: %v", inputFilePath, err)
+	}
+	util.CompareBytes(got.Bytes(), append([]byte("# LICENSED UNDER THE APACHE LICENSE\n"), want.Bytes()...), inputFilePath, t)
+
+	failing := func([]byte) ([]byte, error) {
+		return nil, fmt.Errorf("no license")
+	}
+	err = IntoResourceFileWithTransform(sidecarTemplate, valuesConfig, params.Mesh, bytes.NewReader(input), ioutil.Discard, failing)
+	if err == nil || !strings.Contains(err.Error(), "no license") {
+		t.Fatalf("expected the error of the transform, got %v", err)
+	}
+}
+
+func TestRecordInjectionID(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			params := newTestParams()
+			params.RecordInjectionID = enabled
+			got, _, err := injectTestFile("hello.yaml", params, t)
+			if err != nil {
+				t.Fatalf("IntoResourceFile() returned an error: %v", err)
+			}
+			obj, err := FromRawToObject(bytes.TrimSuffix(got, []byte("---\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			annotations := obj.(*appsv1.Deployment).Spec.Template.Annotations
+			id, ok := annotations[injectionIDAnnotation]
+			if !enabled {
+				if ok {
+					t.Fatalf("unexpected %s annotation: %q", injectionIDAnnotation, id)
+				}
+				return
+			}
+			if _, err := uuid.Parse(id); err != nil {
+				t.Fatalf("%s annotation %q is not a valid UUID: %v", injectionIDAnnotation, id, err)
+			}
+			if parseInjectionStatus(annotations) == nil {
+				t.Fatalf("injection status is missing from %v", annotations)
+			}
+		})
+	}
+}
+
+func TestRecordInjectorVersion(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			params := newTestParams()
+			params.Version = "1.4.0-test"
+			params.RecordInjectorVersion = enabled
+			got, _, err := injectTestFile("hello.yaml", params, t)
+			if err != nil {
+				t.Fatalf("IntoResourceFile() returned an error: %v", err)
+			}
+			obj, err := FromRawToObject(bytes.TrimSuffix(got, []byte("---\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			annotations := obj.(*appsv1.Deployment).Spec.Template.Annotations
+			injectorVersion, ok := annotations[injectorVersionAnnotation]
+			if !enabled {
+				if ok {
+					t.Fatalf("unexpected %s annotation: %q", injectorVersionAnnotation, injectorVersion)
+				}
+				return
+			}
+			if injectorVersion != params.Version {
+				t.Fatalf("got %s annotation %q, want %q", injectorVersionAnnotation, injectorVersion, params.Version)
+			}
+			// The annotation is left alone by stripVersion, which only blanks the template version.
+			if stripped := stripVersion(got); !bytes.Contains(stripped, []byte(injectorVersionAnnotation+": "+params.Version)) {
+				t.Fatalf("stripVersion() dropped the %s annotation:\n%s", injectorVersionAnnotation, stripped)
+			}
+
+			// The injected pod is still recognized as such, and is not injected twice.
+			var again bytes.Buffer
+			err = IntoResourceFile(loadSidecarTemplate(t), getValues(params, t), params.Mesh, bytes.NewReader(got), &again)
+			if err != nil {
+				t.Fatalf("IntoResourceFile() of the injected output returned an error: %v", err)
+			}
+			if !bytes.Equal(again.Bytes(), got) {
+				t.Fatalf("injected output was injected again:\n%s", again.Bytes())
+			}
+		})
 	}
 }
 
+func TestCustomPodTemplates(t *testing.T) {
+	params := newTestParams()
+	params.CustomPodTemplates = []CustomPodTemplate{{
+		APIVersion: "example.com/v1",
+		Kind:       "CanaryApp",
+		Paths:      []string{"spec.primary.template", "spec.canary.template"},
+	}}
+	if err := params.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := injectTestFile("custom-resource-two-templates.yaml", params, t)
+	if err != nil {
+		t.Fatalf("IntoResourceFile() returned an error: %v", err)
+	}
+
+	var resource struct {
+		Spec struct {
+			Strategy map[string]interface{} `json:"strategy"`
+			Primary  struct {
+				Replicas int                    `json:"replicas"`
+				Template corev1.PodTemplateSpec `json:"template"`
+			} `json:"primary"`
+			Canary struct {
+				Replicas int                    `json:"replicas"`
+				Template corev1.PodTemplateSpec `json:"template"`
+			} `json:"canary"`
+		} `json:"spec"`
+	}
+	if err := yaml.Unmarshal(bytes.TrimSuffix(got, []byte("---\n")), &resource); err != nil {
+		t.Fatal(err)
+	}
+	for name, template := range map[string]corev1.PodTemplateSpec{
+		"primary": resource.Spec.Primary.Template,
+		"canary":  resource.Spec.Canary.Template,
+	} {
+		if FindSidecar(template.Spec.Containers) == nil {
+			t.Errorf("%s template has no %s container:\n%s", name, ProxyContainerName, got)
+		}
+		if parseInjectionStatus(template.Annotations) == nil {
+			t.Errorf("%s template has no injection status: %v", name, template.Annotations)
+		}
+	}
+	// The rest of the resource is kept.
+	if resource.Spec.Primary.Replicas != 3 || resource.Spec.Canary.Replicas != 1 ||
+		resource.Spec.Strategy["canaryWeight"] != float64(10) {
+		t.Errorf("resource fields around the templates were not preserved:\n%s", got)
+	}
+	if track := resource.Spec.Canary.Template.Labels["track"]; track != "canary" {
+		t.Errorf("got canary track label %q, want %q", track, "canary")
+	}
+}
+
+func TestReinjectOnVersionChange(t *testing.T) {
+	injectFile := func(params *Params, in []byte) []byte {
+		t.Helper()
+		var out bytes.Buffer
+		if err := IntoResourceFile(loadSidecarTemplate(t), getValues(params, t), params.Mesh, bytes.NewReader(in), &out); err != nil {
+			t.Fatalf("IntoResourceFile() returned an error: %v", err)
+		}
+		return out.Bytes()
+	}
+	original, err := ioutil.ReadFile("testdata/inject/hello.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	injected := injectFile(newTestParams(), original)
+	// The status of pods injected from another template records another version.
+	stale := statusPattern.ReplaceAllLiteral(injected, []byte(`sidecar.istio.io/status: '{"version":"0123456789abcdef",`))
+
+	cases := []struct {
+		name    string
+		in      []byte
+		enabled bool
+		want    []byte
+	}{
+		{name: "same version", in: injected, enabled: true, want: injected},
+		{name: "other version", in: stale, enabled: true, want: injected},
+		{name: "other version, disabled", in: stale, enabled: false, want: stale},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := newTestParams()
+			params.ReinjectOnVersionChange = c.enabled
+			got := injectFile(params, c.in)
+			if !bytes.Equal(got, c.want) {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+// TestReinjectOnModeChange verifies that a pod injected from the same template is injected again
+// when its status records another mode than the current values inject.
+func TestReinjectOnModeChange(t *testing.T) {
+	proxyOnlyWithCniTemplate := `
+{{ if not .Values.istio_cni.enabled -}}
+initContainers:
+- name: istio-init
+  image: docker.io/istio/proxy_init:unittest
+{{ end -}}
+containers:
+- name: istio-proxy
+  image: docker.io/istio/proxyv2:unittest
+`
+	injectFile := func(params *Params, in []byte) []byte {
+		t.Helper()
+		var out bytes.Buffer
+		if err := IntoResourceFile(proxyOnlyWithCniTemplate, getValues(params, t), params.Mesh, bytes.NewReader(in), &out); err != nil {
+			t.Fatalf("IntoResourceFile() returned an error: %v", err)
+		}
+		return out.Bytes()
+	}
+	original, err := ioutil.ReadFile("testdata/inject/hello.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	injected := injectFile(newTestParams(), original)
+	cniParams := newTestParams()
+	cniParams.EnableCni = true
+	proxyOnly := injectFile(cniParams, original)
+	if !strings.Contains(string(proxyOnly), `"mode":"ProxyOnly"`) {
+		t.Fatalf("expected the status annotation to record the proxy only mode, got:\n%s", proxyOnly)
+	}
+
+	cases := []struct {
+		name    string
+		enabled bool
+		want    []byte
+	}{
+		{name: "other mode", enabled: true, want: injected},
+		{name: "other mode, disabled", enabled: false, want: proxyOnly},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := newTestParams()
+			params.ReinjectOnVersionChange = c.enabled
+			got := injectFile(params, proxyOnly)
+			if !bytes.Equal(got, c.want) {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSecurityContextPerInterceptionMode(t *testing.T) {
+	cases := []struct {
+		name                  string
+		mode                  meshapi.ProxyConfig_InboundInterceptionMode
+		enableCni             bool
+		wantInitContainer     string
+		wantInitUser          int64
+		wantInitNonRoot       bool
+		wantProxyUser         int64
+		wantProxyNonRoot      bool
+		wantProxyCapabilities []corev1.Capability
+		golden                string
+	}{
+		{
+			name:              "redirect",
+			mode:              meshapi.ProxyConfig_REDIRECT,
+			golden:            "redirect.yaml",
+			wantInitContainer: "istio-init",
+			wantInitUser:      0,
+			wantInitNonRoot:   false,
+			wantProxyUser:     1337,
+			wantProxyNonRoot:  true,
+		},
+		{
+			name:                  "tproxy",
+			mode:                  meshapi.ProxyConfig_TPROXY,
+			golden:                "tproxy.yaml",
+			wantInitContainer:     "istio-init",
+			wantInitUser:          0,
+			wantInitNonRoot:       false,
+			wantProxyUser:         0,
+			wantProxyNonRoot:      false,
+			wantProxyCapabilities: []corev1.Capability{"NET_ADMIN"},
+		},
+		{
+			// The CNI plugin sets up the redirection, the init container only validates it.
+			name:              "redirect with cni",
+			mode:              meshapi.ProxyConfig_REDIRECT,
+			enableCni:         true,
+			golden:            "cni.yaml",
+			wantInitContainer: "istio-validation",
+			wantInitUser:      1337,
+			wantInitNonRoot:   true,
+			wantProxyUser:     1337,
+			wantProxyNonRoot:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := newTestParams()
+			params.EnableCni = c.enableCni
+			params.Mesh.DefaultConfig.InterceptionMode = c.mode
+			sidecarTemplate := loadSidecarTemplate(t)
+			valuesConfig := getValues(params, t)
+			in, err := ioutil.ReadFile("testdata/inject/hello.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj, err := FromRawToObject(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := IntoObject(sidecarTemplate, valuesConfig, params.Mesh, obj)
+			if err != nil {
+				t.Fatalf("IntoObject() returned an error: %v", err)
+			}
+			podSpec := out.(*appsv1.Deployment).Spec.Template.Spec
+
+			if len(podSpec.InitContainers) != 1 || podSpec.InitContainers[0].Name != c.wantInitContainer {
+				t.Fatalf("got init containers %v, want %q", containerNames(podSpec.InitContainers), c.wantInitContainer)
+			}
+			checkSecurityContext(t, &podSpec.InitContainers[0], c.wantInitUser, c.wantInitNonRoot)
+
+			proxy := FindSidecar(podSpec.Containers)
+			if proxy == nil {
+				t.Fatalf("no %s container in %v", ProxyContainerName, containerNames(podSpec.Containers))
+			}
+			checkSecurityContext(t, proxy, c.wantProxyUser, c.wantProxyNonRoot)
+			var capabilities []corev1.Capability
+			if proxy.SecurityContext.Capabilities != nil {
+				capabilities = proxy.SecurityContext.Capabilities.Add
+			}
+			if !reflect.DeepEqual(capabilities, c.wantProxyCapabilities) {
+				t.Errorf("got proxy capabilities %v, want %v", capabilities, c.wantProxyCapabilities)
+			}
+
+			// The golden files pin the whole rendered security contexts of each mode.
+			type renderedSecurityContext struct {
+				Name            string                  `json:"name"`
+				SecurityContext *corev1.SecurityContext `json:"securityContext"`
+			}
+			var rendered []renderedSecurityContext
+			for _, ic := range podSpec.InitContainers {
+				rendered = append(rendered, renderedSecurityContext{ic.Name, ic.SecurityContext})
+			}
+			rendered = append(rendered, renderedSecurityContext{proxy.Name, proxy.SecurityContext})
+			gotBytes, err := yaml.Marshal(rendered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantFilePath := "testdata/inject/security-context/" + c.golden
+			wantBytes := util.ReadGoldenFile(gotBytes, wantFilePath, t)
+			util.CompareBytes(gotBytes, wantBytes, wantFilePath, t)
+			if util.Refresh() {
+				util.RefreshGoldenFile(gotBytes, wantFilePath, t)
+			}
+		})
+	}
+}
+
+func checkSecurityContext(t *testing.T, c *corev1.Container, wantUser int64, wantNonRoot bool) {
+	t.Helper()
+	sc := c.SecurityContext
+	if sc == nil || sc.RunAsUser == nil || sc.RunAsNonRoot == nil {
+		t.Fatalf("container %q has an incomplete security context: %+v", c.Name, sc)
+	}
+	if *sc.RunAsUser != wantUser || *sc.RunAsNonRoot != wantNonRoot {
+		t.Errorf("container %q runs as user %d (nonRoot=%v), want %d (nonRoot=%v)",
+			c.Name, *sc.RunAsUser, *sc.RunAsNonRoot, wantUser, wantNonRoot)
+	}
+}
+
+func TestHostNamespaces(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			params := newTestParams()
+			params.StrictHostNamespaces = strict
+			got, warnings, err := injectTestFile("hello-host-pid.yaml", params, t)
+			if strict {
+				if err == nil || !strings.Contains(err.Error(), "hostPID") {
+					t.Fatalf("expected injection of a hostPID pod to be refused, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("IntoResourceFileWithWarnings() returned an error: %v", err)
+			}
+			if len(warnings) != 1 || !strings.Contains(warnings[0], "hostPID") {
+				t.Fatalf("expected a hostPID warning, got %v", warnings)
+			}
+			if !bytes.Contains(got, []byte("hostPID: true")) {
+				t.Fatalf("hostPID was not preserved:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestStrictAnnotations(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			params := newTestParams()
+			params.StrictAnnotations = strict
+			_, _, err := injectTestFile("hello-misspelled-annotation.yaml", params, t)
+			if !strict {
+				if err != nil {
+					t.Fatalf("IntoResourceFile() returned an error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error for the misspelled annotation")
+			}
+			for _, want := range []string{"sidecar.istio.io/injct", "did you mean 'sidecar.istio.io/inject'"} {
+				if !strings.Contains(err.Error(), want) {
+					t.Fatalf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectPod(t *testing.T) {
+	params := newTestParams()
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+	raw, err := ioutil.ReadFile("testdata/inject/pod.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := FromRawToObject(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := obj.(*corev1.Pod)
+	in := pod.DeepCopy()
+
+	got, err := InjectPod(sidecarTemplate, valuesConfig, params.Mesh, pod)
+	if err != nil {
+		t.Fatalf("InjectPod() returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(pod, in) {
+		t.Fatalf("InjectPod() modified its input")
+	}
+	if FindSidecar(got.Spec.Containers) == nil {
+		t.Fatalf("InjectPod() did not inject the proxy: %+v", got.Spec.Containers)
+	}
+
+	// The injection is the one IntoResourceFile applies to each decoded object.
+	want, err := IntoObject(sidecarTemplate, valuesConfig, params.Mesh, pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("InjectPod() got %+v want %+v", got, want)
+	}
+}
+
+func TestBuildSidecar(t *testing.T) {
+	params := newTestParams()
+	params.RecordInjectionID = true
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+	raw, err := ioutil.ReadFile("testdata/inject/pod.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := FromRawToObject(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := obj.(*corev1.Pod)
+	in := pod.DeepCopy()
+
+	got, err := BuildSidecar(sidecarTemplate, valuesConfig, params.Mesh, &pod.ObjectMeta, &pod.Spec)
+	if err != nil {
+		t.Fatalf("BuildSidecar() returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(pod, in) {
+		t.Fatalf("BuildSidecar() modified its input")
+	}
+
+	// The sidecar is the one the full injection merges into the pod.
+	out, err := IntoObject(sidecarTemplate, valuesConfig, params.Mesh, pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := out.(*corev1.Pod)
+	if !reflect.DeepEqual(got.InitContainers, want.Spec.InitContainers) {
+		t.Errorf("got init containers %+v want %+v", got.InitContainers, want.Spec.InitContainers)
+	}
+	if !reflect.DeepEqual(got.Containers, want.Spec.Containers[len(pod.Spec.Containers):]) {
+		t.Errorf("got containers %+v want %+v", got.Containers, want.Spec.Containers[len(pod.Spec.Containers):])
+	}
+	if !reflect.DeepEqual(got.Volumes, want.Spec.Volumes) {
+		t.Errorf("got volumes %+v want %+v", got.Volumes, want.Spec.Volumes)
+	}
+	if !reflect.DeepEqual(got.ImagePullSecrets, want.Spec.ImagePullSecrets) {
+		t.Errorf("got image pull secrets %+v want %+v", got.ImagePullSecrets, want.Spec.ImagePullSecrets)
+	}
+	if got.Annotations[annotation.SidecarStatus.Name] == "" {
+		t.Errorf("BuildSidecar() did not resolve the injection status: %v", got.Annotations)
+	}
+	if id, ok := got.Annotations[injectionIDAnnotation]; ok {
+		t.Errorf("BuildSidecar() resolved the injection ID %q, which is unique to each injection", id)
+	}
+	for name, value := range got.Annotations {
+		if want.Annotations[name] != value {
+			t.Errorf("got annotation %s=%q want %q", name, value, want.Annotations[name])
+		}
+	}
+}
+
+func TestRenderUserVolumeMounts(t *testing.T) {
+	deploymentMeta := &metav1.ObjectMeta{Name: "hello", Namespace: "demo"}
+	cases := []struct {
+		name     string
+		value    string
+		wantPath string
+		wantErr  string
+	}{
+		{
+			name:     "plain JSON",
+			value:    `{"custom":{"mountPath":"/etc/custom"}}`,
+			wantPath: "/etc/custom",
+		},
+		{
+			name:     "pod metadata",
+			value:    `{"custom":{"mountPath":"/etc/custom/{{ .DeploymentMeta.Namespace }}"}}`,
+			wantPath: "/etc/custom/demo",
+		},
+		{
+			name:    "environment of the injector",
+			value:   `{"custom":{"mountPath":"/etc/{{ env "HOME" "" }}"}}`,
+			wantErr: `function "env" not defined`,
+		},
+		{
+			name:    "nested template",
+			value:   `{"custom":{"mountPath":"/etc/{{ render "x" }}"}}`,
+			wantErr: `function "render" not defined`,
+		},
+		{
+			name:    "execution error",
+			value:   `{"custom":{"mountPath":"/etc/{{ .DeploymentMeta.Unknown }}"}}`,
+			wantErr: "userVolumeMount invalid template",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mounts, err := renderUserVolumeMounts(c.value, deploymentMeta, &metav1.ObjectMeta{})
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("got error %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mounts) != 1 || mounts[0].MountPath != c.wantPath {
+				t.Fatalf("got mounts %+v, want the mount path %q", mounts, c.wantPath)
+			}
+		})
+	}
+}
+
+func TestProxyImageSelector(t *testing.T) {
+	RegisterProxyImageSelector("flavor", func(pod *corev1.Pod) (string, string, error) {
+		switch pod.Labels["proxy-flavor"] {
+		case "":
+			return "", "", nil
+		case "debug":
+			return "docker.io/istio/proxyv2-debug:latest", "docker.io/istio/proxy_init-debug:unittest", nil
+		case "invalid":
+			return "docker.io/istio/Proxy", "", nil
+		default:
+			return "", "", fmt.Errorf("unknown flavor %q", pod.Labels["proxy-flavor"])
+		}
+	})
+	defer RegisterProxyImageSelector("flavor", nil)
+
+	sidecarTemplate := loadSidecarTemplate(t)
+	raw, err := ioutil.ReadFile("testdata/inject/pod.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := FromRawToObject(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := obj.(*corev1.Pod)
+
+	cases := []struct {
+		name       string
+		flavor     string
+		params     func(p *Params)
+		wantProxy  string
+		wantPolicy corev1.PullPolicy
+		wantInit   []string
+		wantErr    string
+	}{
+		{
+			name:      "template images",
+			wantProxy: "docker.io/istio/proxyv2:unittest",
+			wantInit:  []string{"docker.io/istio/proxy_init:unittest"},
+		},
+		{
+			name:      "selected images",
+			flavor:    "debug",
+			wantProxy: "docker.io/istio/proxyv2-debug:latest",
+			wantInit:  []string{"docker.io/istio/proxy_init-debug:unittest"},
+		},
+		{
+			name:   "core dump image kept",
+			flavor: "debug",
+			params: func(p *Params) {
+				p.EnableCoreDump = true
+				p.InferPullPolicyFromTag = true
+			},
+			wantProxy:  "docker.io/istio/proxyv2-debug:latest",
+			wantPolicy: corev1.PullAlways,
+			wantInit:   []string{"docker.io/istio/proxy_init-debug:unittest", "ubuntu:xenial"},
+		},
+		{
+			name:    "invalid image",
+			flavor:  "invalid",
+			wantErr: "selected proxy image invalid",
+		},
+		{
+			name:    "selector error",
+			flavor:  "unknown",
+			wantErr: `proxy image selector "flavor" failed for pod "hellopod": unknown flavor "unknown"`,
+		},
+		{
+			name:    "not registered",
+			params:  func(p *Params) { p.ProxyImageSelector = "missing" },
+			wantErr: `proxy image selector "missing" is not registered`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := newTestParams()
+			params.ProxyImageSelector = "flavor"
+			if c.params != nil {
+				c.params(params)
+			}
+			in := pod.DeepCopy()
+			if c.flavor != "" {
+				if in.Labels == nil {
+					in.Labels = map[string]string{}
+				}
+				in.Labels["proxy-flavor"] = c.flavor
+				in.Annotations = map[string]string{annotation.SidecarProxyImage.Name: "docker.io/istio/proxyv2-annotated:unittest"}
+			}
+			got, err := InjectPod(sidecarTemplate, getValues(params, t), params.Mesh, in)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("got error %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("InjectPod() returned an error: %v", err)
+			}
+			proxy := FindSidecar(got.Spec.Containers)
+			if proxy == nil || proxy.Image != c.wantProxy {
+				t.Fatalf("got proxy %+v, want image %q", proxy, c.wantProxy)
+			}
+			if c.wantPolicy != "" && proxy.ImagePullPolicy != c.wantPolicy {
+				t.Fatalf("got proxy pull policy %q, want %q", proxy.ImagePullPolicy, c.wantPolicy)
+			}
+			var gotInit []string
+			for _, ic := range got.Spec.InitContainers {
+				gotInit = append(gotInit, ic.Image)
+			}
+			if !reflect.DeepEqual(gotInit, c.wantInit) {
+				t.Fatalf("got init images %v, want %v", gotInit, c.wantInit)
+			}
+		})
+	}
+
+	params := newTestParams()
+	params.ProxyImageSelector = "missing"
+	if err := params.Validate(); err == nil {
+		t.Fatal("Validate() accepted an unregistered proxyImageSelector")
+	}
+}
+
+func TestIntoObjectWithoutMetadata(t *testing.T) {
+	spec := `
+    spec:
+      containers:
+      - name: hello
+        image: fake.docker.io/google-samples/hello-go-gke:1.0`
+	cases := map[string]string{
+		"Pod": `apiVersion: v1
+kind: Pod
+spec:
+  containers:
+  - name: hello
+    image: fake.docker.io/google-samples/hello-go-gke:1.0`,
+		"Deployment": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: hello
+spec:
+  template:` + spec,
+		"DaemonSet": `apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: hello
+spec:
+  template:` + spec,
+		"Job": `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: hello
+spec:
+  template:` + spec,
+		"ReplicationController": `apiVersion: v1
+kind: ReplicationController
+metadata:
+  name: hello
+spec:
+  template:` + spec,
+	}
+	params := newTestParams()
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+	for kind, in := range cases {
+		t.Run(kind, func(t *testing.T) {
+			obj, err := FromRawToObject([]byte(in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := IntoObject(sidecarTemplate, valuesConfig, params.Mesh, obj)
+			if err != nil {
+				t.Fatalf("IntoObject() returned an error: %v", err)
+			}
+			got, err := json.Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []string{`"sidecar.istio.io/status":`, `"security.istio.io/tlsMode":"istio"`} {
+				if !strings.Contains(string(got), want) {
+					t.Fatalf("injected %s does not contain %s: %s", kind, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordOwner(t *testing.T) {
+	pod := `apiVersion: v1
+kind: Pod
+metadata:
+  name: hello-5d8f9c-x7k2p
+  labels:
+    app: hello
+    pod-template-hash: 5d8f9c
+%s
+spec:
+  containers:
+  - name: hello
+    image: fake.docker.io/google-samples/hello-go-gke:1.0`
+	cases := []struct {
+		name   string
+		owners string
+		want   string
+	}{
+		{
+			name: "deployment",
+			owners: `  ownerReferences:
+  - apiVersion: apps/v1
+    kind: ReplicaSet
+    name: hello-5d8f9c
+    uid: 7c4a2b3e-0d7e-4b7a-9a0c-3f6f0f3b2d1e
+    controller: true`,
+			want: "Deployment/hello",
+		},
+		{
+			name: "statefulset",
+			owners: `  ownerReferences:
+  - apiVersion: apps/v1
+    kind: StatefulSet
+    name: hello-db
+    uid: 1f0e6e2a-52c8-4d1e-8c4e-6b8f2b7d9a10
+    controller: true`,
+			want: "StatefulSet/hello-db",
+		},
+		{
+			name: "no owner",
+		},
+	}
+	params := newTestParams()
+	params.RecordOwner = true
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			obj, err := FromRawToObject([]byte(fmt.Sprintf(pod, c.owners)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := IntoObject(sidecarTemplate, valuesConfig, params.Mesh, obj)
+			if err != nil {
+				t.Fatalf("IntoObject() returned an error: %v", err)
+			}
+			got, ok := out.(*corev1.Pod).Annotations[ownerAnnotation]
+			if c.want == "" {
+				if ok {
+					t.Fatalf("pod without owner annotated with %q", got)
+				}
+				return
+			}
+			if got != c.want {
+				t.Fatalf("got owner %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	params := newTestParams()
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+	if err := ValidateTemplate(sidecarTemplate, valuesConfig); err != nil {
+		t.Fatalf("ValidateTemplate() of the release template and values failed: %v", err)
+	}
+
+	mismatched := templateCompatibilityVersionRegexp.ReplaceAllString(sidecarTemplate, `{{- /* compatibilityVersion: "0" */ -}}`)
+	err := ValidateTemplate(mismatched, valuesConfig)
+	if err == nil || !strings.Contains(err.Error(), `compatibility version "0" does not match the version "1"`) {
+		t.Fatalf("ValidateTemplate() of mismatched versions: got error %v", err)
+	}
+
+	// Injection refuses the mismatched pair too.
+	in, err := os.Open("testdata/inject/hello.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = in.Close() }()
+	var got bytes.Buffer
+	if err := IntoResourceFile(mismatched, valuesConfig, params.Mesh, in, &got); err == nil {
+		t.Fatalf("IntoResourceFile() with mismatched versions succeeded")
+	}
+
+	// Templates without marker, e.g. custom ones, are not checked.
+	unmarked := templateCompatibilityVersionRegexp.ReplaceAllString(sidecarTemplate, "")
+	if err := ValidateTemplate(unmarked, valuesConfig); err != nil {
+		t.Fatalf("ValidateTemplate() of a template without marker failed: %v", err)
+	}
+}
+
+func TestLegacyInjectionStatus(t *testing.T) {
+	for _, reinject := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reinject=%v", reinject), func(t *testing.T) {
+			params := newTestParams()
+			params.ReinjectLegacyStatus = reinject
+			sidecarTemplate := loadSidecarTemplate(t)
+			valuesConfig := getValues(params, t)
+			inputFilePath := "testdata/inject/hello-legacy-status.yaml"
+			in, err := ioutil.ReadFile(inputFilePath)
+			if err != nil {
+				t.Fatalf("Failed to read %q: %v", inputFilePath, err)
+			}
+			obj, err := FromRawToObject(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := IntoObject(sidecarTemplate, valuesConfig, params.Mesh, obj)
+			if err != nil {
+				t.Fatalf("IntoObject(%v) returned an error: %v", inputFilePath, err)
+			}
+			if !reinject {
+				if !reflect.DeepEqual(out, obj) {
+					t.Fatalf("pod with a legacy status annotation was modified")
+				}
+				return
+			}
+
+			template := out.(*appsv1.Deployment).Spec.Template
+			if parseInjectionStatus(template.Annotations) == nil {
+				t.Fatalf("legacy status annotation was not replaced: %v", template.Annotations)
+			}
+			for _, want := range []struct {
+				names []string
+				name  string
+			}{
+				{containerNames(template.Spec.InitContainers), "istio-init"},
+				{containerNames(template.Spec.Containers), ProxyContainerName},
+				{containerNames(template.Spec.Containers), "hello"},
+			} {
+				count := 0
+				for _, n := range want.names {
+					if n == want.name {
+						count++
+					}
+				}
+				if count != 1 {
+					t.Fatalf("got %d %q containers, want 1: %v", count, want.name, want.names)
+				}
+			}
+			for _, c := range template.Spec.Containers {
+				if c.Name == ProxyContainerName && c.Image != params.ProxyImage {
+					t.Fatalf("legacy proxy was not replaced, got image %q", c.Image)
+				}
+			}
+		})
+	}
+}
+
+func containerNames(containers []corev1.Container) []string {
+	names := make([]string, 0, len(containers))
+	for _, c := range containers {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func TestInjectionModeStatus(t *testing.T) {
+	cases := []struct {
+		name string
+		spec SidecarInjectionSpec
+		want InjectionMode
+	}{
+		{
+			name: "full",
+			spec: SidecarInjectionSpec{
+				InitContainers: []corev1.Container{{Name: "istio-init"}},
+				Containers:     []corev1.Container{{Name: ProxyContainerName}},
+			},
+			want: InjectionModeFull,
+		},
+		{
+			name: "init only",
+			spec: SidecarInjectionSpec{
+				InitContainers: []corev1.Container{{Name: "istio-init"}},
+			},
+			want: InjectionModeInitOnly,
+		},
+		{
+			name: "proxy only",
+			spec: SidecarInjectionSpec{
+				Containers: []corev1.Container{{Name: ProxyContainerName}},
+			},
+			want: InjectionModeProxyOnly,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := injectionModeFor(&c.spec); got != c.want {
+				t.Fatalf("injectionModeFor() got %q want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestContainerInjections(t *testing.T) {
+	got, _, err := injectTestFile("multi-container.yaml", newTestParams(), t)
+	if err != nil {
+		t.Fatalf("IntoResourceFile() returned an error: %v", err)
+	}
+	var deployment appsv1.Deployment
+	if err = yaml.Unmarshal(got, &deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	if roles := ContainerInjections(&metav1.ObjectMeta{}, &deployment.Spec.Template.Spec); roles != nil {
+		t.Fatalf("expected no classification without a status annotation, got %+v", roles)
+	}
+	want := []ContainerInjection{
+		{Name: "istio-init", Init: true, Role: ContainerRoleInjected},
+		{Name: "name1", Role: ContainerRoleApp},
+		{Name: "name2", Role: ContainerRoleUntouched},
+		{Name: "name3", Role: ContainerRoleUntouched},
+		{Name: ProxyContainerName, Role: ContainerRoleProxy},
+	}
+	roles := ContainerInjections(&deployment.Spec.Template.ObjectMeta, &deployment.Spec.Template.Spec)
+	if !reflect.DeepEqual(roles, want) {
+		t.Fatalf("ContainerInjections() got %+v want %+v", roles, want)
+	}
+}
+
+// TestInitOnlyInjectionNotReinjected verifies that a partially injected pod is recognized
+// from its status annotation and does not get the proxy injected on a second pass.
+func TestInitOnlyInjectionNotReinjected(t *testing.T) {
+	initOnlyTemplate := `
+initContainers:
+- name: istio-init
+  image: docker.io/istio/proxy_init:unittest
+`
+	params := newTestParams()
+	valuesConfig := getValues(params, t)
+	inputFilePath := "testdata/inject/hello.yaml"
+	in, err := os.Open(inputFilePath)
+	if err != nil {
+		t.Fatalf("Failed to open %q: %v", inputFilePath, err)
+	}
+	defer func() { _ = in.Close() }()
+
+	var first bytes.Buffer
+	if err = IntoResourceFile(initOnlyTemplate, valuesConfig, params.Mesh, in, &first); err != nil {
+		t.Fatalf("IntoResourceFile(%v) returned an error: %v", inputFilePath, err)
+	}
+	if !strings.Contains(first.String(), `"mode":"InitOnly"`) {
+		t.Fatalf("expected the status annotation to record the init only mode, got:\n%s", first.String())
+	}
+
+	var second bytes.Buffer
+	if err = IntoResourceFile(loadSidecarTemplate(t), valuesConfig, params.Mesh, bytes.NewReader(first.Bytes()), &second); err != nil {
+		t.Fatalf("IntoResourceFile(%v) returned an error on second pass: %v", inputFilePath, err)
+	}
+	if strings.Contains(second.String(), ProxyContainerName) {
+		t.Fatalf("expected no proxy to be injected into an init only pod, got:\n%s", second.String())
+	}
+	util.CompareBytes(second.Bytes(), first.Bytes(), inputFilePath, t)
+}
+
+func TestSchedulesOnSpotNodes(t *testing.T) {
+	cases := []struct {
+		name string
+		spec corev1.PodSpec
+		want bool
+	}{
+		{
+			name: "no spot toleration",
+			spec: corev1.PodSpec{Tolerations: []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpExists}}},
+		},
+		{
+			name: "equal toleration of a key only label",
+			spec: corev1.PodSpec{Tolerations: []corev1.Toleration{{Key: "cloud.google.com/gke-spot", Value: "true"}}},
+			want: true,
+		},
+		{
+			name: "equal toleration of a spot value",
+			spec: corev1.PodSpec{Tolerations: []corev1.Toleration{{Key: "kubernetes.azure.com/scalesetpriority", Value: "spot"}}},
+			want: true,
+		},
+		{
+			name: "equal toleration of another value",
+			spec: corev1.PodSpec{Tolerations: []corev1.Toleration{{Key: "kubernetes.azure.com/scalesetpriority", Value: "regular"}}},
+		},
+		{
+			name: "exists toleration of a key only label",
+			spec: corev1.PodSpec{Tolerations: []corev1.Toleration{{Key: "cloud.google.com/gke-preemptible", Operator: corev1.TolerationOpExists}}},
+			want: true,
+		},
+		{
+			name: "exists toleration of a label with a spot value",
+			spec: corev1.PodSpec{Tolerations: []corev1.Toleration{{Key: "kubernetes.azure.com/scalesetpriority", Operator: corev1.TolerationOpExists}}},
+			want: true,
+		},
+		{
+			name: "spot node selector",
+			spec: corev1.PodSpec{NodeSelector: map[string]string{"eks.amazonaws.com/capacityType": "SPOT"}},
+			want: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := schedulesOnSpotNodes(&c.spec); got != c.want {
+				t.Fatalf("schedulesOnSpotNodes() got %v want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDedupeEnv(t *testing.T) {
+	podName := corev1.EnvVar{
+		Name: "POD_NAME",
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+		},
+	}
+	cases := []struct {
+		name string
+		in   []corev1.EnvVar
+		want []corev1.EnvVar
+	}{
+		{
+			name: "no duplicates",
+			in:   []corev1.EnvVar{podName, {Name: "FOO", Value: "1"}},
+			want: []corev1.EnvVar{podName, {Name: "FOO", Value: "1"}},
+		},
+		{
+			name: "last declaration wins",
+			in:   []corev1.EnvVar{podName, {Name: "FOO", Value: "1"}, {Name: "POD_NAME", Value: "hello"}},
+			want: []corev1.EnvVar{{Name: "POD_NAME", Value: "hello"}, {Name: "FOO", Value: "1"}},
+		},
+		{
+			name: "identical downward API declarations",
+			in:   []corev1.EnvVar{podName, podName},
+			want: []corev1.EnvVar{podName},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := dedupeEnv(c.in); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestReferenceDownwardAPIEnv(t *testing.T) {
+	fieldEnv := func(name, apiVersion, path string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{APIVersion: apiVersion, FieldPath: path},
+			},
+		}
+	}
+	resourceEnv := func(name, container, divisor string) corev1.EnvVar {
+		ref := &corev1.ResourceFieldSelector{ContainerName: container, Resource: "limits.memory"}
+		if divisor != "" {
+			ref.Divisor = resource.MustParse(divisor)
+		}
+		return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: ref}}
+	}
+	cases := []struct {
+		name string
+		in   []corev1.EnvVar
+		want []corev1.EnvVar
+	}{
+		{
+			name: "distinct fields",
+			in:   []corev1.EnvVar{fieldEnv("POD_NAME", "", "metadata.name"), fieldEnv("POD_NAMESPACE", "", "metadata.namespace")},
+			want: []corev1.EnvVar{fieldEnv("POD_NAME", "", "metadata.name"), fieldEnv("POD_NAMESPACE", "", "metadata.namespace")},
+		},
+		{
+			name: "same field with the default API version",
+			in:   []corev1.EnvVar{fieldEnv("POD_NAME", "", "metadata.name"), fieldEnv("ISTIO_META_POD_NAME", "v1", "metadata.name")},
+			want: []corev1.EnvVar{fieldEnv("POD_NAME", "", "metadata.name"), {Name: "ISTIO_META_POD_NAME", Value: "$(POD_NAME)"}},
+		},
+		{
+			name: "same resource with the default container and divisor",
+			in:   []corev1.EnvVar{resourceEnv("MEMORY", "", ""), resourceEnv("MEMORY_LIMIT", ProxyContainerName, "1")},
+			want: []corev1.EnvVar{resourceEnv("MEMORY", "", ""), {Name: "MEMORY_LIMIT", Value: "$(MEMORY)"}},
+		},
+		{
+			name: "same resource with another divisor",
+			in:   []corev1.EnvVar{resourceEnv("MEMORY", "", ""), resourceEnv("MEMORY_MI", "", "1Mi")},
+			want: []corev1.EnvVar{resourceEnv("MEMORY", "", ""), resourceEnv("MEMORY_MI", "", "1Mi")},
+		},
+		{
+			name: "resource of another container",
+			in:   []corev1.EnvVar{resourceEnv("MEMORY", "", ""), resourceEnv("APP_MEMORY", "hello", "")},
+			want: []corev1.EnvVar{resourceEnv("MEMORY", "", ""), resourceEnv("APP_MEMORY", "hello", "")},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			referenceDownwardAPIEnv(ProxyContainerName, c.in)
+			if !reflect.DeepEqual(c.in, c.want) {
+				t.Fatalf("got %v, want %v", c.in, c.want)
+			}
+		})
+	}
+}
+
+func TestApplyReadinessInitialDelayFloor(t *testing.T) {
+	cases := []struct {
+		name  string
+		floor uint32
+		delay int32
+		want  int32
+	}{
+		{name: "no floor", floor: 0, delay: 1, want: 1},
+		{name: "raised", floor: 10, delay: 1, want: 10},
+		{name: "larger delay kept", floor: 10, delay: 30, want: 30},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sic := &SidecarInjectionSpec{
+				MinReadinessInitialDelaySeconds: c.floor,
+				Containers: []corev1.Container{
+					{Name: "hello", ReadinessProbe: &corev1.Probe{InitialDelaySeconds: 2}},
+					{Name: ProxyContainerName, ReadinessProbe: &corev1.Probe{InitialDelaySeconds: c.delay}},
+				},
+			}
+			applyReadinessInitialDelayFloor(sic)
+			if got := sic.Containers[1].ReadinessProbe.InitialDelaySeconds; got != c.want {
+				t.Fatalf("got initial delay %d, want %d", got, c.want)
+			}
+			if got := sic.Containers[0].ReadinessProbe.InitialDelaySeconds; got != 2 {
+				t.Fatalf("application probe was modified: initial delay %d", got)
+			}
+		})
+	}
+}
+
+func TestApplyProxyImageRules(t *testing.T) {
+	rules := []ProxyImageRule{
+		{MinContainers: 5, Image: "docker.io/istio/proxyv2-xlarge:unittest"},
+		{MinContainers: 3, Image: "docker.io/istio/proxyv2-large:unittest"},
+	}
+	defaultImage := ProxyImageName(unitTestHub, unitTestTag)
+	cases := []struct {
+		name        string
+		containers  int
+		annotations map[string]string
+		want        string
+	}{
+		{name: "below every threshold", containers: 2, want: defaultImage},
+		{name: "at the lower threshold", containers: 3, want: "docker.io/istio/proxyv2-large:unittest"},
+		{name: "between the thresholds", containers: 4, want: "docker.io/istio/proxyv2-large:unittest"},
+		{name: "above every threshold", containers: 8, want: "docker.io/istio/proxyv2-xlarge:unittest"},
+		{
+			name:        "annotation wins",
+			containers:  8,
+			annotations: map[string]string{annotation.SidecarProxyImage.Name: "docker.io/istio/proxyv2:debug"},
+			want:        defaultImage,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			spec := &corev1.PodSpec{}
+			for i := 0; i < c.containers; i++ {
+				spec.Containers = append(spec.Containers, corev1.Container{Name: fmt.Sprintf("app-%d", i)})
+			}
+			sic := &SidecarInjectionSpec{
+				ProxyImageRules: rules,
+				Containers:      []corev1.Container{{Name: ProxyContainerName, Image: defaultImage}},
+			}
+			applyProxyImageRules(sic, spec, c.annotations)
+			if got := sic.Containers[0].Image; got != c.want {
+				t.Fatalf("got image %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestProxyMetadata(t *testing.T) {
+	params := newTestParams()
+	params.Mesh.DefaultConfig.ProxyMetadata = map[string]string{
+		"ISTIO_META_DNS_CAPTURE": "true",
+		"ISTIO_META_CLUSTER_ID":  "cluster-1",
+		"ISTIO_META_OWNER":       "mesh",
+	}
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+	metadata := &metav1.ObjectMeta{
+		Name:      "hello",
+		Namespace: "default",
+		Annotations: map[string]string{
+			proxyMetadataAnnotation: `{"ISTIO_META_CLUSTER_ID":"cluster-2"}`,
+		},
+	}
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "hello", Image: "fake.docker.io/google-samples/hello-go-gke:1.0"}},
+	}
+	sic, _, err := injectionData(sidecarTemplate, valuesConfig, "", &metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}, metadata, spec,
+		metadata, params.Mesh.DefaultConfig, params.Mesh, nil)
+	if err != nil {
+		t.Fatalf("injectionData() failed: %v", err)
+	}
+	proxy := FindSidecar(sic.Containers)
+	if proxy == nil {
+		t.Fatalf("no proxy container injected")
+	}
+	env := map[string][]string{}
+	for _, e := range proxy.Env {
+		env[e.Name] = append(env[e.Name], e.Value)
+	}
+	for name, want := range map[string]string{
+		"ISTIO_META_DNS_CAPTURE": "true",
+		// The annotation wins over the mesh.
+		"ISTIO_META_CLUSTER_ID": "cluster-2",
+		// The mesh wins over the template.
+		"ISTIO_META_OWNER": "mesh",
+	} {
+		if got := env[name]; !reflect.DeepEqual(got, []string{want}) {
+			t.Errorf("env %s: got %v, want [%s]", name, got, want)
+		}
+	}
+}
+
+func TestProxyEnv(t *testing.T) {
+	params := newTestParams()
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+	metadata := &metav1.ObjectMeta{
+		Name:      "hello",
+		Namespace: "default",
+		Annotations: map[string]string{
+			proxyMetadataAnnotation: `{"ISTIO_META_DNS_CAPTURE":"true"}`,
+			proxyEnvAnnotation:      "ISTIO_META_CLUSTER_ID: cluster-2\nISTIO_META_DNS_CAPTURE: \"false\"\n",
+		},
+	}
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "hello", Image: "fake.docker.io/google-samples/hello-go-gke:1.0"}},
+	}
+	sic, _, err := injectionData(sidecarTemplate, valuesConfig, "", &metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}, metadata, spec,
+		metadata, params.Mesh.DefaultConfig, params.Mesh, nil)
+	if err != nil {
+		t.Fatalf("injectionData() failed: %v", err)
+	}
+	proxy := FindSidecar(sic.Containers)
+	if proxy == nil {
+		t.Fatalf("no proxy container injected")
+	}
+	env := map[string][]string{}
+	for _, e := range proxy.Env {
+		env[e.Name] = append(env[e.Name], e.Value)
+	}
+	for name, want := range map[string]string{
+		// The annotation wins over the template.
+		"ISTIO_META_CLUSTER_ID": "cluster-2",
+		// The annotation wins over the proxy metadata.
+		"ISTIO_META_DNS_CAPTURE": "false",
+	} {
+		if got := env[name]; !reflect.DeepEqual(got, []string{want}) {
+			t.Errorf("env %s: got %v, want [%s]", name, got, want)
+		}
+	}
+}
+
+func TestInjectedEnvOrder(t *testing.T) {
+	params := newTestParams()
+	params.TopologyAware = true
+	params.TuneProxyMemoryFromLimit = true
+	params.Mesh.DefaultConfig.ProxyMetadata = map[string]string{
+		"ISTIO_META_ZONE":        "zone-1",
+		"ISTIO_META_DNS_CAPTURE": "true",
+	}
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+	metadata := &metav1.ObjectMeta{
+		Name:      "hello",
+		Namespace: "default",
+		Annotations: map[string]string{
+			trustDomainAnnotation: "tenant.example.org",
+		},
+	}
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "hello", Image: "fake.docker.io/google-samples/hello-go-gke:1.0"}},
+	}
+
+	var envs [][]corev1.EnvVar
+	for i := 0; i < 2; i++ {
+		sic, _, err := injectionData(sidecarTemplate, valuesConfig, "", &metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			metadata, spec, metadata, params.Mesh.DefaultConfig, params.Mesh, nil)
+		if err != nil {
+			t.Fatalf("injectionData() failed: %v", err)
+		}
+		proxy := FindSidecar(sic.Containers)
+		if proxy == nil {
+			t.Fatalf("no proxy container injected")
+		}
+		envs = append(envs, proxy.Env)
+	}
+	if !reflect.DeepEqual(envs[0], envs[1]) {
+		t.Fatalf("the env of the proxy differs between injections:\n%v\n%v", envs[0], envs[1])
+	}
+
+	// The variables appended to the template come last, sorted by name.
+	var names []string
+	for _, e := range envs[0] {
+		names = append(names, e.Name)
+	}
+	want := []string{"ISTIO_META_DNS_CAPTURE", "ISTIO_META_PROXY_MEMORY_THRESHOLD", "ISTIO_META_ZONE", "NODE_NAME", "TRUST_DOMAIN"}
+	if len(names) < len(want) || !reflect.DeepEqual(names[len(names)-len(want):], want) {
+		t.Fatalf("got env %v, want it to end with %v", names, want)
+	}
+}
+
+func TestJobProxyQuitEnv(t *testing.T) {
+	cases := []struct {
+		in       string
+		wantEnv  bool
+		disabled bool
+	}{
+		{in: "job.yaml", wantEnv: true},
+		{in: "cronjob.yaml", wantEnv: true},
+		{in: "hello.yaml"},
+		// Knative pods serve requests, their proxy stops along with them.
+		{in: "knative-service.yaml"},
+		{in: "job.yaml", disabled: true},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s disabled=%v", c.in, c.disabled), func(t *testing.T) {
+			params := newTestParams()
+			params.StatusPort = DefaultStatusPort
+			params.JobProxyQuitEnv = !c.disabled
+			params.CustomPodTemplates = knativeServiceTemplates
+			out, _, err := injectTestFile(c.in, params, t)
+			if err != nil {
+				t.Fatalf("IntoResourceFile() returned an error: %v", err)
+			}
+			// The output ends with a document separator.
+			raw := bytes.TrimSuffix(out, []byte("---\n"))
+			var podSpec *corev1.PodSpec
+			if obj, err := FromRawToObject(raw); err == nil {
+				if _, _, _, podSpec, err = podTemplateOf(obj); err != nil {
+					t.Fatal(err)
+				}
+			} else if runtime.IsNotRegisteredError(err) {
+				// Knative Services are unknown to the scheme, their pod template is decoded as is.
+				var service struct {
+					Spec struct {
+						Template corev1.PodTemplateSpec `json:"template"`
+					} `json:"spec"`
+				}
+				if err := yaml.Unmarshal(raw, &service); err != nil {
+					t.Fatal(err)
+				}
+				podSpec = &service.Spec.Template.Spec
+			} else {
+				t.Fatal(err)
+			}
+			if FindSidecar(podSpec.Containers) == nil {
+				t.Fatalf("%s was not injected:\n%s", c.in, raw)
+			}
+			for _, container := range podSpec.Containers {
+				var got string
+				for _, e := range container.Env {
+					if e.Name == ProxyQuitURLEnv {
+						got = e.Value
+					}
+				}
+				want := ""
+				if c.wantEnv && container.Name != ProxyContainerName {
+					want = "http://127.0.0.1:15020/quitquitquit"
+				}
+				if got != want {
+					t.Errorf("container %q: got %s %q, want %q", container.Name, ProxyQuitURLEnv, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyNodeNameEnv(t *testing.T) {
+	nodeName := corev1.EnvVar{
+		Name:      "NODE_NAME",
+		ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"}},
+	}
+	custom := corev1.EnvVar{Name: "NODE_NAME", Value: "node-1"}
+	podName := corev1.EnvVar{Name: "POD_NAME", Value: "hello"}
+	cases := []struct {
+		name          string
+		topologyAware bool
+		env           []corev1.EnvVar
+		want          []corev1.EnvVar
+	}{
+		{
+			name: "not topology aware",
+			env:  []corev1.EnvVar{podName},
+			want: []corev1.EnvVar{podName},
+		},
+		{
+			name:          "added",
+			topologyAware: true,
+			env:           []corev1.EnvVar{podName},
+			want:          []corev1.EnvVar{podName, nodeName},
+		},
+		{
+			name:          "already declared",
+			topologyAware: true,
+			env:           []corev1.EnvVar{custom, podName},
+			want:          []corev1.EnvVar{custom, podName},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sic := &SidecarInjectionSpec{
+				TopologyAware: c.topologyAware,
+				Containers:    []corev1.Container{{Name: ProxyContainerName, Env: c.env}},
+			}
+			applyNodeNameEnv(sic)
+			if got := sic.Containers[0].Env; !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func stripVersion(yaml []byte) []byte {
+	return statusPattern.ReplaceAllLiteral(yaml, []byte(statusReplacement))
+}
+
+func TestInvalidParams(t *testing.T) {
+	cases := []struct {
+		annotation    string
+		paramModifier func(p *Params)
+	}{
+		{
+			annotation: "includeipranges",
+			paramModifier: func(p *Params) {
+				p.IncludeIPRanges = "bad"
+			},
+		},
+		{
+			annotation: "excludeipranges",
+			paramModifier: func(p *Params) {
+				p.ExcludeIPRanges = "*"
+			},
+		},
+		{
+			annotation: "excludeipranges invalid: failed parsing cidr '10.96.0.0/33'",
+			paramModifier: func(p *Params) {
+				p.ExcludeIPRanges = "10.96.0.0/12,10.96.0.0/33"
+			},
+		},
+		{
+			annotation: "includeipranges invalid: failed parsing cidr 'fd00::/129'",
+			paramModifier: func(p *Params) {
+				p.IncludeIPRanges = "10.0.0.0/8,fd00::/129"
+			},
+		},
+		{
+			annotation: "includeipranges",
+			paramModifier: func(p *Params) {
+				p.IncludeIPRanges = longCIDRList(4096)
+			},
+		},
+		{
+			annotation: "excludeipranges",
+			paramModifier: func(p *Params) {
+				p.ExcludeIPRanges = longCIDRList(4096)
+			},
+		},
+		{
+			annotation: "proxyimage",
+			paramModifier: func(p *Params) {
+				p.ProxyImage = "docker.io//proxyv2:"
+			},
+		},
+		{
+			annotation: "proxyimage",
+			paramModifier: func(p *Params) {
+				p.ProxyImage = ProxyImageName(unitTestHub, "")
+			},
+		},
+		{
+			annotation: "initimage",
+			paramModifier: func(p *Params) {
+				p.InitImage = "docker.io/Istio/proxy_init:latest"
+			},
+		},
+		{
+			annotation: "includeinboundports",
+			paramModifier: func(p *Params) {
+				p.IncludeInboundPorts = "bad"
+			},
+		},
+		{
+			annotation: "excludeoutboundports",
+			paramModifier: func(p *Params) {
+				p.ExcludeOutboundPorts = "bad"
+			},
+		},
+		{
+			annotation: "excludeoutboundports",
+			paramModifier: func(p *Params) {
+				p.ExcludeOutboundPorts = "5432,70000"
+			},
+		},
+		{
+			annotation: "kubevirtinterfaces",
+			paramModifier: func(p *Params) {
+				p.KubevirtInterfaces = "net1,net 2"
+			},
+		},
+		{
+			annotation: "trustdomain",
+			paramModifier: func(p *Params) {
+				m := mesh.DefaultMeshConfig()
+				m.TrustDomain = "Example.org/tenant"
+				p.Mesh = &m
+			},
+		},
+		{
+			annotation: "kubevirtinterfaces",
+			paramModifier: func(p *Params) {
+				p.KubevirtInterfaces = "net1,a-very-long-interface-name"
+			},
+		},
+		{
+			annotation: "kubevirtinterfaces invalid: \"net1,,net2\" has an empty entry",
+			paramModifier: func(p *Params) {
+				p.KubevirtInterfaces = "net1,,net2"
+			},
+		},
+		{
+			annotation: "kubevirtinterfaces invalid: \"net1\" is listed more than once",
+			paramModifier: func(p *Params) {
+				p.KubevirtInterfaces = "net1,net2,net1"
+			},
+		},
+		{
+			annotation: "kubevirtinterfaces invalid: \" net2\" is not a valid network interface name",
+			paramModifier: func(p *Params) {
+				p.KubevirtInterfaces = "net1, net2"
+			},
+		},
+		{
+			annotation: "excludeinboundports",
+			paramModifier: func(p *Params) {
+				p.ExcludeInboundPorts = "*"
+			},
+		},
+		{
+			annotation: "proxycabundleconfigmap",
+			paramModifier: func(p *Params) {
+				p.ProxyCABundleConfigMap = "Not_A_Name"
+			},
+		},
+		{
+			annotation: "telemetryudspath",
+			paramModifier: func(p *Params) {
+				p.TelemetryUDSPath = "telemetry.sock"
+			},
+		},
+		{
+			annotation: "telemetryudspath",
+			paramModifier: func(p *Params) {
+				p.TelemetryUDSPath = "/telemetry.sock"
+			},
+		},
+		{
+			annotation: "telemetryudspath",
+			paramModifier: func(p *Params) {
+				p.TelemetryUDSPath = "/etc/istio/proxy/telemetry.sock"
+			},
+		},
+		{
+			annotation: "proxyimagerules",
+			paramModifier: func(p *Params) {
+				p.ProxyImageRules = []ProxyImageRule{{MinContainers: 0, Image: ProxyImageName(unitTestHub, unitTestTag)}}
+			},
+		},
+		{
+			annotation: "proxyimagerules",
+			paramModifier: func(p *Params) {
+				p.ProxyImageRules = []ProxyImageRule{{MinContainers: 3, Image: "docker.io/Istio/proxyv2:latest"}}
+			},
+		},
+		{
+			annotation: "telemetryudsappenv",
+			paramModifier: func(p *Params) {
+				p.TelemetryUDSAppEnv = true
+			},
+		},
+		{
+			annotation: "traffic.sidecar.istio.io/excludeoutboundports (1001 ports)",
+			paramModifier: func(p *Params) {
+				ports := make([]string, 0, 1001)
+				for port := 1; port <= 1001; port++ {
+					ports = append(ports, strconv.Itoa(port))
+				}
+				p.ExcludeOutboundPorts = strings.Join(ports, ",")
+			},
+		},
+		{
+			annotation: "custompodtemplates[0] invalid: at least one path",
+			paramModifier: func(p *Params) {
+				p.CustomPodTemplates = []CustomPodTemplate{{APIVersion: "example.com/v1", Kind: "CanaryApp"}}
+			},
+		},
+		{
+			annotation: "proxyvolumesizelimit invalid",
+			paramModifier: func(p *Params) {
+				p.ProxyVolumeSizeLimit = "64 megabytes"
+			},
+		},
+		{
+			annotation: "statusportname invalid",
+			paramModifier: func(p *Params) {
+				p.StatusPortName = "status_port"
+			},
+		},
+		{
+			annotation: "initseccompprofile invalid",
+			paramModifier: func(p *Params) {
+				p.InitSeccompProfile = "runtime/default"
+			},
+		},
+		{
+			annotation: "imagepullsecrets invalid",
+			paramModifier: func(p *Params) {
+				p.ImagePullSecrets = []string{"regcred", "Private_Registry"}
+			},
+		},
+		{
+			annotation: "list 4 ports, exceeding the limit of 3",
+			paramModifier: func(p *Params) {
+				p.MaxRedirectPorts = 3
+				p.IncludeInboundPorts = "80,8080"
+				p.ExcludeOutboundPorts = "3306,5432"
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.annotation, func(t *testing.T) {
+			params := newTestParams()
+			c.paramModifier(params)
+
+			if err := params.Validate(); err == nil {
+				t.Fatalf("expected error")
+			} else if !strings.Contains(strings.ToLower(err.Error()), c.annotation) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateIPRanges(t *testing.T) {
+	for _, ipRanges := range []string{"::/0", "fd00::/8", "10.0.0.0/8,fd00::/8", "fd00::/8,192.168.0.0/16,2001:db8::/32"} {
+		if err := ValidateIncludeIPRanges(ipRanges); err != nil {
+			t.Errorf("ValidateIncludeIPRanges(%q) returned an error: %v", ipRanges, err)
+		}
+		if err := ValidateExcludeIPRanges(ipRanges); err != nil {
+			t.Errorf("ValidateExcludeIPRanges(%q) returned an error: %v", ipRanges, err)
+		}
+	}
+	// The wildcard only means all ranges when included.
+	if err := ValidateIncludeIPRanges("*"); err != nil {
+		t.Errorf("ValidateIncludeIPRanges(%q) returned an error: %v", "*", err)
+	}
+}
+
+func TestStatusPortRange(t *testing.T) {
+	cases := []struct {
+		name        string
+		statusPort  int
+		wantWarning bool
+	}{
+		{
+			name:       "default",
+			statusPort: DefaultStatusPort,
+		},
+		{
+			name:       "end of the reserved range",
+			statusPort: 15090,
+		},
+		{
+			name:       "disabled",
+			statusPort: 0,
+		},
+		{
+			name:        "outside of the reserved range",
+			statusPort:  8080,
+			wantWarning: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := newTestParams()
+			params.StatusPort = c.statusPort
+			if err := params.Validate(); err != nil {
+				t.Fatalf("Validate() returned an error for status port %d: %v", c.statusPort, err)
+			}
+
+			_, warnings, err := injectTestFile("hello.yaml", params, t)
+			if err != nil {
+				t.Fatalf("IntoResourceFileWithWarnings() returned an error: %v", err)
+			}
+			if !c.wantWarning {
+				if len(warnings) != 0 {
+					t.Fatalf("unexpected warnings: %v", warnings)
+				}
+				return
+			}
+			if len(warnings) != 1 || !strings.Contains(warnings[0], "statusPort 8080") {
+				t.Fatalf("expected a warning about the status port, got %v", warnings)
+			}
+		})
+	}
+}
+
+func TestRequireSameImageRegistry(t *testing.T) {
+	cases := []struct {
+		name       string
+		proxyImage string
+		initImage  string
+		wantErr    bool
+	}{
+		{
+			name:       "same registry",
+			proxyImage: "registry.local:5000/istio/proxyv2:1.4.0",
+			initImage:  "registry.local:5000/istio/proxy_init:1.4.0",
+		},
+		{
+			name:       "implicit docker.io",
+			proxyImage: "istio/proxyv2:1.4.0",
+			initImage:  "docker.io/istio/proxy_init:1.4.0",
+		},
+		{
+			name:       "different registries",
+			proxyImage: "registry.local:5000/istio/proxyv2:1.4.0",
+			initImage:  "docker.io/istio/proxy_init:1.4.0",
+			wantErr:    true,
+		},
+		{
+			name:       "same host, different port",
+			proxyImage: "registry.local:5000/istio/proxyv2:1.4.0",
+			initImage:  "registry.local/istio/proxy_init:1.4.0",
+			wantErr:    true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := newTestParams()
+			params.RequireSameImageRegistry = true
+			params.ProxyImage = c.proxyImage
+			params.InitImage = c.initImage
+
+			err := params.Validate()
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				} else if !strings.Contains(err.Error(), "differs from registry") {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// Mixed registries are only rejected when required.
+			params.RequireSameImageRegistry = false
+			params.InitImage = "gcr.io/istio-release/proxy_init:1.4.0"
+			if err := params.Validate(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// setProxyResources replaces the proxy resources of valuesConfig with the YAML resources.
+func setProxyResources(valuesConfig, resources string, t *testing.T) string {
+	t.Helper()
+	values := chartutil.FromYaml(valuesConfig)
+	global, _ := values["global"].(map[string]interface{})
+	proxy, ok := global["proxy"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("values have no global.proxy")
+	}
+	proxy["resources"] = map[string]interface{}(chartutil.FromYaml(resources))
+	return chartutil.ToYaml(values)
+}
+
+// injectTestFile injects the testdata/inject file name with the sidecar template and the values
+// of params, and returns the output along with the injection warnings.
+func injectTestFile(name string, params *Params, t *testing.T) ([]byte, []string, error) {
+	t.Helper()
+	return injectTestFileWithValues(name, getValues(params, t), params.Mesh, t)
+}
+
+// injectTestFileWithValues is injectTestFile with the values config given as is.
+func injectTestFileWithValues(name, valuesConfig string, mesh *meshapi.MeshConfig, t *testing.T) ([]byte, []string, error) {
+	t.Helper()
+	in, err := os.Open("testdata/inject/" + name)
+	if err != nil {
+		t.Fatalf("Failed to open %q: %v", name, err)
+	}
+	defer func() { _ = in.Close() }()
+	var out bytes.Buffer
+	warnings, err := IntoResourceFileWithWarnings(loadSidecarTemplate(t), valuesConfig, mesh, in, &out)
+	return out.Bytes(), warnings, err
+}
+
+// longCIDRList returns a comma separated list of n distinct /32 CIDRs.
+func longCIDRList(n int) string {
+	cidrs := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		cidrs = append(cidrs, fmt.Sprintf("10.%d.%d.%d/32", i>>16&0xff, i>>8&0xff, i&0xff))
+	}
+	return strings.Join(cidrs, ",")
+}
+
+func TestInvalidAnnotations(t *testing.T) {
+	cases := []struct {
+		annotation string
+		in         string
+	}{
+		{
+			annotation: "includeipranges",
+			in:         "traffic-annotations-bad-includeipranges.yaml",
+		},
+		{
+			annotation: "excludeipranges",
+			in:         "traffic-annotations-bad-excludeipranges.yaml",
+		},
+		{
+			annotation: "includeinboundports",
+			in:         "traffic-annotations-bad-includeinboundports.yaml",
+		},
+		{
+			annotation: "excludeinboundports",
+			in:         "traffic-annotations-bad-excludeinboundports.yaml",
+		},
+		{
+			annotation: "excludeoutboundports",
+			in:         "traffic-annotations-bad-excludeoutboundports.yaml",
+		},
+		{
+			annotation: "idletimeout",
+			in:         "traffic-annotations-bad-idletimeout.yaml",
+		},
+		{
+			annotation: "portprotocols",
+			in:         "traffic-annotations-bad-portprotocols.yaml",
+		},
+		{
+			annotation: "loglevel",
+			in:         "traffic-annotations-bad-loglevel.yaml",
+		},
+		{
+			annotation: "mintlsversion",
+			in:         "traffic-annotations-bad-mintlsversion.yaml",
+		},
+		{
+			annotation: "discoveryaddress",
+			in:         "traffic-annotations-bad-discoveryaddress.yaml",
+		},
+		{
+			annotation: "trustdomain",
+			in:         "traffic-annotations-bad-trustdomain.yaml",
+		},
+		{
+			annotation: "proxycpulimit",
+			in:         "traffic-annotations-bad-proxycpulimit.yaml",
+		},
+		{
+			annotation: "imagepullsecrets",
+			in:         "traffic-annotations-bad-imagepullsecrets.yaml",
+		},
+		{
+			annotation: "sidecar.istio.io/proxyenv",
+			in:         "traffic-annotations-bad-proxyenv.yaml",
+		},
+		{
+			annotation: "sidecar.istio.io/proxysecuritycontext",
+			in:         "traffic-annotations-bad-proxysecuritycontext.yaml",
+		},
+		{
+			annotation: "sidecar.istio.io/proxyargs",
+			in:         "traffic-annotations-bad-proxyargs.yaml",
+		},
+		{
+			annotation: "sidecar.istio.io/uservolume",
+			in:         "traffic-annotations-bad-uservolume.yaml",
+		},
+		{
+			annotation: "sidecar.istio.io/uservolumemount",
+			in:         "traffic-annotations-bad-uservolumemount.yaml",
+		},
+		{
+			// The annotations of pods cannot call the functions of the injection template.
+			annotation: `function "env" not defined`,
+			in:         "traffic-annotations-bad-uservolumemount-env.yaml",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.annotation, func(t *testing.T) {
+			params := newTestParams()
+			sidecarTemplate := loadSidecarTemplate(t)
+			valuesConfig := getValues(params, t)
+			inputFilePath := "testdata/inject/" + c.in
+			in, err := os.Open(inputFilePath)
+			if err != nil {
+				t.Fatalf("Failed to open %q: %v", inputFilePath, err)
+			}
+			defer func() { _ = in.Close() }()
+			var got bytes.Buffer
+			if err = IntoResourceFile(sidecarTemplate, valuesConfig, params.Mesh, in, &got); err == nil {
+				t.Fatalf("expected error")
+			} else if !strings.Contains(strings.ToLower(err.Error()), c.annotation) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestInvalidAnnotationsAggregated(t *testing.T) {
+	params := newTestParams()
+	in, err := ioutil.ReadFile("testdata/inject/traffic-annotations-bad-multiple.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	err = IntoResourceFile(loadSidecarTemplate(t), getValues(params, t), params.Mesh, bytes.NewReader(in), &got)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, name := range []string{annotation.SidecarTrafficIncludeOutboundIPRanges.Name, sidecarIdleTimeoutAnnotation} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error does not report annotation %s: %v", name, err)
+		}
+	}
+}
+
+func TestSkipSCTPPorts(t *testing.T) {
+	cases := []struct {
+		c     corev1.Container
+		ports []string
+	}{
+		{
+			c: corev1.Container{
+				Ports: []corev1.ContainerPort{
+					{
+						ContainerPort: 38412,
+						Protocol:      corev1.ProtocolSCTP,
+					},
+				},
+			},
+		},
+		{
+			c: corev1.Container{
+				Ports: []corev1.ContainerPort{
+					{
+						ContainerPort: 80,
+						Protocol:      corev1.ProtocolTCP,
+					},
+					{
+						ContainerPort: 38412,
+						Protocol:      corev1.ProtocolSCTP,
+					},
+					{
+						ContainerPort: 53,
+						Protocol:      corev1.ProtocolUDP,
+					},
+				},
+			},
+			ports: []string{"80"},
+		},
+		{
+			c: corev1.Container{
+				Ports: []corev1.ContainerPort{
+					{
+						ContainerPort: 9000,
+						Protocol:      corev1.ProtocolTCP,
+					},
+					{
+						ContainerPort: 9000,
+						Protocol:      corev1.ProtocolUDP,
+					},
+					{
+						ContainerPort: 9000,
+						Protocol:      corev1.ProtocolSCTP,
+					},
+				},
+			},
+			ports: []string{"9000"},
+		},
+		{
+			c: corev1.Container{
+				Ports: []corev1.ContainerPort{
+					{
+						ContainerPort: 8080,
+					},
+					{
+						ContainerPort: 8080,
+						Protocol:      corev1.ProtocolSCTP,
+					},
+				},
+			},
+			ports: []string{"8080"},
+		},
+	}
+	for i, c := range cases {
+		if got := getPortsForContainer(c.c); !reflect.DeepEqual(got, append([]string{}, c.ports...)) {
+			t.Fatalf("unexpected ports result for case %d: expect %v, got %v", i, c.ports, got)
+		}
+	}
+}
+
+func TestSkipUDPPorts(t *testing.T) {
+	cases := []struct {
+		c corev1.Container
+		// others are further containers of the pod; when set, the ports of all the containers are checked.
+		others []corev1.Container
+		ports  []string
+	}{
+		{
+			c: corev1.Container{
+				Ports: []corev1.ContainerPort{},
+			},
+		},
+		{
+			c: corev1.Container{
+				Ports: []corev1.ContainerPort{
+					{
+						ContainerPort: 80,
+						Protocol:      corev1.ProtocolTCP,
+					},
+					{
+						ContainerPort: 8080,
+						Protocol:      corev1.ProtocolTCP,
+					},
+				},
+			},
+			ports: []string{"80", "8080"},
+		},
+		{
+			c: corev1.Container{
+				Ports: []corev1.ContainerPort{
+					{
+						ContainerPort: 53,
+						Protocol:      corev1.ProtocolTCP,
+					},
+					{
+						ContainerPort: 53,
+						Protocol:      corev1.ProtocolUDP,
+					},
+				},
+			},
+			ports: []string{"53"},
+		},
+		{
+			c: corev1.Container{
+				Ports: []corev1.ContainerPort{
+					{
+						ContainerPort: 80,
+						Protocol:      corev1.ProtocolTCP,
+					},
+					{
+						ContainerPort: 53,
+						Protocol:      corev1.ProtocolUDP,
+					},
+				},
+			},
+			ports: []string{"80"},
+		},
+		{
+			c: corev1.Container{
+				Ports: []corev1.ContainerPort{
+					{
+						ContainerPort: 53,
+						Protocol:      corev1.ProtocolUDP,
+					},
+				},
+			},
+		},
+		{
+			c: corev1.Container{
+				Name: "app",
+				Ports: []corev1.ContainerPort{
+					{
+						ContainerPort: 80,
+						Protocol:      corev1.ProtocolTCP,
+					},
+					{
+						ContainerPort: 8080,
+						Protocol:      corev1.ProtocolTCP,
+					},
+				},
+			},
+			others: []corev1.Container{
+				{
+					Name: "helper",
+					Ports: []corev1.ContainerPort{
+						{
+							ContainerPort: 8080,
+							Protocol:      corev1.ProtocolTCP,
+						},
+						{
+							ContainerPort: 9090,
+							Protocol:      corev1.ProtocolTCP,
+						},
+					},
+				},
+			},
+			ports: []string{"80", "8080", "9090"},
+		},
+	}
+	for i := range cases {
+		expectPorts := cases[i].ports
+		ports := getPortsForContainer(cases[i].c)
+		if cases[i].others != nil {
+			containers := append([]corev1.Container{cases[i].c}, cases[i].others...)
+			ports = strings.Split(includeInboundPorts(containers), ",")
+
+			var warnings injectionWarnings
+			warnPortConflicts(&metav1.ObjectMeta{Name: "hello"}, containers, &warnings)
+			if len(warnings) != 1 || !strings.Contains(warnings[0], "8080/TCP") {
+				t.Fatalf("unexpected port conflict warnings for case %d: %v", i, warnings)
+			}
+		}
+		if len(ports) != len(expectPorts) {
+			t.Fatalf("unexpect ports result for case %d", i)
+		}
+		for j := 0; j < len(ports); j++ {
+			if ports[j] != expectPorts[j] {
+				t.Fatalf("unexpect ports result for case %d: expect %v, got %v", i, expectPorts, ports)
+			}
+		}
+	}
+}
+
+func TestExcludeNonTCPInboundPorts(t *testing.T) {
+	tcpAndUDP := []corev1.Container{{
+		Name: "app",
+		Ports: []corev1.ContainerPort{
+			{ContainerPort: 80, Protocol: corev1.ProtocolTCP},
+			{ContainerPort: 5353, Protocol: corev1.ProtocolUDP},
+		},
+	}}
+	cases := []struct {
+		name       string
+		include    string
+		containers []corev1.Container
+		exclude    string
+		want       string
+	}{
+		{
+			name:       "wildcard",
+			include:    "*",
+			containers: tcpAndUDP,
+			exclude:    "15020",
+			want:       "15020,5353",
+		},
+		{
+			name:       "explicit include",
+			include:    "80",
+			containers: tcpAndUDP,
+			exclude:    "15020",
+			want:       "15020",
+		},
+		{
+			name:       "already excluded",
+			include:    "*",
+			containers: tcpAndUDP,
+			exclude:    "5353,15020",
+			want:       "5353,15020",
+		},
+		{
+			name:    "sctp of another container",
+			include: "*",
+			containers: append([]corev1.Container{{
+				Name:  "sctp",
+				Ports: []corev1.ContainerPort{{ContainerPort: 38412, Protocol: corev1.ProtocolSCTP}},
+			}}, tcpAndUDP...),
+			exclude: "",
+			want:    "38412,5353",
+		},
+		{
+			// Excluding the port would stop the redirection of its TCP traffic.
+			name:    "port also declared for tcp",
+			include: "*",
+			containers: []corev1.Container{{
+				Name: "dns",
+				Ports: []corev1.ContainerPort{
+					{ContainerPort: 53, Protocol: corev1.ProtocolUDP},
+					{ContainerPort: 53},
+				},
+			}},
+			exclude: "15020",
+			want:    "15020",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := excludeNonTCPInboundPorts(c.include, c.containers, c.exclude); got != c.want {
+				t.Fatalf("excludeNonTCPInboundPorts() got %q, want %q", got, c.want)
+			}
+		})
+	}
+
+	// The init container and the annotation read by the CNI plugin both skip the UDP port.
+	params := newTestParams()
+	params.StatusPort = DefaultStatusPort
+	metadata := &metav1.ObjectMeta{Name: "app", Namespace: "default"}
+	spec := &corev1.PodSpec{Containers: tcpAndUDP}
+	sic, _, err := injectionData(loadSidecarTemplate(t), getValues(params, t), "", &metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		metadata, spec, metadata, params.Mesh.DefaultConfig, params.Mesh, nil)
+	if err != nil {
+		t.Fatalf("injectionData() failed: %v", err)
+	}
+	if len(sic.InitContainers) == 0 {
+		t.Fatalf("no init container injected")
+	}
+	var excluded string
+	command := sic.InitContainers[0].Command
+	for i := 0; i+1 < len(command); i++ {
+		if command[i] == "-d" {
+			excluded = command[i+1]
+		}
+	}
+	if excluded != "15020,5353" {
+		t.Errorf("istio-init excludes %q, want 15020,5353", excluded)
+	}
+	if got := sic.PodRedirectAnnot[annotation.SidecarTrafficExcludeInboundPorts.Name]; got != "15020,5353" {
+		t.Errorf("excludeInboundPorts annotation is %q, want 15020,5353", got)
+	}
+}
+
+// knativeServiceTemplates lists the pod template of Knative Services.
+var knativeServiceTemplates = []CustomPodTemplate{{
+	APIVersion: "serving.knative.dev/v1",
+	Kind:       "Service",
+	Paths:      []string{"spec.template"},
+}}
+
 func newTestParams() *Params {
 	m := mesh.DefaultMeshConfig()
 	return &Params{
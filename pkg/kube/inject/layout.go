@@ -0,0 +1,137 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is focused on keeping the key order of the resources given to kube-inject, so that the
+// injected manifests stay close to the ones kept in source control.
+package inject
+
+import (
+	"fmt"
+
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// keepKeyOrder returns the YAML injected with its mapping keys in the order they have in the YAML
+// original it was injected from. Keys added by the injection follow the original ones, except
+// for the empty values that marshaling the typed object adds, e.g. `creationTimestamp: null` or
+// `status: {}`, which are dropped. The values are the injected ones.
+//
+// This only covers the key order half of keeping manifests close to their source: comments are
+// still lost. Keeping them needs a node preserving parser such as the gopkg.in/yaml.v3 Node API,
+// which this package does not depend on.
+func keepKeyOrder(original, injected []byte) ([]byte, error) {
+	var o, i yamlv2.MapSlice
+	if err := yamlv2.Unmarshal(original, &o); err != nil {
+		return nil, err
+	}
+	if err := yamlv2.Unmarshal(injected, &i); err != nil {
+		return nil, err
+	}
+	return yamlv2.Marshal(mergeKeyOrder(o, i))
+}
+
+// mergeKeyOrder returns injected with the keys of its mappings ordered as in original. The items
+// of sequences are matched by their name, as the injection may insert named items anywhere, e.g.
+// the proxy first with holdApplicationUntilProxyStarts. Sequences of unnamed items are matched by
+// index. Injected items matching no original item are kept as they are.
+func mergeKeyOrder(original, injected interface{}) interface{} {
+	switch inj := injected.(type) {
+	case yamlv2.MapSlice:
+		orig, ok := original.(yamlv2.MapSlice)
+		if !ok {
+			return injected
+		}
+		values := make(map[string]interface{}, len(inj))
+		for _, item := range inj {
+			values[fmt.Sprint(item.Key)] = item.Value
+		}
+		seen := make(map[string]bool, len(orig))
+		merged := make(yamlv2.MapSlice, 0, len(inj))
+		for _, item := range orig {
+			key := fmt.Sprint(item.Key)
+			seen[key] = true
+			if v, ok := values[key]; ok {
+				merged = append(merged, yamlv2.MapItem{Key: item.Key, Value: mergeKeyOrder(item.Value, v)})
+			}
+		}
+		for _, item := range inj {
+			key := fmt.Sprint(item.Key)
+			if !seen[key] && !(marshalingArtifacts[key] && isEmptyYAMLValue(item.Value)) {
+				merged = append(merged, item)
+			}
+		}
+		return merged
+	case []interface{}:
+		orig, ok := original.([]interface{})
+		if !ok {
+			return injected
+		}
+		byName := make(map[string]interface{}, len(orig))
+		for _, v := range orig {
+			if name, ok := yamlItemName(v); ok {
+				byName[name] = v
+			}
+		}
+		merged := make([]interface{}, len(inj))
+		for k, v := range inj {
+			if name, ok := yamlItemName(v); ok {
+				if o, found := byName[name]; found {
+					merged[k] = mergeKeyOrder(o, v)
+				} else {
+					merged[k] = v
+				}
+			} else if k < len(orig) {
+				merged[k] = mergeKeyOrder(orig[k], v)
+			} else {
+				merged[k] = v
+			}
+		}
+		return merged
+	}
+	return injected
+}
+
+// marshalingArtifacts are the keys that marshaling the typed object writes even when they are
+// unset. Only those are dropped when they are new and empty; empty values the injection adds on
+// purpose, such as `emptyDir: {}`, are kept.
+var marshalingArtifacts = map[string]bool{
+	"creationTimestamp": true,
+	"resources":         true,
+	"status":            true,
+}
+
+// yamlItemName returns the name of the sequence item v, if it is a mapping with a name.
+func yamlItemName(v interface{}) (string, bool) {
+	m, ok := v.(yamlv2.MapSlice)
+	if !ok {
+		return "", false
+	}
+	for _, item := range m {
+		if fmt.Sprint(item.Key) == "name" {
+			if name, ok := item.Value.(string); ok {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// isEmptyYAMLValue returns whether v is null or an empty mapping.
+func isEmptyYAMLValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	m, ok := v.(yamlv2.MapSlice)
+	return ok && len(m) == 0
+}
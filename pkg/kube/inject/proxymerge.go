@@ -0,0 +1,266 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"fmt"
+	"strings"
+
+	"istio.io/api/annotation"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ProxyMergeLayer identifies a layer of the proxy container merge pipeline.
+type ProxyMergeLayer string
+
+// Layers of the proxy container merge pipeline, from lowest to highest precedence.
+const (
+	// ProxyMergeLayerTemplate is the proxy container as rendered by the injection template.
+	ProxyMergeLayerTemplate ProxyMergeLayer = "template"
+	// ProxyMergeLayerValues holds the settings of the values config, i.e. the injection params.
+	ProxyMergeLayerValues ProxyMergeLayer = "values"
+	// ProxyMergeLayerAnnotations holds the settings of the pod annotations.
+	ProxyMergeLayerAnnotations ProxyMergeLayer = "annotations"
+)
+
+// ProxyMergeStep records a proxy setting assigned by one layer of the merge pipeline.
+type ProxyMergeStep struct {
+	Layer   ProxyMergeLayer `json:"layer"`
+	Setting string          `json:"setting"`
+	Value   string          `json:"value"`
+}
+
+// proxySetting is a setting of the proxy container resolved by the merge pipeline.
+type proxySetting struct {
+	// name of the setting, as reported in the merge trace.
+	name string
+	// flag of the pilot agent carrying the setting.
+	flag string
+	// values is the path of the setting in the values config.
+	values []string
+	// annotation overriding the setting for a pod.
+	annotation string
+}
+
+var proxySettings = []proxySetting{
+	{
+		name:       "logLevel",
+		flag:       "--proxyLogLevel",
+		values:     []string{"global", "proxy", "logLevel"},
+		annotation: sidecarLogLevelAnnotation,
+	},
+	{
+		name:       "componentLogLevel",
+		flag:       "--proxyComponentLogLevel",
+		values:     []string{"global", "proxy", "componentLogLevel"},
+		annotation: sidecarComponentLogLevelAnnotation,
+	},
+}
+
+// paramOverrides are the injection params that pod annotations override. They are resolved in
+// the values given to the template, which therefore renders the overridden values, whether it
+// reads the params or the annotations.
+var paramOverrides = []proxySetting{
+	{
+		name:       "includeIPRanges",
+		values:     []string{"global", "proxy", "includeIPRanges"},
+		annotation: annotation.SidecarTrafficIncludeOutboundIPRanges.Name,
+	},
+	{
+		name:       "excludeIPRanges",
+		values:     []string{"global", "proxy", "excludeIPRanges"},
+		annotation: annotation.SidecarTrafficExcludeOutboundIPRanges.Name,
+	},
+	{
+		name:       "includeInboundPorts",
+		values:     []string{"global", "proxy", "includeInboundPorts"},
+		annotation: annotation.SidecarTrafficIncludeInboundPorts.Name,
+	},
+	{
+		name:       "excludeInboundPorts",
+		values:     []string{"global", "proxy", "excludeInboundPorts"},
+		annotation: annotation.SidecarTrafficExcludeInboundPorts.Name,
+	},
+	{
+		name:       "excludeOutboundPorts",
+		values:     []string{"global", "proxy", "excludeOutboundPorts"},
+		annotation: annotation.SidecarTrafficExcludeOutboundPorts.Name,
+	},
+	{
+		name:       "statusPort",
+		values:     []string{"global", "proxy", "statusPort"},
+		annotation: annotation.SidecarStatusPort.Name,
+	},
+	{
+		name:       "readinessInitialDelaySeconds",
+		values:     []string{"global", "proxy", "readinessInitialDelaySeconds"},
+		annotation: annotation.SidecarStatusReadinessInitialDelaySeconds.Name,
+	},
+	{
+		name:       "readinessPeriodSeconds",
+		values:     []string{"global", "proxy", "readinessPeriodSeconds"},
+		annotation: annotation.SidecarStatusReadinessPeriodSeconds.Name,
+	},
+	{
+		name:       "readinessFailureThreshold",
+		values:     []string{"global", "proxy", "readinessFailureThreshold"},
+		annotation: annotation.SidecarStatusReadinessFailureThreshold.Name,
+	},
+	{
+		name:       "enableCoreDump",
+		values:     []string{"global", "proxy", "enableCoreDump"},
+		annotation: annotation.SidecarEnableCoreDump.Name,
+	},
+}
+
+// resolveParamOverrides returns values with the params of paramOverrides set to the values of
+// the pod annotations, and the trace of the overrides. For each annotation found, the trace lists
+// the param value, if any, followed by the annotation value. values is left unchanged.
+func resolveParamOverrides(values map[string]interface{}, annotations map[string]string) (map[string]interface{}, []ProxyMergeStep) {
+	var trace []ProxyMergeStep
+	for _, s := range paramOverrides {
+		v, found := annotations[s.annotation]
+		if !found {
+			continue
+		}
+		if param := lookupValue(values, s.values...); param != "" {
+			trace = append(trace, ProxyMergeStep{Layer: ProxyMergeLayerValues, Setting: s.name, Value: param})
+		}
+		values = withValue(values, v, s.values...)
+		trace = append(trace, ProxyMergeStep{Layer: ProxyMergeLayerAnnotations, Setting: s.name, Value: v})
+	}
+	return values, trace
+}
+
+// withValue returns a copy of values with value set at path. Only the maps along the path are
+// copied, the others are shared with values.
+func withValue(values map[string]interface{}, value interface{}, path ...string) map[string]interface{} {
+	out := make(map[string]interface{}, len(values)+1)
+	for k, v := range values {
+		out[k] = v
+	}
+	if len(path) == 1 {
+		out[path[0]] = value
+		return out
+	}
+	next, _ := values[path[0]].(map[string]interface{})
+	out[path[0]] = withValue(next, value, path[1:]...)
+	return out
+}
+
+// traceMerge records in the merge trace of sic that layer set setting to value. The apply
+// functions of the injection call it for the overrides they make to the proxy container.
+func (sic *SidecarInjectionSpec) traceMerge(layer ProxyMergeLayer, setting, value string) {
+	sic.ProxyMergeTrace = append(sic.ProxyMergeTrace, ProxyMergeStep{Layer: layer, Setting: setting, Value: value})
+}
+
+// warnAnnotationOverrides reports every setting of the trace that a pod annotation overrode,
+// along with the value it replaced.
+func warnAnnotationOverrides(trace []ProxyMergeStep, warnings *injectionWarnings) {
+	previous := map[string]ProxyMergeStep{}
+	for _, step := range trace {
+		if step.Layer == ProxyMergeLayerAnnotations {
+			if p, ok := previous[step.Setting]; ok {
+				warnings.warnf("annotation overrode %s: %q (%s) -> %q", step.Setting, p.Value, p.Layer, step.Value)
+			} else {
+				warnings.warnf("annotation overrode %s: unset -> %q", step.Setting, step.Value)
+			}
+		}
+		previous[step.Setting] = step
+	}
+}
+
+// mergeProxyContainer resolves the settings of the sidecar proxy container in a single pass.
+// Each setting starts from the template rendered container, is overridden by the values config
+// and then by the pod annotations. The returned trace lists every layer that set a value, in
+// the order they were applied.
+func mergeProxyContainer(containers []corev1.Container, values map[string]interface{}, annotations map[string]string) []ProxyMergeStep {
+	var proxy *corev1.Container
+	for i := range containers {
+		if containers[i].Name == ProxyContainerName {
+			proxy = &containers[i]
+			break
+		}
+	}
+	if proxy == nil {
+		return nil
+	}
+
+	var trace []ProxyMergeStep
+	for _, s := range proxySettings {
+		value, ok := proxyArg(proxy, s.flag)
+		if ok {
+			trace = append(trace, ProxyMergeStep{Layer: ProxyMergeLayerTemplate, Setting: s.name, Value: value})
+		}
+		if v := lookupValue(values, s.values...); v != "" {
+			value, ok = v, true
+			trace = append(trace, ProxyMergeStep{Layer: ProxyMergeLayerValues, Setting: s.name, Value: value})
+		}
+		if v, found := annotations[s.annotation]; found {
+			value, ok = v, true
+			trace = append(trace, ProxyMergeStep{Layer: ProxyMergeLayerAnnotations, Setting: s.name, Value: value})
+		}
+		if ok {
+			setProxyArg(proxy, s.flag, value)
+		}
+	}
+	return trace
+}
+
+// lookupValue returns the string found at path in the values config, or "" if there is none.
+func lookupValue(values map[string]interface{}, path ...string) string {
+	var cur interface{} = values
+	for _, key := range path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		cur = m[key]
+	}
+	if cur == nil {
+		return ""
+	}
+	return fmt.Sprint(cur)
+}
+
+// proxyArg returns the value of flag in the container args. Both the "--flag=value" and the
+// "--flag value" forms are supported.
+func proxyArg(c *corev1.Container, flag string) (string, bool) {
+	for i, arg := range c.Args {
+		if strings.HasPrefix(arg, flag+"=") {
+			return strings.TrimPrefix(arg, flag+"="), true
+		}
+		if arg == flag && i+1 < len(c.Args) {
+			return c.Args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// setProxyArg sets flag to value in the container args, replacing any existing occurrence.
+func setProxyArg(c *corev1.Container, flag, value string) {
+	for i, arg := range c.Args {
+		if strings.HasPrefix(arg, flag+"=") {
+			c.Args[i] = flag + "=" + value
+			return
+		}
+		if arg == flag && i+1 < len(c.Args) {
+			c.Args[i+1] = value
+			return
+		}
+	}
+	c.Args = append(c.Args, flag+"="+value)
+}
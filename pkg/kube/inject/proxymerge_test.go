@@ -0,0 +1,225 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"istio.io/api/annotation"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMergeProxyContainer(t *testing.T) {
+	logLevelValues := map[string]interface{}{
+		"global": map[string]interface{}{
+			"proxy": map[string]interface{}{
+				"logLevel": "debug",
+			},
+		},
+	}
+	logLevelAnnotations := map[string]string{sidecarLogLevelAnnotation: "trace"}
+
+	tests := []struct {
+		name        string
+		args        []string
+		values      map[string]interface{}
+		annotations map[string]string
+		wantArgs    []string
+		wantTrace   []ProxyMergeStep
+	}{
+		{
+			name:     "nothing set",
+			args:     []string{"proxy", "sidecar"},
+			wantArgs: []string{"proxy", "sidecar"},
+		},
+		{
+			name:     "template only",
+			args:     []string{"proxy", "--proxyLogLevel=info"},
+			wantArgs: []string{"proxy", "--proxyLogLevel=info"},
+			wantTrace: []ProxyMergeStep{
+				{Layer: ProxyMergeLayerTemplate, Setting: "logLevel", Value: "info"},
+			},
+		},
+		{
+			name:     "values override template",
+			args:     []string{"proxy", "--proxyLogLevel", "info"},
+			values:   logLevelValues,
+			wantArgs: []string{"proxy", "--proxyLogLevel", "debug"},
+			wantTrace: []ProxyMergeStep{
+				{Layer: ProxyMergeLayerTemplate, Setting: "logLevel", Value: "info"},
+				{Layer: ProxyMergeLayerValues, Setting: "logLevel", Value: "debug"},
+			},
+		},
+		{
+			name:     "values without template",
+			args:     []string{"proxy"},
+			values:   logLevelValues,
+			wantArgs: []string{"proxy", "--proxyLogLevel=debug"},
+			wantTrace: []ProxyMergeStep{
+				{Layer: ProxyMergeLayerValues, Setting: "logLevel", Value: "debug"},
+			},
+		},
+		{
+			name:        "annotations override values and template",
+			args:        []string{"proxy", "--proxyLogLevel=info"},
+			values:      logLevelValues,
+			annotations: logLevelAnnotations,
+			wantArgs:    []string{"proxy", "--proxyLogLevel=trace"},
+			wantTrace: []ProxyMergeStep{
+				{Layer: ProxyMergeLayerTemplate, Setting: "logLevel", Value: "info"},
+				{Layer: ProxyMergeLayerValues, Setting: "logLevel", Value: "debug"},
+				{Layer: ProxyMergeLayerAnnotations, Setting: "logLevel", Value: "trace"},
+			},
+		},
+		{
+			name:        "annotations without values",
+			args:        []string{"proxy"},
+			annotations: logLevelAnnotations,
+			wantArgs:    []string{"proxy", "--proxyLogLevel=trace"},
+			wantTrace: []ProxyMergeStep{
+				{Layer: ProxyMergeLayerAnnotations, Setting: "logLevel", Value: "trace"},
+			},
+		},
+		{
+			name:        "component log level",
+			args:        []string{"proxy"},
+			annotations: map[string]string{sidecarComponentLogLevelAnnotation: "misc:error,upstream:debug"},
+			wantArgs:    []string{"proxy", "--proxyComponentLogLevel=misc:error,upstream:debug"},
+			wantTrace: []ProxyMergeStep{
+				{Layer: ProxyMergeLayerAnnotations, Setting: "componentLogLevel", Value: "misc:error,upstream:debug"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			containers := []corev1.Container{
+				{Name: "app", Args: []string{"--proxyLogLevel=info"}},
+				{Name: ProxyContainerName, Args: tt.args},
+			}
+			trace := mergeProxyContainer(containers, tt.values, tt.annotations)
+			if !reflect.DeepEqual(trace, tt.wantTrace) {
+				t.Errorf("trace: got %+v, want %+v", trace, tt.wantTrace)
+			}
+			if got := containers[1].Args; !reflect.DeepEqual(got, tt.wantArgs) {
+				t.Errorf("proxy args: got %v, want %v", got, tt.wantArgs)
+			}
+			if got := containers[0].Args; !reflect.DeepEqual(got, []string{"--proxyLogLevel=info"}) {
+				t.Errorf("app container args were modified: %v", got)
+			}
+		})
+	}
+}
+
+func TestAnnotationOverrides(t *testing.T) {
+	params := newTestParams()
+	params.StatusPort = DefaultStatusPort
+	params.ReportAnnotationOverrides = true
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+
+	metadata := &metav1.ObjectMeta{
+		Name:      "hello",
+		Namespace: "default",
+		Annotations: map[string]string{
+			annotation.SidecarTrafficIncludeInboundPorts.Name:     "8080",
+			annotation.SidecarTrafficExcludeOutboundIPRanges.Name: "10.0.0.0/8",
+			annotation.SidecarStatusPort.Name:                     "15021",
+			sidecarLogLevelAnnotation:                             "debug",
+		},
+	}
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "hello", Image: "fake.docker.io/google-samples/hello-go-gke:1.0"}},
+	}
+	var warnings injectionWarnings
+	sic, _, err := injectionData(sidecarTemplate, valuesConfig, "", &metav1.TypeMeta{}, metadata, spec, metadata,
+		params.Mesh.DefaultConfig, params.Mesh, &warnings)
+	if err != nil {
+		t.Fatalf("injectionData() failed: %v", err)
+	}
+
+	// The params are resolved before the template renders them, the proxy flags after.
+	want := []ProxyMergeStep{
+		{Layer: ProxyMergeLayerAnnotations, Setting: "excludeIPRanges", Value: "10.0.0.0/8"},
+		{Layer: ProxyMergeLayerValues, Setting: "includeInboundPorts", Value: params.IncludeInboundPorts},
+		{Layer: ProxyMergeLayerAnnotations, Setting: "includeInboundPorts", Value: "8080"},
+		{Layer: ProxyMergeLayerValues, Setting: "statusPort", Value: "15020"},
+		{Layer: ProxyMergeLayerAnnotations, Setting: "statusPort", Value: "15021"},
+		{Layer: ProxyMergeLayerAnnotations, Setting: "logLevel", Value: "debug"},
+	}
+	var got []ProxyMergeStep
+	for i, step := range sic.ProxyMergeTrace {
+		// Keep the annotation steps, and the step each of them overrode.
+		if step.Layer == ProxyMergeLayerAnnotations {
+			if i > 0 && sic.ProxyMergeTrace[i-1].Setting == step.Setting {
+				got = append(got, sic.ProxyMergeTrace[i-1])
+			}
+			got = append(got, step)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("overrides: got %+v, want %+v", got, want)
+	}
+
+	for _, setting := range []string{"logLevel", "excludeIPRanges", "includeInboundPorts", "statusPort"} {
+		found := false
+		for _, w := range warnings {
+			if strings.Contains(w, "annotation overrode "+setting+":") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("no warning reports the override of %s: %v", setting, warnings)
+		}
+	}
+}
+
+func TestBuildSidecarProxyMergeTrace(t *testing.T) {
+	params := newTestParams()
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+
+	metadata := &metav1.ObjectMeta{
+		Name:      "hello",
+		Namespace: "default",
+		Annotations: map[string]string{
+			proxyEnvAnnotation:    `{"ISTIO_META_FOO": "bar"}`,
+			proxyArgsAnnotation:   `["--concurrency", "4"]`,
+			trustDomainAnnotation: "example.com",
+		},
+	}
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "hello", Image: "fake.docker.io/google-samples/hello-go-gke:1.0"}},
+	}
+	sic, err := BuildSidecar(sidecarTemplate, valuesConfig, params.Mesh, metadata, spec)
+	if err != nil {
+		t.Fatalf("BuildSidecar() failed: %v", err)
+	}
+
+	// Applied in this order after the template renders the proxy.
+	want := []ProxyMergeStep{
+		{Layer: ProxyMergeLayerAnnotations, Setting: "trustDomain", Value: "example.com"},
+		{Layer: ProxyMergeLayerAnnotations, Setting: "env.ISTIO_META_FOO", Value: "bar"},
+		{Layer: ProxyMergeLayerAnnotations, Setting: "extraArgs", Value: "--concurrency 4"},
+	}
+	if !reflect.DeepEqual(sic.ProxyMergeTrace, want) {
+		t.Fatalf("got trace %+v, want %+v", sic.ProxyMergeTrace, want)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is focused on keeping secret-looking env values out of the diagnostic output of the
+// injector: its logs, diffs, warnings and reports.
+package inject
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// redactedValue replaces the value of the sensitive env vars in diagnostic output.
+const redactedValue = "<redacted>"
+
+// sensitiveEnvNameRegexp matches the names of the env vars whose value is redacted.
+var sensitiveEnvNameRegexp = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD|PASSWD|CREDENTIAL|API_?KEY|PRIVATE_?KEY)`)
+
+// redactSensitiveEnabled returns whether valuesConfig asks for the redaction of diagnostic
+// output, which is the default.
+func redactSensitiveEnabled(valuesConfig string) bool {
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(valuesConfig), &values); err != nil {
+		return true
+	}
+	return lookupValue(values, "sidecarInjectorWebhook", "redactSensitive") != "false"
+}
+
+// redactSensitiveEnv returns the JSON document raw, e.g. a pod or a patch, with the value of the
+// env vars having a sensitive name redacted. Their names are kept. Documents that cannot be
+// parsed are redacted as a whole.
+func redactSensitiveEnv(raw []byte) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return redactedValue
+	}
+	out, err := json.Marshal(redactEnvValues(doc))
+	if err != nil {
+		return redactedValue
+	}
+	return string(out)
+}
+
+// redactSensitiveYAML returns the YAML document doc with the value of the env vars having a
+// sensitive name redacted. The order of its keys is kept.
+func redactSensitiveYAML(doc []byte) ([]byte, error) {
+	var node yamlv2.MapSlice
+	if err := yamlv2.Unmarshal(doc, &node); err != nil {
+		return nil, err
+	}
+	return yamlv2.Marshal(redactEnvValues(node))
+}
+
+// redactTrace redacts the value of the env vars having a sensitive name in the merge trace, e.g.
+// those set by the proxyEnv annotation.
+func redactTrace(trace []ProxyMergeStep) {
+	for i := range trace {
+		name := strings.TrimPrefix(trace[i].Setting, "env.")
+		if name != trace[i].Setting && sensitiveEnvNameRegexp.MatchString(name) {
+			trace[i].Value = redactedValue
+		}
+	}
+}
+
+// redactEnvValues redacts the value of every env var of node, at any depth. Env vars are
+// recognized by their shape: an object with a string name and a value.
+func redactEnvValues(node interface{}) interface{} {
+	switch n := node.(type) {
+	case yamlv2.MapSlice:
+		for _, item := range n {
+			if name, ok := item.Value.(string); ok && item.Key == "name" && sensitiveEnvNameRegexp.MatchString(name) {
+				for i := range n {
+					if n[i].Key == "value" {
+						n[i].Value = redactedValue
+					}
+				}
+			}
+		}
+		for i := range n {
+			n[i].Value = redactEnvValues(n[i].Value)
+		}
+	case map[string]interface{}:
+		if name, ok := n["name"].(string); ok && sensitiveEnvNameRegexp.MatchString(name) {
+			if _, ok := n["value"]; ok {
+				n["value"] = redactedValue
+			}
+		}
+		for k, v := range n {
+			n[k] = redactEnvValues(v)
+		}
+	case []interface{}:
+		for i, v := range n {
+			n[i] = redactEnvValues(v)
+		}
+	}
+	return node
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactSensitiveEnv(t *testing.T) {
+	cases := []struct {
+		name   string
+		raw    string
+		secret string
+	}{
+		{
+			name: "pod",
+			raw: `{"spec":{"containers":[{"name":"hello","env":[` +
+				`{"name":"DB_PASSWORD","value":"hunter2"},{"name":"LOG_LEVEL","value":"debug"}]}]}}`,
+			secret: "DB_PASSWORD",
+		},
+		{
+			name: "patch",
+			raw: `[{"op":"add","path":"/spec/containers/-","value":{"name":"istio-proxy","env":[` +
+				`{"name":"api_token","value":"hunter2"},{"name":"LOG_LEVEL","value":"debug"}]}}]`,
+			secret: "api_token",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := redactSensitiveEnv([]byte(c.raw))
+			if strings.Contains(got, "hunter2") {
+				t.Fatalf("secret value not redacted: %s", got)
+			}
+			for _, want := range []string{
+				`{"name":"` + c.secret + `","value":"` + redactedValue + `"}`,
+				`{"name":"LOG_LEVEL","value":"debug"}`,
+			} {
+				if !strings.Contains(got, want) {
+					t.Fatalf("redacted output %s does not contain %s", got, want)
+				}
+			}
+		})
+	}
+
+	if got := redactSensitiveEnv([]byte("not json")); got != redactedValue {
+		t.Fatalf("unparseable document not redacted: %s", got)
+	}
+}
+
+func TestRedactSensitiveEnabled(t *testing.T) {
+	for values, want := range map[string]bool{
+		"":             true,
+		"global: {}\n": true,
+		"sidecarInjectorWebhook:\n  redactSensitive: true\n":  true,
+		"sidecarInjectorWebhook:\n  redactSensitive: false\n": false,
+	} {
+		if got := redactSensitiveEnabled(values); got != want {
+			t.Errorf("redactSensitiveEnabled(%q): got %v, want %v", values, got, want)
+		}
+	}
+}
+
+func TestRedactTrace(t *testing.T) {
+	trace := []ProxyMergeStep{
+		{Layer: ProxyMergeLayerAnnotations, Setting: "env.DB_PASSWORD", Value: "hunter2"},
+		{Layer: ProxyMergeLayerAnnotations, Setting: "env.LOG_LEVEL", Value: "debug"},
+		{Layer: ProxyMergeLayerAnnotations, Setting: "trustDomain", Value: "example.com"},
+	}
+	redactTrace(trace)
+	var warnings injectionWarnings
+	warnAnnotationOverrides(trace, &warnings)
+	for _, w := range warnings {
+		if strings.Contains(w, "hunter2") {
+			t.Fatalf("secret value not redacted: %s", w)
+		}
+	}
+	if trace[0].Value != redactedValue || trace[1].Value != "debug" || trace[2].Value != "example.com" {
+		t.Fatalf("got trace %+v, want only the value of DB_PASSWORD redacted", trace)
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"istio.io/api/annotation"
+	meshconfig "istio.io/api/mesh/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// InjectionReportVersion is the version of the InjectionReport schema. It is bumped whenever a
+// field is removed or changes meaning; new fields may be added within a version.
+const InjectionReportVersion = "v1"
+
+// Reasons an object of a file is reported as skipped.
+const (
+	// SkipReasonUnsupportedKind is reported for objects that carry no pod template, e.g. Services.
+	SkipReasonUnsupportedKind = "UnsupportedKind"
+	// SkipReasonNotInjected is reported for workloads left unchanged, e.g. because they use host
+	// networking or have been injected already.
+	SkipReasonNotInjected = "NotInjected"
+)
+
+// Details of the objects reported with SkipReasonNotInjected.
+const (
+	// SkipDetailHostNetwork is reported for pods using host networking, whose traffic cannot be
+	// redirected without affecting the node.
+	SkipDetailHostNetwork = "HostNetwork"
+	// SkipDetailWindows is reported for pods running on Windows nodes, which the Linux proxy does not
+	// support.
+	SkipDetailWindows = "Windows"
+	// SkipDetailAlreadyInjected is reported for pods that already carry a sidecar.
+	SkipDetailAlreadyInjected = "AlreadyInjected"
+	// SkipDetailInjectDisabled is reported for pods whose sidecar.istio.io/inject annotation
+	// disables injection, when the values honor it.
+	SkipDetailInjectDisabled = "InjectDisabled"
+)
+
+// InjectionReport is the machine readable summary of a directory injection.
+type InjectionReport struct {
+	Version string                `json:"version"`
+	Files   []InjectionFileReport `json:"files"`
+}
+
+// InjectionFileReport lists what happened to the objects of a single file.
+type InjectionFileReport struct {
+	// Path of the file, relative to the injected directory.
+	Path     string            `json:"path"`
+	Injected []InjectionObject `json:"injected"`
+	Skipped  []InjectionObject `json:"skipped"`
+	Warnings []string          `json:"warnings"`
+}
+
+// InjectionObject identifies an object of an injected file.
+type InjectionObject struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	// Reason is only set for skipped objects, and Detail refines it when known.
+	Reason string `json:"reason,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	// Annotations lists the injection annotations of the pod template that were honored.
+	Annotations []string `json:"annotations,omitempty"`
+	// Traffic is the effective traffic redirection of injected objects.
+	Traffic *InjectionTraffic `json:"traffic,omitempty"`
+	// ProxyImage and InitImage are the images of the injected containers.
+	ProxyImage string `json:"proxyImage,omitempty"`
+	InitImage  string `json:"initImage,omitempty"`
+	// ProxyMergeTrace records how the settings of the proxy of injected objects were resolved.
+	ProxyMergeTrace []ProxyMergeStep `json:"proxyMergeTrace,omitempty"`
+}
+
+// InjectionTraffic is the traffic redirection recorded on an injected pod.
+type InjectionTraffic struct {
+	IncludeIPRanges      string `json:"includeIPRanges,omitempty"`
+	ExcludeIPRanges      string `json:"excludeIPRanges,omitempty"`
+	IncludeInboundPorts  string `json:"includeInboundPorts,omitempty"`
+	ExcludeInboundPorts  string `json:"excludeInboundPorts,omitempty"`
+	ExcludeOutboundPorts string `json:"excludeOutboundPorts,omitempty"`
+}
+
+// addObject records the object decoded from raw in the report. Empty documents are ignored.
+func (r *InjectionFileReport) addObject(raw []byte, injected bool, reason string) {
+	if r == nil {
+		return
+	}
+	var object struct {
+		metav1.TypeMeta `json:",inline"`
+		Metadata        metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := yaml.Unmarshal(raw, &object); err != nil || object.Kind == "" {
+		return
+	}
+	o := InjectionObject{
+		Kind:      object.Kind,
+		Name:      object.Metadata.Name,
+		Namespace: object.Metadata.Namespace,
+	}
+	if injected {
+		r.Injected = append(r.Injected, o)
+		return
+	}
+	o.Reason = reason
+	r.Skipped = append(r.Skipped, o)
+}
+
+// addResult records in the report the object in and the result out of its injection. Lists are
+// recorded item by item. The proxy merge trace of injected objects is the one of the sidecar that
+// buildSidecar returns for their pod template.
+func (r *InjectionFileReport) addResult(in runtime.Object, out interface{},
+	buildSidecar func(metadata *metav1.ObjectMeta, spec *corev1.PodSpec) (*SidecarInjectionSpec, error)) {
+	if r == nil {
+		return
+	}
+	if list, ok := in.(*corev1.List); ok {
+		outList := out.(*corev1.List)
+		for i, item := range list.Items {
+			obj, err := FromRawToObject(item.Raw)
+			if err != nil {
+				r.addObject(item.Raw, false, SkipReasonUnsupportedKind)
+				continue
+			}
+			r.addResult(obj, outList.Items[i].Object, buildSidecar)
+		}
+		return
+	}
+
+	outObject := out.(runtime.Object)
+	accessor, err := meta.Accessor(in)
+	if err != nil {
+		return
+	}
+	o := InjectionObject{
+		Kind:      in.GetObjectKind().GroupVersionKind().Kind,
+		Name:      accessor.GetName(),
+		Namespace: accessor.GetNamespace(),
+	}
+	_, _, inMetadata, inSpec, err := podTemplateOf(in)
+	if err != nil {
+		return
+	}
+	if reflect.DeepEqual(in, outObject) {
+		o.Reason = SkipReasonNotInjected
+		switch {
+		case inSpec.HostNetwork:
+			o.Detail = SkipDetailHostNetwork
+		case isWindowsPod(inSpec):
+			o.Detail = SkipDetailWindows
+		case parseInjectionStatus(inMetadata.Annotations) != nil || FindSidecar(inSpec.Containers) != nil:
+			o.Detail = SkipDetailAlreadyInjected
+		case injectAnnotationDisables(inMetadata):
+			o.Detail = SkipDetailInjectDisabled
+		}
+		r.Skipped = append(r.Skipped, o)
+		return
+	}
+
+	_, _, outMetadata, outSpec, err := podTemplateOf(outObject)
+	if err != nil {
+		return
+	}
+	for name := range inMetadata.Annotations {
+		if _, ok := annotationRegistry[name]; ok {
+			o.Annotations = append(o.Annotations, name)
+		}
+	}
+	sort.Strings(o.Annotations)
+	o.Traffic = &InjectionTraffic{
+		IncludeIPRanges:      outMetadata.Annotations[annotation.SidecarTrafficIncludeOutboundIPRanges.Name],
+		ExcludeIPRanges:      outMetadata.Annotations[annotation.SidecarTrafficExcludeOutboundIPRanges.Name],
+		IncludeInboundPorts:  outMetadata.Annotations[annotation.SidecarTrafficIncludeInboundPorts.Name],
+		ExcludeInboundPorts:  outMetadata.Annotations[annotation.SidecarTrafficExcludeInboundPorts.Name],
+		ExcludeOutboundPorts: outMetadata.Annotations[annotation.SidecarTrafficExcludeOutboundPorts.Name],
+	}
+	if proxy := FindSidecar(outSpec.Containers); proxy != nil {
+		o.ProxyImage = proxy.Image
+	}
+	if status := parseInjectionStatus(outMetadata.Annotations); status != nil && len(status.InitContainers) > 0 {
+		for _, c := range outSpec.InitContainers {
+			if c.Name == status.InitContainers[0] {
+				o.InitImage = c.Image
+			}
+		}
+	}
+	if sic, err := buildSidecar(inMetadata, inSpec); err == nil {
+		o.ProxyMergeTrace = sic.ProxyMergeTrace
+	}
+	r.Injected = append(r.Injected, o)
+}
+
+// IntoResourceFileWithReport is like IntoResourceFile, but also returns a report of what was
+// injected into each object of the file, and why the others were skipped.
+func IntoResourceFileWithReport(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig,
+	in io.Reader, out io.Writer) (*InjectionFileReport, error) {
+	report := &InjectionFileReport{
+		Injected: []InjectionObject{},
+		Skipped:  []InjectionObject{},
+		Warnings: []string{},
+	}
+	var warnings injectionWarnings
+	if err := intoResourceFile(sidecarTemplate, valuesConfig, meshconfig, in, out, &warnings, report, nil); err != nil {
+		return nil, err
+	}
+	report.Warnings = append(report.Warnings, warnings...)
+	return report, nil
+}
+
+// IntoResourceDir injects the istio proxy into every kubernetes YAML file found under inDir and
+// writes the result to the same relative path under outDir, which may be inDir to inject the files
+// in place. When reportPath is not empty, the returned report is also written to it as JSON.
+func IntoResourceDir(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig,
+	inDir, outDir, reportPath string) (*InjectionReport, error) {
+	report := &InjectionReport{
+		Version: InjectionReportVersion,
+		Files:   []InjectionFileReport{},
+	}
+	err := filepath.Walk(inDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != inDir && filepath.Clean(path) == filepath.Clean(outDir) {
+			// Do not inject again what has been written so far.
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !isYAMLFile(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(inDir, path)
+		if err != nil {
+			return err
+		}
+		fileReport := InjectionFileReport{
+			Path:     filepath.ToSlash(rel),
+			Injected: []InjectionObject{},
+			Skipped:  []InjectionObject{},
+			Warnings: []string{},
+		}
+		outPath := filepath.Join(outDir, rel)
+		if err = intoResourceDirFile(sidecarTemplate, valuesConfig, meshconfig, path, outPath, &fileReport); err != nil {
+			return err
+		}
+		report.Files = append(report.Files, fileReport)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if reportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ") // nolint: vetshadow
+		if err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(reportPath, data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func intoResourceDirFile(sidecarTemplate string, valuesConfig string, meshconfig *meshconfig.MeshConfig,
+	inPath, outPath string, report *InjectionFileReport) error {
+	// The input is read in full first: outPath is inPath when injecting a directory in place.
+	in, err := ioutil.ReadFile(inPath)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	var warnings injectionWarnings
+	err = intoResourceFile(sidecarTemplate, valuesConfig, meshconfig, bytes.NewReader(in), &out, &warnings, report, nil)
+	report.Warnings = append(report.Warnings, warnings...)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomically(outPath, out.Bytes())
+}
+
+// writeFileAtomically writes data to a temporary file next to path, then renames it to path, so
+// that path is never left partially written.
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func isYAMLFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
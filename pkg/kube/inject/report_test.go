@@ -0,0 +1,275 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIntoResourceDirReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject_report_test")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	inDir := filepath.Join(dir, "in")
+	outDir := filepath.Join(dir, "out")
+	reportPath := filepath.Join(dir, "report.json")
+	for _, f := range []string{"hello.yaml", "hello-host-network.yaml", "apps/hello-service.yaml"} {
+		data, err := ioutil.ReadFile("testdata/inject/" + filepath.Base(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(inDir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	params := newTestParams()
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+	if _, err = IntoResourceDir(sidecarTemplate, valuesConfig, params.Mesh, inDir, outDir, reportPath); err != nil {
+		t.Fatalf("IntoResourceDir() failed: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("report not written: %v", err)
+	}
+
+	// The field names are part of the versioned schema consumed by other tools.
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("report is not valid JSON: %v", err)
+	}
+	if raw["version"] != InjectionReportVersion {
+		t.Fatalf("got version %v, want %v", raw["version"], InjectionReportVersion)
+	}
+	files, ok := raw["files"].([]interface{})
+	if !ok || len(files) == 0 {
+		t.Fatalf("report has no files: %s", data)
+	}
+	for _, f := range files {
+		for _, key := range []string{"path", "injected", "skipped", "warnings"} {
+			if _, ok := f.(map[string]interface{})[key]; !ok {
+				t.Fatalf("file report is missing %q: %v", key, f)
+			}
+		}
+	}
+
+	var got InjectionReport
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	hostNetworkSkipped := InjectionObject{
+		Kind:   "Deployment",
+		Name:   "hello-host-network",
+		Reason: SkipReasonNotInjected,
+		Detail: SkipDetailHostNetwork,
+	}
+	helloInjected := InjectionObject{
+		Kind:       "Deployment",
+		Name:       "hello",
+		Traffic:    &InjectionTraffic{IncludeIPRanges: "*", IncludeInboundPorts: "80", ExcludeInboundPorts: "15020"},
+		ProxyImage: "docker.io/istio/proxyv2:unittest",
+		InitImage:  "docker.io/istio/proxy_init:unittest",
+	}
+	want := InjectionReport{
+		Version: InjectionReportVersion,
+		Files: []InjectionFileReport{
+			{
+				Path:     "apps/hello-service.yaml",
+				Injected: []InjectionObject{},
+				Skipped:  []InjectionObject{{Kind: "Service", Name: "hello", Reason: SkipReasonUnsupportedKind}},
+				Warnings: []string{},
+			},
+			{
+				Path:     "hello-host-network.yaml",
+				Injected: []InjectionObject{},
+				Skipped:  []InjectionObject{hostNetworkSkipped},
+				Warnings: []string{},
+			},
+			{
+				Path:     "hello.yaml",
+				Injected: []InjectionObject{helloInjected},
+				Skipped:  []InjectionObject{},
+				Warnings: []string{},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got report %+v, want %+v", got, want)
+	}
+
+	for _, f := range want.Files {
+		if _, err := os.Stat(filepath.Join(outDir, f.Path)); err != nil {
+			t.Errorf("injected file %q not written: %v", f.Path, err)
+		}
+	}
+}
+
+func TestIntoResourceDirInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject_in_place_test")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	data, err := ioutil.ReadFile("testdata/inject/hello.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "hello.yaml")
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	params := newTestParams()
+	sidecarTemplate := loadSidecarTemplate(t)
+	valuesConfig := getValues(params, t)
+	var want bytes.Buffer
+	if err = IntoResourceFile(sidecarTemplate, valuesConfig, params.Mesh, bytes.NewReader(data), &want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = IntoResourceDir(sidecarTemplate, valuesConfig, params.Mesh, dir, dir, ""); err != nil {
+		t.Fatalf("IntoResourceDir() failed: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want.Bytes())
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected only the injected file to be left in %s, got %d files", dir, len(files))
+	}
+}
+
+func TestIntoResourceFileWithReport(t *testing.T) {
+	traffic := func(includeInboundPorts string) *InjectionTraffic {
+		return &InjectionTraffic{IncludeIPRanges: "*", IncludeInboundPorts: includeInboundPorts, ExcludeInboundPorts: "15020"}
+	}
+	cases := []struct {
+		in                    string
+		honorInjectAnnotation bool
+		wantInjected          []InjectionObject
+		wantSkipped           []InjectionObject
+	}{
+		{
+			in: "list.yaml",
+			wantInjected: []InjectionObject{
+				{Kind: "Deployment", Name: "hello-v1", Traffic: traffic("80"),
+					ProxyImage: "docker.io/istio/proxyv2:unittest", InitImage: "docker.io/istio/proxy_init:unittest"},
+				{Kind: "Deployment", Name: "hello-v2", Traffic: traffic("81"),
+					ProxyImage: "docker.io/istio/proxyv2:unittest", InitImage: "docker.io/istio/proxy_init:unittest"},
+			},
+			wantSkipped: []InjectionObject{},
+		},
+		{
+			in: "traffic-annotations.yaml",
+			wantInjected: []InjectionObject{
+				{
+					Kind: "Deployment",
+					Name: "traffic",
+					Annotations: []string{
+						"traffic.sidecar.istio.io/excludeInboundPorts",
+						"traffic.sidecar.istio.io/excludeOutboundIPRanges",
+						"traffic.sidecar.istio.io/excludeOutboundPorts",
+						"traffic.sidecar.istio.io/includeInboundPorts",
+						"traffic.sidecar.istio.io/includeOutboundIPRanges",
+					},
+					Traffic: &InjectionTraffic{
+						IncludeIPRanges:      "127.0.0.1/24,10.96.0.1/24",
+						ExcludeIPRanges:      "10.96.0.2/24,10.96.0.3/24",
+						IncludeInboundPorts:  "1,2,3",
+						ExcludeInboundPorts:  "4,5,6,15020",
+						ExcludeOutboundPorts: "7,8,9",
+					},
+					ProxyImage: "docker.io/istio/proxyv2:unittest",
+					InitImage:  "docker.io/istio/proxy_init:unittest",
+					ProxyMergeTrace: []ProxyMergeStep{
+						{Layer: ProxyMergeLayerValues, Setting: "includeIPRanges", Value: "*"},
+						{Layer: ProxyMergeLayerAnnotations, Setting: "includeIPRanges", Value: "127.0.0.1/24,10.96.0.1/24"},
+						{Layer: ProxyMergeLayerAnnotations, Setting: "excludeIPRanges", Value: "10.96.0.2/24,10.96.0.3/24"},
+						{Layer: ProxyMergeLayerValues, Setting: "includeInboundPorts", Value: "*"},
+						{Layer: ProxyMergeLayerAnnotations, Setting: "includeInboundPorts", Value: "1,2,3"},
+						{Layer: ProxyMergeLayerAnnotations, Setting: "excludeInboundPorts", Value: "4,5,6"},
+						{Layer: ProxyMergeLayerAnnotations, Setting: "excludeOutboundPorts", Value: "7,8,9"},
+					},
+				},
+			},
+			wantSkipped: []InjectionObject{},
+		},
+		{
+			in:           "hello.yaml.injected",
+			wantInjected: []InjectionObject{},
+			wantSkipped: []InjectionObject{
+				{Kind: "Deployment", Name: "hello", Reason: SkipReasonNotInjected, Detail: SkipDetailAlreadyInjected},
+			},
+		},
+		{
+			in:                    "hello-ignore.yaml",
+			honorInjectAnnotation: true,
+			wantInjected:          []InjectionObject{},
+			wantSkipped: []InjectionObject{
+				{Kind: "Deployment", Name: "hello", Reason: SkipReasonNotInjected, Detail: SkipDetailInjectDisabled},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			params := newTestParams()
+			params.HonorInjectAnnotation = c.honorInjectAnnotation
+			sidecarTemplate := loadSidecarTemplate(t)
+			valuesConfig := getValues(params, t)
+			in, err := os.Open("testdata/inject/" + c.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = in.Close() }()
+
+			report, err := IntoResourceFileWithReport(sidecarTemplate, valuesConfig, params.Mesh, in, ioutil.Discard)
+			if err != nil {
+				t.Fatalf("IntoResourceFileWithReport() returned an error: %v", err)
+			}
+			if !reflect.DeepEqual(report.Injected, c.wantInjected) {
+				t.Errorf("got injected %+v, want %+v", report.Injected, c.wantInjected)
+			}
+			if !reflect.DeepEqual(report.Skipped, c.wantSkipped) {
+				t.Errorf("got skipped %+v, want %+v", report.Skipped, c.wantSkipped)
+			}
+			if _, err := json.Marshal(report); err != nil {
+				t.Fatalf("report is not JSON serializable: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is focused on the security context of the injected containers, e.g. to meet the
+// restricted Pod Security Standard.
+package inject
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// proxySecurityContextAnnotation holds a JSON securityContext merged onto the one of the proxy.
+	proxySecurityContextAnnotation = "sidecar.istio.io/proxySecurityContext"
+	// seccompAnnotationPrefix, followed by the name of a container, is the annotation selecting the
+	// seccomp profile of the container. Security contexts have no seccompProfile field, so the
+	// profiles of the injected containers are set through it.
+	seccompAnnotationPrefix = "container.seccomp.security.alpha.kubernetes.io/"
+)
+
+// seccompProfile is the seccompProfile field of later versions of corev1.SecurityContext.
+type seccompProfile struct {
+	Type             string `json:"type"`
+	LocalhostProfile string `json:"localhostProfile,omitempty"`
+}
+
+// validateProxySecurityContext validates the proxySecurityContext annotation, a JSON object of the
+// fields of a container security context.
+func validateProxySecurityContext(value string) error {
+	_, _, err := parseProxySecurityContext(value)
+	return err
+}
+
+// parseProxySecurityContext returns the fields of the proxySecurityContext annotation, without
+// its seccompProfile, along with the value of the seccomp annotation matching that profile, if
+// any.
+func parseProxySecurityContext(value string) (map[string]interface{}, string, error) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return nil, "", fmt.Errorf("proxySecurityContext invalid, expected a JSON object: %v", err)
+	}
+
+	var seccomp string
+	if raw, ok := fields["seccompProfile"]; ok {
+		delete(fields, "seccompProfile")
+		b, _ := json.Marshal(raw)
+		var profile seccompProfile
+		if err := json.Unmarshal(b, &profile); err != nil {
+			return nil, "", fmt.Errorf("proxySecurityContext invalid seccompProfile: %v", err)
+		}
+		switch {
+		case profile.Type == "RuntimeDefault":
+			seccomp = "runtime/default"
+		case profile.Type == "Unconfined":
+			seccomp = "unconfined"
+		case profile.Type == "Localhost" && profile.LocalhostProfile != "":
+			seccomp = "localhost/" + profile.LocalhostProfile
+		default:
+			return nil, "", fmt.Errorf("proxySecurityContext invalid seccompProfile: %s", b)
+		}
+	}
+
+	// Unknown fields are rejected rather than silently dropped.
+	b, _ := json.Marshal(fields)
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&corev1.SecurityContext{}); err != nil {
+		return nil, "", fmt.Errorf("proxySecurityContext invalid: %v", err)
+	}
+	return fields, seccomp, nil
+}
+
+// applyProxySecurityContext merges the proxySecurityContext annotation onto the security context
+// of the proxy. Objects, such as capabilities, are merged field by field, while other values,
+// lists included, replace the ones of the template.
+func applyProxySecurityContext(sic *SidecarInjectionSpec, annotations map[string]string) {
+	value, ok := annotations[proxySecurityContextAnnotation]
+	if !ok {
+		return
+	}
+	// The annotation has been validated already.
+	fields, seccomp, _ := parseProxySecurityContext(value)
+	if seccomp != "" {
+		setSeccompAnnotation(sic, ProxyContainerName, seccomp)
+	}
+	proxy := FindSidecar(sic.Containers)
+	if proxy == nil {
+		return
+	}
+
+	merged := map[string]interface{}{}
+	if proxy.SecurityContext != nil {
+		b, _ := json.Marshal(proxy.SecurityContext)
+		_ = json.Unmarshal(b, &merged)
+	}
+	mergeJSONObject(merged, fields)
+	b, _ := json.Marshal(merged)
+	securityContext := &corev1.SecurityContext{}
+	if err := json.Unmarshal(b, securityContext); err != nil {
+		return
+	}
+	proxy.SecurityContext = securityContext
+	sic.traceMerge(ProxyMergeLayerAnnotations, "securityContext", value)
+}
+
+// mergeJSONObject sets the fields of src in dst, merging the objects both of them have.
+func mergeJSONObject(dst, src map[string]interface{}) {
+	for name, value := range src {
+		srcObject, srcOK := value.(map[string]interface{})
+		dstObject, dstOK := dst[name].(map[string]interface{})
+		if srcOK && dstOK {
+			mergeJSONObject(dstObject, srcObject)
+			continue
+		}
+		dst[name] = value
+	}
+}
+
+// applyInitSeccompProfile sets the seccomp profile of the istio-init container to the
+// InitSeccompProfile of sic, when both are set. In CNI mode the init container is not injected.
+func applyInitSeccompProfile(sic *SidecarInjectionSpec) error {
+	if sic.InitSeccompProfile == "" {
+		return nil
+	}
+	value, err := seccompAnnotationValue(sic.InitSeccompProfile)
+	if err != nil {
+		return fmt.Errorf("initSeccompProfile invalid: %v", err)
+	}
+	for _, c := range sic.InitContainers {
+		if c.Name == "istio-init" {
+			setSeccompAnnotation(sic, c.Name, value)
+		}
+	}
+	return nil
+}
+
+// seccompAnnotationValue returns the value of the seccomp annotation selecting profile, one of
+// RuntimeDefault, Unconfined or the path of a profile of the nodes prefixed with localhost/.
+func seccompAnnotationValue(profile string) (string, error) {
+	switch {
+	case profile == "RuntimeDefault":
+		return "runtime/default", nil
+	case profile == "Unconfined":
+		return "unconfined", nil
+	case strings.HasPrefix(profile, "localhost/") && len(profile) > len("localhost/"):
+		return profile, nil
+	}
+	return "", fmt.Errorf("%q is not RuntimeDefault, Unconfined nor localhost/<profile>", profile)
+}
+
+// setSeccompAnnotation records the seccomp profile of the injected container name in the
+// annotations of sic.
+func setSeccompAnnotation(sic *SidecarInjectionSpec, name, value string) {
+	if sic.SeccompAnnotations == nil {
+		sic.SeccompAnnotations = map[string]string{}
+	}
+	sic.SeccompAnnotations[seccompAnnotationPrefix+name] = value
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is focused on sharing the telemetry UDS of the sidecar with the application.
+package inject
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// telemetryUDSVolumeName is the name of the volume holding the telemetry UDS of the proxy.
+	telemetryUDSVolumeName = "istio-telemetry-uds"
+	// telemetryUDSProxyEnv is the variable the template gives the proxy the socket path in.
+	telemetryUDSProxyEnv = "ISTIO_META_TELEMETRY_UDS_PATH"
+	// TelemetryUDSAppEnv is the variable the application container gets the socket path in.
+	TelemetryUDSAppEnv = "ISTIO_TELEMETRY_UDS_PATH"
+)
+
+// telemetryUDSAppInjection returns the index of the first application container of the pod, along
+// with the volume mount and env var that give it access to the telemetry UDS of the proxy. The
+// index is -1 when there is nothing to inject.
+func telemetryUDSAppInjection(podSpec *corev1.PodSpec, spec *SidecarInjectionSpec) (int, corev1.VolumeMount, corev1.EnvVar) {
+	if !spec.TelemetryUDSAppEnv {
+		return -1, corev1.VolumeMount{}, corev1.EnvVar{}
+	}
+	sidecar := FindSidecar(spec.Containers)
+	if sidecar == nil {
+		return -1, corev1.VolumeMount{}, corev1.EnvVar{}
+	}
+	var mount *corev1.VolumeMount
+	for i := range sidecar.VolumeMounts {
+		if sidecar.VolumeMounts[i].Name == telemetryUDSVolumeName {
+			mount = &sidecar.VolumeMounts[i]
+			break
+		}
+	}
+	var udsPath string
+	for _, e := range sidecar.Env {
+		if e.Name == telemetryUDSProxyEnv {
+			udsPath = e.Value
+			break
+		}
+	}
+	// The template did not set the socket up, e.g. because global.proxy.telemetryUDSPath is empty.
+	if mount == nil || udsPath == "" {
+		return -1, corev1.VolumeMount{}, corev1.EnvVar{}
+	}
+	for i, c := range podSpec.Containers {
+		if c.Name == ProxyContainerName {
+			continue
+		}
+		return i, corev1.VolumeMount{Name: mount.Name, MountPath: mount.MountPath}, corev1.EnvVar{Name: TelemetryUDSAppEnv, Value: udsPath}
+	}
+	return -1, corev1.VolumeMount{}, corev1.EnvVar{}
+}
+
+// applyTelemetryUDSAppEnv mounts the telemetry UDS volume into the first application container of
+// the pod and gives it the path of the socket.
+func applyTelemetryUDSAppEnv(podSpec *corev1.PodSpec, spec *SidecarInjectionSpec) {
+	i, mount, env := telemetryUDSAppInjection(podSpec, spec)
+	if i == -1 {
+		return
+	}
+	c := &podSpec.Containers[i]
+	if !hasEnv(c.Env, env.Name) {
+		c.Env = append(c.Env, env)
+	}
+	if !hasVolumeMount(c.VolumeMounts, mount.Name) {
+		c.VolumeMounts = append(c.VolumeMounts, mount)
+	}
+}
+
+// createTelemetryUDSAppEnvPatch generates the patch for webhook.
+func createTelemetryUDSAppEnvPatch(podSpec *corev1.PodSpec, spec *SidecarInjectionSpec) []rfc6902PatchOperation {
+	i, mount, env := telemetryUDSAppInjection(podSpec, spec)
+	if i == -1 {
+		return nil
+	}
+	c := podSpec.Containers[i]
+	var patch []rfc6902PatchOperation
+	if !hasEnv(c.Env, env.Name) {
+		patch = append(patch, appendPatch(len(c.Env) == 0, fmt.Sprintf("/spec/containers/%d/env", i), env))
+	}
+	if !hasVolumeMount(c.VolumeMounts, mount.Name) {
+		patch = append(patch, appendPatch(len(c.VolumeMounts) == 0, fmt.Sprintf("/spec/containers/%d/volumeMounts", i), mount))
+	}
+	return patch
+}
+
+// appendPatch returns the operation appending value to the array at path, creating the array when
+// it is empty.
+func appendPatch(first bool, path string, value interface{}) rfc6902PatchOperation {
+	if first {
+		return rfc6902PatchOperation{Op: "add", Path: path, Value: []interface{}{value}}
+	}
+	return rfc6902PatchOperation{Op: "add", Path: path + "/-", Value: value}
+}
+
+func hasEnv(env []corev1.EnvVar, name string) bool {
+	for _, e := range env {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasVolumeMount(mounts []corev1.VolumeMount, name string) bool {
+	for _, m := range mounts {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,346 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is focused on reverting the injection of the sidecar, to get the workload back as it
+// was declared, e.g. from a manifest kept in source control.
+package inject
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"istio.io/api/annotation"
+	"istio.io/istio/pilot/cmd/pilot-agent/status"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	yamlDecoder "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// redirectAnnotations are the annotations the injector writes through the podRedirectAnnot of the
+// template. They hold the effective value of the setting, so they are written whether the pod
+// declared them or not. The injection status records the ones the pod declared.
+var redirectAnnotations = []string{
+	annotation.SidecarInterceptionMode.Name,
+	annotation.SidecarTrafficIncludeOutboundIPRanges.Name,
+	annotation.SidecarTrafficExcludeOutboundIPRanges.Name,
+	annotation.SidecarTrafficIncludeInboundPorts.Name,
+	annotation.SidecarTrafficExcludeInboundPorts.Name,
+	annotation.SidecarTrafficExcludeOutboundPorts.Name,
+	annotation.SidecarTrafficKubevirtInterfaces.Name,
+}
+
+// Uninject removes the istio proxy from the kubernetes YAML read from in, and writes the result
+// to out. The containers, volumes and image pull secrets removed are the ones recorded in the
+// sidecar.istio.io/status annotation, which also records the other changes reverted, e.g. the
+// tolerations added and the redirect annotations the pod declared. Objects without it are written
+// unchanged.
+func Uninject(in io.Reader, out io.Writer) error {
+	reader := yamlDecoder.NewYAMLReader(bufio.NewReaderSize(in, 4096))
+	for {
+		raw, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if isEmptyDocument(raw) {
+			// Like for the injection, the comments of documents without object are kept.
+			if len(bytes.TrimSpace(raw)) == 0 {
+				continue
+			}
+			if err = writeDocument(out, raw, false); err != nil {
+				return err
+			}
+			continue
+		}
+
+		obj, err := FromRawToObject(raw)
+		if err != nil && !runtime.IsNotRegisteredError(err) {
+			return err
+		}
+
+		var updated []byte
+		if err == nil {
+			outObject, err := uninjectObject(obj) // nolint: vetshadow
+			if err != nil {
+				return err
+			}
+			if updated, err = yaml.Marshal(outObject); err != nil {
+				return err
+			}
+		} else {
+			updated = raw // unchanged
+		}
+
+		if err = writeDocument(out, updated, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uninjectObject returns a copy of in without the injected sidecar. Lists are uninjected item by
+// item.
+func uninjectObject(in runtime.Object) (interface{}, error) {
+	out := in.DeepCopyObject()
+
+	if list, ok := out.(*corev1.List); ok {
+		result := list
+
+		for i, item := range list.Items {
+			obj, err := FromRawToObject(item.Raw)
+			if runtime.IsNotRegisteredError(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			r, err := uninjectObject(obj) // nolint: vetshadow
+			if err != nil {
+				return nil, err
+			}
+
+			re := runtime.RawExtension{}
+			re.Object = r.(runtime.Object)
+			result.Items[i] = re
+		}
+		return result, nil
+	}
+
+	_, _, metadata, podSpec, err := podTemplateOf(out)
+	if err != nil {
+		return out, err
+	}
+	injected := parseInjectionStatus(metadata.Annotations)
+	if injected == nil {
+		return out, nil
+	}
+	uninjectPod(metadata, podSpec, injected)
+	return out, nil
+}
+
+// uninjectPod removes from the pod template of metadata and podSpec what its injection status
+// records, along with the annotations and labels added by the injector. The redirect annotations
+// the pod declared are given back their declared value.
+func uninjectPod(metadata *metav1.ObjectMeta, podSpec *corev1.PodSpec, injected *SidecarInjectionStatus) {
+	// The proxy records the original app probers, which are restored before it is removed.
+	if sidecar := FindSidecar(podSpec.Containers); sidecar != nil {
+		restoreAppProbers(podSpec, sidecar)
+	}
+	podSpec.InitContainers = removeNamedContainers(podSpec.InitContainers, injected.InitContainers)
+	podSpec.Containers = removeNamedContainers(podSpec.Containers, injected.Containers)
+
+	var volumes []corev1.Volume
+	for _, v := range podSpec.Volumes {
+		if !containsString(injected.Volumes, v.Name) {
+			volumes = append(volumes, v)
+		}
+	}
+	podSpec.Volumes = volumes
+	var imagePullSecrets []corev1.LocalObjectReference
+	for _, s := range podSpec.ImagePullSecrets {
+		if !containsString(injected.ImagePullSecrets, s.Name) {
+			imagePullSecrets = append(imagePullSecrets, s)
+		}
+	}
+	podSpec.ImagePullSecrets = imagePullSecrets
+	podSpec.Tolerations = removeTolerations(podSpec.Tolerations, injected.Tolerations)
+	var readinessGates []corev1.PodReadinessGate
+	for _, g := range podSpec.ReadinessGates {
+		if !containsString(injected.ReadinessGates, string(g.ConditionType)) {
+			readinessGates = append(readinessGates, g)
+		}
+	}
+	podSpec.ReadinessGates = readinessGates
+	if injected.ServiceLinksDisabled {
+		podSpec.EnableServiceLinks = nil
+	}
+	if injected.CNINodeAffinity {
+		podSpec.Affinity = removeCNINodeAffinity(podSpec.Affinity)
+	}
+
+	for i := range podSpec.Containers {
+		c := &podSpec.Containers[i]
+		unwrapAppEntrypoint(c)
+		// The application containers may share the volumes of the proxy, e.g. its telemetry UDS.
+		var mounts []corev1.VolumeMount
+		for _, m := range c.VolumeMounts {
+			if !containsString(injected.Volumes, m.Name) {
+				mounts = append(mounts, m)
+			}
+		}
+		c.VolumeMounts = mounts
+		if containsString(injected.Volumes, telemetryUDSVolumeName) {
+			c.Env = removeEnv(c.Env, TelemetryUDSAppEnv)
+		}
+		c.Env = removeEnv(c.Env, ProxyQuitURLEnv)
+	}
+
+	delete(metadata.Annotations, annotation.SidecarStatus.Name)
+	delete(metadata.Annotations, injectionIDAnnotation)
+	delete(metadata.Annotations, ownerAnnotation)
+	delete(metadata.Annotations, injectorVersionAnnotation)
+	for _, names := range [][]string{injected.InitContainers, injected.Containers} {
+		for _, name := range names {
+			delete(metadata.Annotations, seccompAnnotationPrefix+name)
+		}
+	}
+	if injected.SafeToEvict {
+		delete(metadata.Annotations, safeToEvictAnnotation)
+	}
+	// Statuses recorded before the declared redirect annotations have none, and lose them.
+	for _, name := range redirectAnnotations {
+		if value, ok := injected.RedirectAnnotations[name]; ok {
+			metadata.Annotations[name] = value
+		} else {
+			delete(metadata.Annotations, name)
+		}
+	}
+	if metadata.Labels[model.TLSModeLabelName] == model.IstioMutualTLSModeLabel {
+		delete(metadata.Labels, model.TLSModeLabelName)
+	}
+}
+
+// removeNamedContainers returns the containers whose name is not listed in names.
+func removeNamedContainers(containers []corev1.Container, names []string) []corev1.Container {
+	var kept []corev1.Container
+	for _, c := range containers {
+		if !containsString(names, c.Name) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// removeTolerations returns the tolerations that are not in removed.
+func removeTolerations(tolerations, removed []corev1.Toleration) []corev1.Toleration {
+	var kept []corev1.Toleration
+	for _, t := range tolerations {
+		found := false
+		for i := range removed {
+			if reflect.DeepEqual(t, removed[i]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// removeCNINodeAffinity reverts cniNodeAffinity: the requirement of cniNodeLabel is removed from
+// the required node selector terms, and the terms and affinities left empty are dropped.
+func removeCNINodeAffinity(affinity *corev1.Affinity) *corev1.Affinity {
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return affinity
+	}
+	out := affinity.DeepCopy()
+	required := out.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	var terms []corev1.NodeSelectorTerm
+	for _, term := range required.NodeSelectorTerms {
+		var expressions []corev1.NodeSelectorRequirement
+		for _, e := range term.MatchExpressions {
+			if e.Key != cniNodeLabel || e.Operator != corev1.NodeSelectorOpExists {
+				expressions = append(expressions, e)
+			}
+		}
+		term.MatchExpressions = expressions
+		if len(term.MatchExpressions) > 0 || len(term.MatchFields) > 0 {
+			terms = append(terms, term)
+		}
+	}
+	required.NodeSelectorTerms = terms
+	if len(terms) == 0 {
+		out.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = nil
+	}
+	if reflect.DeepEqual(out.NodeAffinity, &corev1.NodeAffinity{}) {
+		out.NodeAffinity = nil
+	}
+	if reflect.DeepEqual(out, &corev1.Affinity{}) {
+		return nil
+	}
+	return out
+}
+
+// removeEnv returns env without the variable name.
+func removeEnv(env []corev1.EnvVar, name string) []corev1.EnvVar {
+	var kept []corev1.EnvVar
+	for _, e := range env {
+		if e.Name != name {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// restoreAppProbers gives back to the application containers the HTTP probers the sidecar took
+// over, as recorded in its ISTIO_KUBE_APP_PROBERS variable. Named ports are recorded resolved.
+func restoreAppProbers(podSpec *corev1.PodSpec, sidecar *corev1.Container) {
+	var probers status.KubeAppProbers
+	for _, e := range sidecar.Env {
+		if e.Name == status.KubeAppProberEnvName {
+			if err := json.Unmarshal([]byte(e.Value), &probers); err != nil {
+				log.Warnf("failed to decode the app probers of the sidecar: %v", err)
+				return
+			}
+		}
+	}
+	restore := func(probe *corev1.Probe, url string) {
+		if probe == nil || probe.HTTPGet == nil || probe.HTTPGet.Path != url {
+			return
+		}
+		if h, ok := probers[url]; ok && h != nil {
+			probe.HTTPGet = h.DeepCopy()
+		}
+	}
+	for i := range podSpec.Containers {
+		c := &podSpec.Containers[i]
+		if c.Name == ProxyContainerName {
+			continue
+		}
+		readyz, livez := status.FormatProberURL(c.Name)
+		restore(c.ReadinessProbe, readyz)
+		restore(c.LivenessProbe, livez)
+		restore(c.StartupProbe, status.FormatStartupProberURL(c.Name))
+	}
+}
+
+// unwrapAppEntrypoint restores the command and arguments of a container whose entrypoint was
+// wrapped to wait for the sidecar.
+func unwrapAppEntrypoint(c *corev1.Container) {
+	wrapperPrefix := appEntrypointWrapperScript[:strings.Index(appEntrypointWrapperScript, "%d")]
+	if len(c.Command) != 3 || c.Command[0] != "/bin/sh" || c.Command[1] != "-c" ||
+		!strings.HasPrefix(c.Command[2], wrapperPrefix) || len(c.Args) == 0 {
+		return
+	}
+	c.Command = c.Args[:1]
+	c.Args = c.Args[1:]
+	if len(c.Args) == 0 {
+		c.Args = nil
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestUninject(t *testing.T) {
+	cases := []struct {
+		in                  string
+		rewriteAppHTTPProbe bool
+		appEntrypoint       bool
+		skipInjection       bool
+		params              func(p *Params)
+	}{
+		{
+			in: "hello.yaml",
+		},
+		{
+			in:                  "app_probe/hello-readiness.yaml",
+			rewriteAppHTTPProbe: true,
+		},
+		{
+			in:            "hello-entrypoint-wrapper.yaml",
+			appEntrypoint: true,
+		},
+		{
+			// The redirect annotations the pod declared are kept, with their declared value.
+			in: "traffic-annotations.yaml",
+		},
+		{
+			in: "hello-interception-none.yaml",
+		},
+		{
+			// The tolerations, readiness gates and other changes of the pod spec are reverted,
+			// while those the pod declared are kept.
+			in: "hello-tolerations.yaml",
+			params: func(p *Params) {
+				p.ProxyTolerations = []corev1.Toleration{
+					{Key: "istio.io/mesh", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+					{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "app", Effect: corev1.TaintEffectNoSchedule},
+				}
+				p.ReadinessGates = []string{"istio.io/mesh-ready"}
+				p.DisableServiceLinks = true
+				p.NodeDrainAware = true
+				p.EnableCni = true
+				p.RequireCNINodeAffinity = true
+			},
+		},
+		{
+			in: "hello-readiness-gates.yaml",
+			params: func(p *Params) {
+				p.ReadinessGates = []string{"www.example.com/feature-1", "istio.io/mesh-ready"}
+			},
+		},
+		{
+			// Uninjecting a workload that was never injected leaves it unchanged.
+			in:            "hello.yaml",
+			skipInjection: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			original, err := ioutil.ReadFile("testdata/inject/" + c.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			injected := original
+			if !c.skipInjection {
+				params := newTestParams()
+				params.RewriteAppHTTPProbe = c.rewriteAppHTTPProbe
+				params.AppEntrypointWrapper = c.appEntrypoint
+				if c.params != nil {
+					c.params(params)
+				}
+				sidecarTemplate := loadSidecarTemplate(t)
+				valuesConfig := getValues(params, t)
+				var out bytes.Buffer
+				if err := IntoResourceFile(sidecarTemplate, valuesConfig, params.Mesh, bytes.NewReader(original), &out); err != nil {
+					t.Fatalf("IntoResourceFile() returned an error: %v", err)
+				}
+				injected = out.Bytes()
+			}
+
+			var got bytes.Buffer
+			if err := Uninject(bytes.NewReader(injected), &got); err != nil {
+				t.Fatalf("Uninject() returned an error: %v", err)
+			}
+
+			want, err := FromRawToObject(original)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The output ends with a document separator.
+			gotObject, err := FromRawToObject(bytes.TrimSuffix(got.Bytes(), []byte("---\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotObject, want) {
+				t.Fatalf("uninjected object differs from the original:\ngot:\n%s\nwant:\n%s", got.Bytes(), original)
+			}
+		})
+	}
+}
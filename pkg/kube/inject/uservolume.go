@@ -0,0 +1,155 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is focused on the volumes pods add to the sidecar through the userVolume and
+// userVolumeMount annotations, e.g. to give the proxy a custom CA bundle.
+package inject
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// userVolumeTemplateFuncs are the only functions the annotations may call when templated. The
+// annotations are set by whoever creates the pod, so they must not reach the functions of the
+// injection template, e.g. env, which reads the environment of the injector.
+var userVolumeTemplateFuncs = template.FuncMap{
+	"valueOrDefault": valueOrDefault,
+}
+
+// userVolumeTemplateData is what the annotations may reference when templated, e.g.
+// {{ .DeploymentMeta.Namespace }}.
+type userVolumeTemplateData struct {
+	DeploymentMeta *metav1.ObjectMeta
+	ObjectMeta     *metav1.ObjectMeta
+}
+
+// validateUserVolume validates the userVolume annotation, a JSON array of volumes. A JSON object
+// of volume names to volumes is accepted as well.
+func validateUserVolume(value string) error {
+	_, err := renderUserVolumes(value, &metav1.ObjectMeta{}, &metav1.ObjectMeta{})
+	return err
+}
+
+// validateUserVolumeMount validates the userVolumeMount annotation, a JSON object of volume names
+// to the mount of that volume into the proxy.
+func validateUserVolumeMount(value string) error {
+	_, err := renderUserVolumeMounts(value, &metav1.ObjectMeta{}, &metav1.ObjectMeta{})
+	return err
+}
+
+// renderUserVolumes returns the volumes of the userVolume annotation once rendered with the
+// metadata of the workload and of its pod template.
+func renderUserVolumes(value string, deploymentMeta, objectMeta *metav1.ObjectMeta) ([]corev1.Volume, error) {
+	rendered, err := renderUserVolumeTemplate("userVolume", value, deploymentMeta, objectMeta)
+	if err != nil {
+		return nil, err
+	}
+	return parseUserVolumes(rendered)
+}
+
+// renderUserVolumeMounts returns the mounts of the userVolumeMount annotation once rendered with
+// the metadata of the workload and of its pod template.
+func renderUserVolumeMounts(value string, deploymentMeta, objectMeta *metav1.ObjectMeta) ([]corev1.VolumeMount, error) {
+	rendered, err := renderUserVolumeTemplate("userVolumeMount", value, deploymentMeta, objectMeta)
+	if err != nil {
+		return nil, err
+	}
+	return parseUserVolumeMounts(rendered)
+}
+
+// renderUserVolumeTemplate renders the annotation name of the given value, with
+// userVolumeTemplateFuncs only.
+func renderUserVolumeTemplate(name, value string, deploymentMeta, objectMeta *metav1.ObjectMeta) (string, error) {
+	t, err := template.New(name).Funcs(userVolumeTemplateFuncs).Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("%s invalid template: %v", name, err)
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, userVolumeTemplateData{DeploymentMeta: deploymentMeta, ObjectMeta: objectMeta}); err != nil {
+		return "", fmt.Errorf("%s invalid template: %v", name, err)
+	}
+	return out.String(), nil
+}
+
+// parseUserVolumes returns the volumes of the userVolume annotation, in the order of the array or
+// sorted by name when given as an object.
+func parseUserVolumes(value string) ([]corev1.Volume, error) {
+	var volumes []corev1.Volume
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		if err := decodeStrictJSON(value, &volumes); err != nil {
+			return nil, fmt.Errorf("userVolume invalid, expected a JSON array of volumes: %v", err)
+		}
+	} else {
+		byName := map[string]corev1.Volume{}
+		if err := decodeStrictJSON(value, &byName); err != nil {
+			return nil, fmt.Errorf("userVolume invalid, expected a JSON array of volumes: %v", err)
+		}
+		for name, v := range byName {
+			v.Name = name
+			volumes = append(volumes, v)
+		}
+		sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	}
+
+	names := map[string]bool{}
+	for _, v := range volumes {
+		if errs := validation.IsDNS1123Label(v.Name); len(errs) > 0 {
+			return nil, fmt.Errorf("userVolume invalid: %q: %s", v.Name, strings.Join(errs, ", "))
+		}
+		if names[v.Name] {
+			return nil, fmt.Errorf("userVolume invalid: %q is declared more than once", v.Name)
+		}
+		names[v.Name] = true
+	}
+	return volumes, nil
+}
+
+// parseUserVolumeMounts returns the mounts of the userVolumeMount annotation, sorted by volume
+// name.
+func parseUserVolumeMounts(value string) ([]corev1.VolumeMount, error) {
+	byName := map[string]corev1.VolumeMount{}
+	if err := decodeStrictJSON(value, &byName); err != nil {
+		return nil, fmt.Errorf("userVolumeMount invalid, expected a JSON object of volume mounts: %v", err)
+	}
+	mounts := make([]corev1.VolumeMount, 0, len(byName))
+	for name, m := range byName {
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return nil, fmt.Errorf("userVolumeMount invalid: %q: %s", name, strings.Join(errs, ", "))
+		}
+		if m.MountPath == "" {
+			return nil, fmt.Errorf("userVolumeMount invalid: %q has no mountPath", name)
+		}
+		m.Name = name
+		mounts = append(mounts, m)
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Name < mounts[j].Name })
+	return mounts, nil
+}
+
+// decodeStrictJSON decodes value into out, rejecting unknown fields rather than silently dropping
+// them, e.g. a misspelled readOnly.
+func decodeStrictJSON(value string, out interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
@@ -30,7 +30,6 @@ import (
 	"github.com/ghodss/yaml"
 	"github.com/howeyc/fsnotify"
 
-	"istio.io/api/annotation"
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/istio/pilot/cmd/pilot-agent/status"
 	"istio.io/istio/pilot/pkg/model"
@@ -67,6 +66,7 @@ type Webhook struct {
 	sidecarTemplateVersion string
 	meshConfig             *meshconfig.MeshConfig
 	valuesConfig           string
+	redactSensitive        bool
 
 	healthCheckInterval time.Duration
 	healthCheckFile     string
@@ -196,6 +196,7 @@ func NewWebhook(p WebhookParameters) (*Webhook, error) {
 		configFile:             p.ConfigFile,
 		valuesFile:             p.ValuesFile,
 		valuesConfig:           valuesConfig,
+		redactSensitive:        redactSensitiveEnabled(valuesConfig),
 		meshFile:               p.MeshFile,
 		watcher:                watcher,
 		healthCheckInterval:    p.HealthCheckInterval,
@@ -274,7 +275,7 @@ func (wh *Webhook) Run(stop <-chan struct{}) {
 				break
 			}
 
-			version := sidecarTemplateVersionHash(sidecarConfig.Template)
+			templateVersion := sidecarTemplateVersionHash(sidecarConfig.Template)
 			pair, err := tls.LoadX509KeyPair(wh.certFile, wh.keyFile)
 			if err != nil {
 				log.Errorf("reload cert error: %v", err)
@@ -283,7 +284,8 @@ func (wh *Webhook) Run(stop <-chan struct{}) {
 			wh.mu.Lock()
 			wh.Config = sidecarConfig
 			wh.valuesConfig = valuesConfig
-			wh.sidecarTemplateVersion = version
+			wh.redactSensitive = redactSensitiveEnabled(valuesConfig)
+			wh.sidecarTemplateVersion = templateVersion
 			wh.meshConfig = meshConfig
 			wh.cert = &pair
 			wh.mu.Unlock()
@@ -320,6 +322,7 @@ type rfc6902PatchOperation struct {
 	Op    string      `json:"op"`
 	Path  string      `json:"path"`
 	Value interface{} `json:"value,omitempty"`
+	From  string      `json:"from,omitempty"`
 }
 
 // JSONPatch `remove` is applied sequentially. Remove items in reverse
@@ -462,6 +465,48 @@ func addImagePullSecrets(target, added []corev1.LocalObjectReference, basePath s
 	return patch
 }
 
+func addTolerations(target, added []corev1.Toleration, basePath string) (patch []rfc6902PatchOperation) {
+	first := len(target) == 0
+	var value interface{}
+	for _, add := range missingTolerations(target, added) {
+		value = add
+		path := basePath
+		if first {
+			first = false
+			value = []corev1.Toleration{add}
+		} else {
+			path += "/-"
+		}
+		patch = append(patch, rfc6902PatchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
+
+func addReadinessGates(target, added []corev1.PodReadinessGate, basePath string) (patch []rfc6902PatchOperation) {
+	first := len(target) == 0
+	var value interface{}
+	for _, add := range missingReadinessGates(target, added) {
+		value = add
+		path := basePath
+		if first {
+			first = false
+			value = []corev1.PodReadinessGate{add}
+		} else {
+			path += "/-"
+		}
+		patch = append(patch, rfc6902PatchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
+
 func addPodDNSConfig(target *corev1.PodDNSConfig, basePath string) (patch []rfc6902PatchOperation) {
 	patch = append(patch, rfc6902PatchOperation{
 		Op:    "add",
@@ -568,6 +613,8 @@ func createPatch(pod *corev1.Pod, prevStatus *SidecarInjectionStatus, annotation
 	patch = append(patch, addContainer(pod.Spec.Containers, sic.Containers, "/spec/containers")...)
 	patch = append(patch, addVolume(pod.Spec.Volumes, sic.Volumes, "/spec/volumes")...)
 	patch = append(patch, addImagePullSecrets(pod.Spec.ImagePullSecrets, sic.ImagePullSecrets, "/spec/imagePullSecrets")...)
+	patch = append(patch, addTolerations(pod.Spec.Tolerations, sic.Tolerations, "/spec/tolerations")...)
+	patch = append(patch, addReadinessGates(pod.Spec.ReadinessGates, sic.ReadinessGates, "/spec/readinessGates")...)
 
 	if sic.DNSConfig != nil {
 		patch = append(patch, addPodDNSConfig(sic.DNSConfig, "/spec/dnsConfig")...)
@@ -577,6 +624,22 @@ func createPatch(pod *corev1.Pod, prevStatus *SidecarInjectionStatus, annotation
 		patch = append(patch, addSecurityContext(pod.Spec.SecurityContext, "/spec/securityContext")...)
 	}
 
+	if sic.RequireCNINodeAffinity {
+		patch = append(patch, rfc6902PatchOperation{
+			Op:    "add",
+			Path:  "/spec/affinity",
+			Value: cniNodeAffinity(pod.Spec.Affinity),
+		})
+	}
+
+	if sic.DisableServiceLinks && pod.Spec.EnableServiceLinks == nil {
+		patch = append(patch, rfc6902PatchOperation{
+			Op:    "add",
+			Path:  "/spec/enableServiceLinks",
+			Value: false,
+		})
+	}
+
 	patch = append(patch, updateAnnotation(pod.Annotations, annotations)...)
 
 	patch = append(patch, addLabels(pod.Labels, map[string]string{model.TLSModeLabelName: model.IstioMutualTLSModeLabel})...)
@@ -584,6 +647,10 @@ func createPatch(pod *corev1.Pod, prevStatus *SidecarInjectionStatus, annotation
 	if rewrite {
 		patch = append(patch, createProbeRewritePatch(pod.Annotations, &pod.Spec, sic)...)
 	}
+	patch = append(patch, createAppEntrypointPatch(pod.Annotations, &pod.Spec, sic)...)
+	patch = append(patch, createTelemetryUDSAppEnvPatch(&pod.Spec, sic)...)
+	// last, as it shifts the indices of the containers the patches above refer to
+	patch = append(patch, createSidecarFirstPatch(&pod.Spec, prevStatus, sic)...)
 
 	return json.Marshal(patch)
 }
@@ -597,24 +664,9 @@ var (
 )
 
 func injectionStatus(pod *corev1.Pod) *SidecarInjectionStatus {
-	var statusBytes []byte
-	if pod.ObjectMeta.Annotations != nil {
-		if value, ok := pod.ObjectMeta.Annotations[annotation.SidecarStatus.Name]; ok {
-			statusBytes = []byte(value)
-		}
-	}
-
 	// default case when injected pod has explicit status
-	var iStatus SidecarInjectionStatus
-	if err := json.Unmarshal(statusBytes, &iStatus); err == nil {
-		// heuristic assumes status is valid if any of the resource
-		// lists is non-empty.
-		if len(iStatus.InitContainers) != 0 ||
-			len(iStatus.Containers) != 0 ||
-			len(iStatus.Volumes) != 0 ||
-			len(iStatus.ImagePullSecrets) != 0 {
-			return &iStatus
-		}
+	if iStatus := parseInjectionStatus(pod.ObjectMeta.Annotations); iStatus != nil {
+		return iStatus
 	}
 
 	// backwards compatibility case when injected pod has legacy
@@ -631,6 +683,15 @@ func toAdmissionResponse(err error) *v1beta1.AdmissionResponse {
 	return &v1beta1.AdmissionResponse{Result: &metav1.Status{Message: err.Error()}}
 }
 
+// diagnostic returns the JSON document raw for the debug logs, with the value of the sensitive env
+// vars redacted unless redaction is disabled.
+func (wh *Webhook) diagnostic(raw []byte) string {
+	if !wh.redactSensitive {
+		return string(raw)
+	}
+	return redactSensitiveEnv(raw)
+}
+
 func (wh *Webhook) inject(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	req := ar.Request
 	var pod corev1.Pod
@@ -648,11 +709,13 @@ func (wh *Webhook) inject(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionRespons
 
 	log.Infof("AdmissionReview for Kind=%v Namespace=%v Name=%v (%v) UID=%v Rfc6902PatchOperation=%v UserInfo=%v",
 		req.Kind, req.Namespace, req.Name, podName, req.UID, req.Operation, req.UserInfo)
-	log.Debugf("Object: %v", string(req.Object.Raw))
-	log.Debugf("OldObject: %v", string(req.OldObject.Raw))
+	if log.DebugEnabled() {
+		log.Debugf("Object: %v", wh.diagnostic(req.Object.Raw))
+		log.Debugf("OldObject: %v", wh.diagnostic(req.OldObject.Raw))
+	}
 
-	if !injectRequired(ignoredNamespaces, wh.Config, &pod.Spec, &pod.ObjectMeta) {
-		log.Infof("Skipping %s/%s due to policy check", pod.ObjectMeta.Namespace, podName)
+	if required, reason := injectDecision(ignoredNamespaces, wh.Config, &pod.Spec, &pod.ObjectMeta); !required {
+		log.Infof("Skipping %s/%s due to policy check: %s", pod.ObjectMeta.Namespace, podName, reason)
 		totalSkippedInjections.Increment()
 		return &v1beta1.AdmissionResponse{
 			Allowed: true,
@@ -716,7 +779,14 @@ func (wh *Webhook) inject(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionRespons
 		return toAdmissionResponse(err)
 	}
 
-	annotations := map[string]string{annotation.SidecarStatus.Name: iStatus}
+	log.Debugf("Proxy merge trace for %s/%s: %+v", pod.ObjectMeta.Namespace, podName, spec.ProxyMergeTrace)
+
+	if err := checkContainerLimit(podName, &pod.Spec, spec); err != nil {
+		handleError(fmt.Sprintf("Injection refused: %v", err))
+		return toAdmissionResponse(err)
+	}
+
+	annotations := injectedAnnotations(spec, &pod.ObjectMeta, iStatus, newInjectionID())
 
 	// Add all additional injected annotations
 	for k, v := range wh.Config.InjectedAnnotations {
@@ -729,7 +799,9 @@ func (wh *Webhook) inject(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionRespons
 		return toAdmissionResponse(err)
 	}
 
-	log.Debugf("AdmissionResponse: patch=%v\n", string(patchBytes))
+	if log.DebugEnabled() {
+		log.Debugf("AdmissionResponse: patch=%v\n", wh.diagnostic(patchBytes))
+	}
 
 	reviewResponse := v1beta1.AdmissionResponse{
 		Allowed: true,
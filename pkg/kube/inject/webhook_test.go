@@ -24,6 +24,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -130,11 +131,58 @@ func parseToLabelSelector(t *testing.T, selector string) *metav1.LabelSelector {
 	return result
 }
 
+// TestInjectDecisionPrecedence covers every combination of the injection policy, the opt-in of the
+// pod, through its annotation or the alwaysInjectSelector, and the inject annotation. Namespace
+// labels are matched by the webhook configuration before the webhook is called, so they are not
+// part of the decision.
+func TestInjectDecisionPrecedence(t *testing.T) {
+	alwaysInject := []metav1.LabelSelector{{MatchLabels: map[string]string{"opt-in": "true"}}}
+	cases := []struct {
+		policy     InjectionPolicy
+		optInLabel bool
+		annotation string
+		want       bool
+		wantReason string
+	}{
+		{InjectionPolicyEnabled, false, "", true, injectReasonPolicyEnabled},
+		{InjectionPolicyEnabled, false, "true", true, injectReasonAnnotationEnabled},
+		{InjectionPolicyEnabled, false, "false", false, injectReasonAnnotationDisabled},
+		{InjectionPolicyEnabled, true, "", true, injectReasonAlwaysInjectSelector},
+		{InjectionPolicyEnabled, true, "true", true, injectReasonAnnotationEnabled},
+		{InjectionPolicyEnabled, true, "false", false, injectReasonAnnotationDisabled},
+		{InjectionPolicyDisabled, false, "", false, injectReasonPolicyDisabled},
+		{InjectionPolicyDisabled, false, "true", true, injectReasonAnnotationEnabled},
+		{InjectionPolicyDisabled, false, "false", false, injectReasonAnnotationDisabled},
+		{InjectionPolicyDisabled, true, "", true, injectReasonAlwaysInjectSelector},
+		{InjectionPolicyDisabled, true, "true", true, injectReasonAnnotationEnabled},
+		{InjectionPolicyDisabled, true, "false", false, injectReasonAnnotationDisabled},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s/optIn=%v/inject=%q", c.policy, c.optInLabel, c.annotation), func(t *testing.T) {
+			meta := &metav1.ObjectMeta{Name: "pod", Namespace: "test-namespace", Annotations: map[string]string{}}
+			if c.optInLabel {
+				meta.Labels = map[string]string{"opt-in": "true"}
+			}
+			if c.annotation != "" {
+				meta.Annotations[annotation.SidecarInject.Name] = c.annotation
+			}
+			config := &Config{Policy: c.policy, AlwaysInjectSelector: alwaysInject}
+			got, reason := injectDecision(nil, config, &corev1.PodSpec{}, meta)
+			if got != c.want || reason != c.wantReason {
+				t.Fatalf("injectDecision() got %v (%s), want %v (%s)", got, reason, c.want, c.wantReason)
+			}
+		})
+	}
+}
+
 func TestInjectRequired(t *testing.T) {
 	podSpec := &corev1.PodSpec{}
 	podSpecHostNetwork := &corev1.PodSpec{
 		HostNetwork: true,
 	}
+	podSpecWindows := &corev1.PodSpec{
+		NodeSelector: map[string]string{"beta.kubernetes.io/os": "windows"},
+	}
 	cases := []struct {
 		config  *Config
 		podSpec *corev1.PodSpec
@@ -247,6 +295,18 @@ func TestInjectRequired(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			config: &Config{
+				Policy: InjectionPolicyEnabled,
+			},
+			podSpec: podSpecWindows,
+			meta: &metav1.ObjectMeta{
+				Name:        "windows",
+				Namespace:   "test-namespace",
+				Annotations: map[string]string{annotation.SidecarInject.Name: "true"},
+			},
+			want: false,
+		},
 		{
 			config: &Config{
 				Policy: "wrong_policy",
@@ -1340,6 +1400,57 @@ func createWebhook(t testing.TB, sidecarTemplate string) (*Webhook, func()) {
 	return wh, cleanup
 }
 
+func TestAddReadinessGates(t *testing.T) {
+	// Appending to the gates of the pod and skipping the ones it has are covered by
+	// hello-readiness-gates.yaml, only the cases specific to the JSON patch are covered here.
+	meshReady := corev1.PodReadinessGate{ConditionType: "istio.io/mesh-ready"}
+	cases := []struct {
+		name  string
+		pod   []corev1.PodReadinessGate
+		added []corev1.PodReadinessGate
+		want  []corev1.PodReadinessGate
+	}{
+		{
+			// The list is added rather than appended to.
+			name:  "no pod readiness gates",
+			added: []corev1.PodReadinessGate{meshReady},
+			want:  []corev1.PodReadinessGate{meshReady},
+		},
+		{
+			name:  "repeated injected readiness gates",
+			added: []corev1.PodReadinessGate{meshReady, meshReady},
+			want:  []corev1.PodReadinessGate{meshReady},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw, err := json.Marshal(corev1.Pod{Spec: corev1.PodSpec{ReadinessGates: c.pod}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			patchBytes, err := json.Marshal(addReadinessGates(c.pod, c.added, "/spec/readinessGates"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			patch, err := jsonpatch.DecodePatch(patchBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err := patch.Apply(raw)
+			if err != nil {
+				t.Fatalf("failed to apply %s: %v", patchBytes, err)
+			}
+			var got corev1.Pod
+			if err := json.Unmarshal(patched, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Spec.ReadinessGates, c.want) {
+				t.Fatalf("got readiness gates %v want %v", got.Spec.ReadinessGates, c.want)
+			}
+		})
+	}
+}
+
 func TestRunAndServe(t *testing.T) {
 	wh, cleanup := createWebhook(t, minimalSidecarTemplate)
 	defer cleanup()